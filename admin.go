@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/habx/service-logfwd/metrics"
+)
+
+// adminAPI serves the administration endpoints, it should only be reachable from trusted networks
+type adminAPI struct {
+	server *Server
+	mux    *http.ServeMux
+}
+
+// clientInfo describes a client in the admin API
+type clientInfo struct {
+	ID            int            `json:"id"`
+	Input         string         `json:"input"`
+	RemoteAddr    string         `json:"remote_addr"`
+	Appname       string         `json:"appname,omitempty"`
+	Tenant        string         `json:"tenant,omitempty"`
+	ArrivalTime   time.Time      `json:"arrival_time"`
+	LastEventTime *time.Time     `json:"last_event_time,omitempty"`
+	TotalNbEvents int            `json:"total_nb_events"`
+	NbBytesRead   int64          `json:"nb_bytes_read"`
+	Connected     bool           `json:"connected"`         // Unset once the client is gone and its last events are being sent
+	Session       bool           `json:"session,omitempty"` // Session of a connectionless input
+	Outputs       map[string]int `json:"outputs"`           // Number of events each output hasn't handled yet
+}
+
+func (srv *Server) listenAdmin() (net.Listener, error) {
+	if srv.config.AdminListenAddr == "" {
+		return nil, nil
+	}
+
+	listener, err := net.Listen("tcp", srv.config.AdminListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", srv.config.AdminListenAddr, err)
+	}
+
+	srv.log.Infow("Listening for admin requests", "addr", srv.config.AdminListenAddr)
+
+	api := &adminAPI{
+		server: srv,
+		mux:    http.NewServeMux(),
+	}
+	api.mux.HandleFunc("/reload", api.reload)
+	api.mux.HandleFunc("/clients", api.clients)
+	api.mux.HandleFunc("/clients/disconnect", api.disconnect)
+	api.mux.Handle("/metrics", metrics.Handler())
+	srv.handleHealth(api.mux)
+
+	// It keeps serving while the events are drained, so that the clients and the readiness can be checked
+	go func() {
+		if err := http.Serve(listener, api.mux); err != nil {
+			srv.log.Fatalw("Couldn't serve admin requests", "err", err)
+		}
+	}()
+
+	return listener, nil
+}
+
+// reload reloads the config like SIGHUP does, the error is returned if the config is invalid
+func (api *adminAPI) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := api.server.reload(); err != nil {
+		api.server.log.Errorw("Couldn't reload config, keeping the current one", "err", err)
+		http.Error(w, fmt.Sprintf("couldn't reload config: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "Reloaded config (generation %d)\n", api.server.current().generation)
+}
+
+// info returns the description of the client, the server must be locked
+func (clt *ClientHandler) info() *clientInfo {
+	clt.stats.Lock()
+	defer clt.stats.Unlock()
+
+	info := &clientInfo{
+		ID:            clt.id,
+		Input:         clt.input,
+		RemoteAddr:    clt.addr.String(),
+		Appname:       clt.appname,
+		ArrivalTime:   clt.arrivalTime,
+		TotalNbEvents: clt.totalNbEvents,
+		NbBytesRead:   atomic.LoadInt64(&clt.nbBytesRead),
+		Connected:     !clt.ended,
+		Session:       clt.Conn == nil,
+		Outputs:       clt.pending.Counts(),
+	}
+	if clt.tenant != nil {
+		info.Tenant = clt.tenant.Name
+	}
+	if !clt.lastEventTime.IsZero() {
+		lastEventTime := clt.lastEventTime
+		info.LastEventTime = &lastEventTime
+	}
+	return info
+}
+
+// clients lists the clients whose events are being handled
+func (api *adminAPI) clients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	srv := api.server
+	srv.Lock()
+	infos := make([]*clientInfo, 0, len(srv.handlers))
+	for _, clt := range srv.handlers {
+		infos = append(infos, clt.info())
+	}
+	srv.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		srv.log.Warnw("Couldn't write clients list", "err", err)
+	}
+}
+
+// disconnect disconnects a client by id or all the clients of an appname, they're disconnected once they're done with
+// their current message
+func (api *adminAPI) disconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	id, appname := query.Get("id"), query.Get("appname")
+	var match func(*clientInfo) bool
+	switch {
+	case id != "" && appname == "":
+		nb, err := strconv.Atoi(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid id %s", id), http.StatusBadRequest)
+			return
+		}
+		match = func(info *clientInfo) bool { return info.ID == nb }
+	case appname != "" && id == "":
+		match = func(info *clientInfo) bool { return info.Appname == appname }
+	default:
+		http.Error(w, "either id or appname is required", http.StatusBadRequest)
+		return
+	}
+
+	srv := api.server
+	ids := []int{}
+	srv.Lock()
+	for _, clt := range srv.handlers {
+		if info := clt.info(); info.Connected && match(info) && clt.kick() {
+			ids = append(ids, clt.id)
+		}
+	}
+	srv.Unlock()
+	sort.Ints(ids)
+
+	if id != "" && len(ids) == 0 {
+		http.Error(w, fmt.Sprintf("no connected client %s (sessions can't be disconnected)", id), http.StatusNotFound)
+		return
+	}
+
+	srv.log.Infow("Disconnecting clients", "clientIDs", ids, "appname", appname)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]int{"disconnected": ids}); err != nil {
+		srv.log.Warnw("Couldn't write disconnected clients", "err", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+func TestAdminDisconnect(t *testing.T) {
+	out := newFakeOutput("out")
+	srv := newTestServer(NewConfig(), nil, out)
+	api := &adminAPI{server: srv}
+	conns := map[string]net.Conn{}
+	for _, appname := range []string{"a", "b"} {
+		conns[appname] = connectClient(srv)
+		if _, err := fmt.Fprintf(conns[appname], "{\"message\": \"m\", \"appname\": %q}\n", appname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The sessions of the connectionless inputs can't be disconnected
+	session := srv.newSessionHandler(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, "udp")
+	session.receive(&clients.LogEvent{Attributes: map[string]interface{}{"message": "m", "appname": "a"}})
+	waitFor(t, "the events", func() bool { return len(out.messages()) == 3 })
+
+	disconnect := func(method, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.disconnect(w, httptest.NewRequest(method, "/clients/disconnect?"+query, nil))
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+	}{
+		{"not a POST", http.MethodGet, "appname=a", http.StatusMethodNotAllowed},
+		{"no client", http.MethodPost, "", http.StatusBadRequest},
+		{"id and appname", http.MethodPost, "id=1&appname=a", http.StatusBadRequest},
+		{"invalid id", http.MethodPost, "id=a", http.StatusBadRequest},
+		{"unknown id", http.MethodPost, "id=1000", http.StatusNotFound},
+		{"session", http.MethodPost, fmt.Sprintf("id=%d", session.id), http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if w := disconnect(test.method, test.query); w.Code != test.status {
+			t.Errorf("%s: got status %d", test.name, w.Code)
+		}
+	}
+
+	w := disconnect(http.MethodPost, "appname=a")
+	response := map[string][]int{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got status %d and body %s", w.Code, w.Body)
+	}
+	if ids := response["disconnected"]; len(ids) != 1 || ids[0] == session.id {
+		t.Errorf("unexpected disconnected clients %v", ids)
+	}
+
+	// Only the connected client of the appname is disconnected
+	if _, err := conns["a"].Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the client wasn't disconnected: %v", err)
+	}
+	waitFor(t, "the disconnection event", func() bool { return len(out.messages()) == 4 })
+	if _, err := fmt.Fprintln(conns["b"], `{"message": "still connected"}`); err != nil {
+		t.Errorf("the other client was disconnected: %s", err)
+	}
+	waitFor(t, "the event of the other client", func() bool { return len(out.messages()) == 5 })
+	if w := disconnect(http.MethodPost, "appname=a"); w.Body.String() != "{\"disconnected\":[]}\n" {
+		t.Errorf("got %s once the client was disconnected", w.Body)
+	}
+
+	srv.shutdown(time.Second)
+}
@@ -1,70 +1,172 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/habx/service-logfwd/clients"
-	"github.com/habx/service-logfwd/clients/list"
+	"github.com/habx/service-logfwd/inputs/logstash"
 	"go.uber.org/zap"
 )
 
 // ClientHandler is structure instantiate for each new (logstash) incoming client
 type ClientHandler struct {
-	server        *Server
-	Conn          net.Conn
-	id            int
+	server           *Server
+	Conn             net.Conn // Connection of the client (nil for the sessions of connectionless inputs)
+	addr             net.Addr
+	id               int
+	input            string // Name of the input, for the metrics
+	nbMalformedLines int
+	arrivalTime      time.Time
+	identity         *clients.Identity
+	tenant           *clients.Tenant
+	log              *zap.SugaredLogger
+	source           *clients.Source  // Set with the first event, once the tenant is known
+	generation       int              // Generation of the reloadable config the source was set with
+	pending          *clients.Pending // Events of the client the outputs haven't handled yet
+	nbBytesRead      int64            // Updated atomically
+
+	// Activity of the client, read by the admin API
+	stats         sync.Mutex
 	totalNbEvents int
-	arrivalTime   time.Time
-	log           *zap.SugaredLogger
-	outputs       []clients.OutputClient
+	lastEventTime time.Time
+	appname       string // Last appname sent by the client
+	ended         bool   // Set once the client stopped being read
+	kicked        bool   // Set when an admin disconnected the client
+}
+
+// countingConn counts the bytes read from a connection
+type countingConn struct {
+	net.Conn
+	nbBytesRead *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.nbBytesRead, int64(n))
+	return n, err
 }
 
 // NewClientHandler instantiates a new client handler
-func (srv *Server) NewClientHandler(conn net.Conn, nb int) *ClientHandler {
+func (srv *Server) NewClientHandler(conn net.Conn, input string, identity *clients.Identity) *ClientHandler {
+	return srv.newClientHandler(conn, conn.RemoteAddr(), input, identity)
+}
+
+// newSessionHandler instantiates a client handler for events that aren't received through a connection
+func (srv *Server) newSessionHandler(addr net.Addr, input string) *ClientHandler {
+	return srv.newClientHandler(nil, addr, input, nil)
+}
+
+func (srv *Server) newClientHandler(
+	conn net.Conn,
+	addr net.Addr,
+	input string,
+	identity *clients.Identity,
+) *ClientHandler {
+	nb := srv.nextClientID()
+	log := srv.log.With("clientID", nb)
+	if identity != nil {
+		log = log.With("clientCN", identity.CommonName)
+	}
+
 	clt := &ClientHandler{
 		server:      srv,
 		Conn:        conn,
+		addr:        addr,
 		id:          nb,
+		input:       input,
 		arrivalTime: time.Now(),
-		log:         srv.log.With("clientID", nb),
+		identity:    identity,
+		log:         log,
+		pending:     clients.NewPending(),
+	}
+	if conn != nil {
+		clt.Conn = &countingConn{Conn: conn, nbBytesRead: &clt.nbBytesRead}
 	}
 
-	clt.createClients()
+	srv.register(clt)
 
 	return clt
 }
 
-func (clt *ClientHandler) createClients() {
-	clt.outputs = make([]clients.OutputClient, 0, len(list.LIST))
-	for _, def := range list.LIST {
-		conf := clt.server.config.OutputClientConfigs[def.Name()]
-		if conf.Enabled() {
-			clt.outputs = append(clt.outputs, def.Create(clt, conf))
-		}
+// setSource sets the tenant of the client and the description of the client given to the outputs with its events.
+// It's set again after a reload, as the tenants are replaced.
+func (clt *ClientHandler) setSource(tenant *clients.Tenant, generation int) {
+	if tenant != nil && clt.tenant == nil {
+		clt.log = clt.log.With("tenant", tenant.Name)
 	}
-}
 
-func (clt *ClientHandler) ID() int {
-	return clt.id
+	// The tenant is read by the admin API
+	clt.server.Lock()
+	clt.tenant = tenant
+	clt.server.Unlock()
+
+	clt.generation = generation
+	clt.source = &clients.Source{
+		ID:       clt.id,
+		Addr:     clt.addr,
+		Identity: clt.identity,
+		Tenant:   tenant,
+		Pending:  clt.pending,
+	}
 }
 
-func (clt *ClientHandler) Addr() net.Addr {
-	return clt.Conn.RemoteAddr()
+// checkTenant checks that an event belongs to the tenant of the client, which is the one of its first event. The
+// tenants are compared by name as they're replaced by the reloads.
+func (clt *ClientHandler) checkTenant(event *clients.LogEvent) error {
+	if clt.source != nil && event.Tenant != nil && (clt.tenant == nil || event.Tenant.Name != clt.tenant.Name) {
+		return errors.New("a client can't send events of several tenants")
+	}
+	return nil
 }
 
-func (clt *ClientHandler) Logger() *zap.SugaredLogger {
-	return clt.log
+// receive accounts for an event received from the client and sends it to the outputs
+func (clt *ClientHandler) receive(event *clients.LogEvent) {
+	eventsReceived.Inc(clt.input, severityNames[event.Severity])
+
+	clt.stats.Lock()
+	clt.totalNbEvents++
+	clt.lastEventTime = time.Now()
+	if appname, ok := event.Attributes["appname"].(string); ok {
+		clt.appname = appname
+	}
+	clt.stats.Unlock()
+
+	clt.send(event)
 }
 
+// send sends an event to the outputs, which are shared by all the clients
 func (clt *ClientHandler) send(event *clients.LogEvent) {
-	for _, out := range clt.outputs {
+	// The outputs aren't closed by a reload until the events being sent to them are, they can block
+	config := clt.server.acquireCurrent()
+	defer config.senders.Done()
+
+	if clt.source == nil {
+		clt.setSource(event.Tenant, config.generation)
+	} else if clt.generation != config.generation {
+		// Events of the default tenant, like the disconnection one, keep the tenant of the client
+		tenant := event.Tenant
+		if tenant == nil {
+			tenant = clt.tenant
+		}
+		clt.log.Infow("Switching to the reloaded config", "generation", config.generation)
+		clt.setSource(tenant, config.generation)
+	}
+
+	if clt.tenant != nil {
+		for k, v := range clt.tenant.Attributes {
+			if _, ok := event.Attributes[k]; !ok {
+				event.Attributes[k] = v
+			}
+		}
+	}
+
+	event.Source = clt.source
+	for _, out := range config.outputClients {
 		out.Send(event)
 	}
 }
@@ -72,6 +174,10 @@ func (clt *ClientHandler) send(event *clients.LogEvent) {
 func (clt *ClientHandler) end() {
 	departure := time.Now()
 
+	clt.stats.Lock()
+	clt.ended = true
+	clt.stats.Unlock()
+
 	// We only log disconnection if at least one event was parsed
 	if clt.totalNbEvents > 0 {
 		clt.send(&clients.LogEvent{
@@ -86,18 +192,76 @@ func (clt *ClientHandler) end() {
 		})
 	}
 
-	if err := clt.Conn.Close(); err != nil {
-		clt.log.Warnw("Issue closing connection", "err", err)
+	if clt.nbMalformedLines > 0 {
+		clt.log.Infow("Client sent malformed lines", "nbMalformedLines", clt.nbMalformedLines)
 	}
 
-	for _, out := range clt.outputs {
-		if err := out.Close(); err != nil {
-			clt.log.Errorf(
-				"Issue closing output client",
-				"clientName", out.Name(),
-				"err", err,
-			)
+	if clt.Conn != nil {
+		if err := clt.Conn.Close(); err != nil {
+			clt.log.Warnw("Issue closing connection", "err", err)
+		}
+	}
+
+	go clt.waitForOutputs()
+}
+
+// waitForOutputs unregisters the client once the outputs have handled all its events
+func (clt *ClientHandler) waitForOutputs() {
+	for nb := clt.pending.Total(); nb > 0; nb = clt.pending.Total() {
+		if !clt.server.outputsSending() {
+			clt.log.Warnw("Outputs stopped before sending all the events", "nbLostEvents", nb)
+			break
 		}
+		time.Sleep(drainCheckPeriod)
+	}
+	clt.server.unregister(clt)
+}
+
+// stopReading makes the client stop reading once it's done with its current message
+func (clt *ClientHandler) stopReading() {
+	clt.stats.Lock()
+	ended := clt.ended
+	clt.stats.Unlock()
+	if ended {
+		// The connection is already closed, its events are still being sent
+		return
+	}
+
+	if err := clt.Conn.SetReadDeadline(time.Now()); err != nil {
+		clt.log.Warnw("Couldn't stop reading from client", "err", err)
+	}
+}
+
+// kick disconnects the client once it's done with its current message. It returns false for the sessions of the
+// connectionless inputs, which can't be disconnected.
+func (clt *ClientHandler) kick() bool {
+	if clt.Conn == nil {
+		return false
+	}
+	clt.stats.Lock()
+	clt.kicked = true
+	clt.stats.Unlock()
+	clt.stopReading()
+	return true
+}
+
+func (clt *ClientHandler) isKicked() bool {
+	clt.stats.Lock()
+	defer clt.stats.Unlock()
+	return clt.kicked
+}
+
+// readFailed logs why the client stopped being read
+func (clt *ClientHandler) readFailed(err error) {
+	switch {
+	case err == io.EOF:
+		clt.log.Infow("Client disconnected")
+	case clt.isKicked():
+		clt.log.Infow("Client disconnected by an admin")
+	case clt.server.isStopping():
+		clt.log.Infow("Client disconnected for shutdown")
+	default:
+		clt.log.Errorw("Couldn't read from client", "err", err)
 	}
 }
 
@@ -118,18 +282,28 @@ func (clt *ClientHandler) run() {
 	*/
 	defer clt.end()
 
-	reader := bufio.NewReaderSize(clt.Conn, clt.server.config.LogstashMaxEventSize)
+	reader := logstash.NewReader(
+		clt.Conn,
+		clt.server.config.LogstashMaxEventSize,
+		clt.server.config.OversizedEventPolicy == "truncate",
+	)
 	for {
-		lineRaw, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				clt.log.Infow("Client disconnected")
-			} else {
-				clt.log.Errorw("Couldn't read from client", "err", err)
-			}
+		lineRaw, truncated, err := reader.ReadLine()
+		if oversized, ok := err.(*logstash.OversizedError); ok {
+			clt.log.Warnw("Discarded oversized line", "size", oversized.Size)
+			linesRead.Inc(clt.input)
+			oversizedLines.Inc(clt.input, "discarded")
+			continue
+		} else if err != nil {
+			clt.readFailed(err)
 			return
 		}
-		if err := clt.ParseLogstashLine(lineRaw); err != nil {
+		linesRead.Inc(clt.input)
+		if truncated {
+			clt.log.Warnw("Truncated oversized line")
+			oversizedLines.Inc(clt.input, "truncated")
+		}
+		if err := clt.ParseLogstashLine(string(lineRaw)); err != nil {
 			clt.log.Errorw("Couldn't parse line from client", "err", err)
 			if _, err := clt.Conn.Write([]byte(err.Error())); err != nil {
 				clt.log.Infow("Couldn't write bye bye message", "err", err)
@@ -139,55 +313,24 @@ func (clt *ClientHandler) run() {
 	}
 }
 
-// https://www.scalyr.com/help/parsing-logs#specialAttrs
-// nolint
-var severityConversions = map[string]clients.Level{
-	"finest":    clients.LvlFinest,
-	"finer":     clients.LvlTrace,
-	"trace":     clients.LvlTrace,
-	"fine":      clients.LvlDebug,
-	"debug":     clients.LvlDebug,
-	"info":      clients.LvlInfo,
-	"notice":    clients.LvlInfo,
-	"warn":      clients.LvlWarning,
-	"warning":   clients.LvlWarning,
-	"error":     clients.LvlError,
-	"fatal":     clients.LvlCritical,
-	"emerg":     clients.LvlCritical,
-	"emergency": clients.LvlCritical,
-	"crit":      clients.LvlCritical,
-	"critical":  clients.LvlCritical,
-	"panic":     clients.LvlCritical,
-	"alert":     clients.LvlCritical,
-	//"i":         LvlInfo,
-	//"w":         LvlWarning,
-	//"err":       LvlError,
-	//"e":         LvlError,
-	//"f":         LvlCritical,
-}
-
+// ParseLogstashLine parses a line received from the client and sends the resulting event to the outputs
 func (clt *ClientHandler) ParseLogstashLine(line string) error {
-	var lineJSON map[string]interface{}
-	authenticated := false
-
 	clt.log.Debugw(
 		"Received from logstash",
 		"line", line,
 	)
 
-	if clt.server.config.LogstashAuthPrefixToken != "" {
-		spl := strings.SplitN(line, " ", 2)
-		if len(spl) != 2 {
-			return errors.New("you need to have an auth prefix")
-		}
-		if spl[0] != clt.server.config.LogstashAuthPrefixToken {
-			return errors.New("wrong auth prefix token authentication")
-		}
-		authenticated = true
-		line = spl[1]
+	// A client with a verified certificate doesn't need the shared logstash authentication
+	event, err := clt.server.parseLogstashLine(line, clt.identity != nil)
+	if err != nil {
+		countFailure(clt.input, err)
 	}
-
-	if err := json.Unmarshal([]byte(line), &lineJSON); err != nil {
+	if malformed, ok := err.(*malformedLineError); ok && clt.server.config.MalformedLinePolicy != "disconnect" {
+		clt.nbMalformedLines++
+		if event = clt.server.malformedEvent(clt.addr, malformed); event == nil {
+			return nil
+		}
+	} else if err != nil {
 		clt.log.Warnw(
 			"Couldn't parse logstash line",
 			"line", line,
@@ -196,66 +339,13 @@ func (clt *ClientHandler) ParseLogstashLine(line string) error {
 		return err
 	}
 
-	// Checking authentication if required
-	if !authenticated && clt.server.config.LogstashAuthKey != "" {
-		value, ok := lineJSON[clt.server.config.LogstashAuthKey]
-		if !ok || clt.server.config.LogstashAuthValue != value {
-			return fmt.Errorf("wrong authentication with key %s", clt.server.config.LogstashAuthKey)
-		}
-		delete(lineJSON, clt.server.config.LogstashAuthKey)
-	}
-
-	event := &clients.LogEvent{
-		Timestamp:  time.Now(),
-		Attributes: lineJSON,
-	}
-
-	// Fetching the timestamp
-	if strTs, ok := event.Attributes["@timestamp"].(string); ok {
-		if timestamp, err := time.Parse(time.RFC3339Nano, strTs); err == nil {
-			event.Timestamp = timestamp
-			delete(event.Attributes, "@timestamp")
-		}
-	}
-
-	// We copy the extra fields to the root (otherwise, scalyr will index them as big chunk of a JSON string)
-	if fields, ok := event.Attributes["@fields"]; ok {
-		if fields, ok := fields.(map[string]interface{}); ok {
-			for k, v := range fields {
-				if _, ok := event.Attributes[k]; !ok {
-					event.Attributes[k] = v
-				}
-			}
-		}
-		delete(event.Attributes, "@fields")
-	}
-
-	if value, ok := event.Attributes["@message"]; ok {
-		event.Attributes["message"] = value
-		delete(event.Attributes, "@message")
-	}
-
-	{ // Fetching the loglevel
-		var levelName string
-		var level clients.Level
-		var ok bool
-		for _, keyName := range []string{"levelName", "levelname"} {
-			if levelName, ok = event.Attributes[keyName].(string); ok {
-				delete(event.Attributes, keyName)
-			}
-		}
-		if ok {
-			if level, ok = severityConversions[strings.ToLower(levelName)]; ok {
-				event.Severity = level
-			}
-		}
-		if !ok {
-			event.Severity = clients.LvlInfo
-		}
+	if err := clt.checkTenant(event); err != nil {
+		authFailures.Inc(clt.input)
+		clt.log.Warnw("Rejected logstash line", "err", err)
+		return err
 	}
 
-	clt.totalNbEvents++
-	clt.send(event)
+	clt.receive(event)
 
 	return nil
 }
@@ -0,0 +1,39 @@
+package clients
+
+import (
+	"fmt"
+)
+
+// Conversions maps the fields of the events to the fields of an output
+type Conversions map[string]string
+
+// UnmarshalYAML replaces the default conversions by the ones of the config file (instead of merging them), like the env
+// vars do
+func (c *Conversions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var conversions map[string]string
+	if err := unmarshal(&conversions); err != nil {
+		return err
+	}
+	*c = conversions
+	return nil
+}
+
+// CheckConversions checks that the fields conversions of an output don't collide: a field can't be converted both to
+// a message field and to another kind of field (session info, tag), and two fields can't be converted to the same
+// session info or tag as only one of them would be kept.
+func CheckConversions(message, other Conversions) error {
+	targets := make(map[string]string, len(other))
+	for key, target := range other {
+		if _, ok := message[key]; ok {
+			return fmt.Errorf("field %s has two conversions", key)
+		}
+		if target == "" {
+			continue
+		}
+		if previous, ok := targets[target]; ok {
+			return fmt.Errorf("fields %s and %s are both converted to %s", previous, key, target)
+		}
+		targets[target] = key
+	}
+	return nil
+}
@@ -3,32 +3,63 @@ package datadog
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/clients/diskqueue"
+	"github.com/habx/service-logfwd/metrics"
 	"go.uber.org/zap"
 )
 
+// connections counts the connections opened to datadog (including the reconnections), by output instance
+var connections = metrics.NewCounter("logfwd_datadog_connections_total", "Connections opened to datadog", "output")
+
+// maxReconnectionDelay is the maximum time between two connection attempts
+const maxReconnectionDelay = time.Minute
+
+// Client sends the events of all the clients through a single connection, the token of each event is the one of the
+// tenant of its client
 type Client struct {
-	srcClient clients.ClientHandler
-	config    *Config // This doesn't belong to us (we MUST not modify it)
-	log       *zap.SugaredLogger
-	events    chan *LogEvent
+	name    string  // Name of the output instance
+	config  *Config // This doesn't belong to us (we MUST not modify it)
+	log     *zap.SugaredLogger
+	events  chan *LogEvent
+	pending int64             // Events received but not sent yet (in memory)
+	queue   *diskqueue.Queue  // Disk queue feeding the events channel, nil if the queue is in memory
+	spill   bool              // The disk queue is only used once the events channel is full
+	reader  *diskqueue.Reader // Reader of the disk queue
+	done    chan struct{}
 }
 
-func NewClient(ch clients.ClientHandler, baseConfig clients.Config) *Client {
+func NewClient(name string, baseConfig clients.Config, log *zap.SugaredLogger) (*Client, error) {
 	config := baseConfig.(*Config)
 	clt := &Client{
-		srcClient: ch,
-		config:    config,
-		log:       ch.Logger().With("log2x", "datadog"),
-		events:    make(chan *LogEvent, config.QueueSize),
+		name:   name,
+		config: config,
+		log:    log.With("log2x", name),
+		events: make(chan *LogEvent, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+
+	if config.QueueOnDisk() {
+		queue, err := config.OpenQueue(name)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open the disk queue of %s: %s", name, err)
+		}
+		clt.queue = queue
+		clt.reader = queue.NewReader()
+		clt.spill = config.OverflowPolicy == clients.OverflowSpill
+		clt.log.Infow("Opened disk queue", "nbEvents", queue.Len(), "truncatedBytes", queue.Truncated())
+		go clt.readQueue()
 	}
 
 	go clt.writeToDatadogTCPInput()
 
-	return clt
+	return clt, nil
 }
 
 // The log event as specified in the API doc
@@ -37,6 +68,49 @@ type LogEvent struct {
 	Severity   clients.Level
 	Attributes map[string]interface{}
 	Tags       map[string]string
+	token      string          // Token of the tenant of the client
+	source     *clients.Source // Client which sent the event
+	seq        uint64          // Sequence number in the disk queue
+	stored     bool            // Read from the disk queue
+	attempts   int             // Attempts to send the event
+}
+
+// storedEvent is an event as it's stored in the disk queue and in the dead letters, with what's needed to send it
+// after a restart. Its token isn't stored, it's the one of its tenant when it's read.
+type storedEvent struct {
+	Event  *LogEvent             `json:"event"`
+	Source *clients.StoredSource `json:"source"`
+}
+
+func newStoredEvent(event *LogEvent) *storedEvent {
+	return &storedEvent{
+		Event:  event,
+		Source: event.source.Store(),
+	}
+}
+
+// decodeEvent decodes a stored event, which fails if its tenant doesn't exist anymore
+func (clt *Client) decodeEvent(record []byte) (*LogEvent, error) {
+	stored := &storedEvent{}
+	if err := json.Unmarshal(record, stored); err != nil {
+		return nil, err
+	}
+	if stored.Event == nil || stored.Source == nil {
+		return nil, errors.New("incomplete event")
+	}
+	source, err := stored.Source.Restore()
+	if err != nil {
+		return nil, err
+	}
+	event := stored.Event
+	event.source = source
+	event.token = clt.token(source)
+	return event, nil
+}
+
+// token returns the token of the events of a client
+func (clt *Client) token(source *clients.Source) string {
+	return source.Tenant.OutputToken(clt.name, string(clt.config.Token))
 }
 
 // Export modifies the content of the event
@@ -63,6 +137,8 @@ func (clt *Client) Send(srcEvent *clients.LogEvent) {
 		Timestamp:  srcEvent.Timestamp.UnixNano() / (1000 * 1000), // nano to milliseconds
 		Attributes: make(map[string]interface{}),
 		Tags:       make(map[string]string),
+		token:      clt.token(srcEvent.Source),
+		source:     srcEvent.Source,
 	}
 	dstEvent.Attributes["ddsource"] = "logfwd"
 
@@ -83,27 +159,254 @@ func (clt *Client) Send(srcEvent *clients.LogEvent) {
 		}
 	}
 
-	clt.events <- dstEvent
+	// Local processes are identified by their credentials
+	if peer, ok := srcEvent.Source.Addr.(*clients.PeerAddr); ok {
+		dstEvent.Tags["peer_pid"] = strconv.Itoa(peer.PID)
+		dstEvent.Tags["peer_uid"] = strconv.Itoa(peer.UID)
+		dstEvent.Tags["peer_gid"] = strconv.Itoa(peer.GID)
+	}
+
+	if tenant := srcEvent.Source.Tenant; tenant != nil {
+		dstEvent.Tags["tenant"] = tenant.Name
+	}
+
+	// The identity of the client is stamped on each event, it can't be overridden by the event itself
+	if identity := srcEvent.Source.Identity; identity != nil {
+		dstEvent.Tags["client_cn"] = identity.CommonName
+		if len(identity.SANs) > 0 {
+			dstEvent.Attributes["client_sans"] = identity.SANs
+		}
+	}
+
+	clt.push(dstEvent)
+}
+
+// Replay sends an event written to the dead letters, with the current token of its tenant
+func (clt *Client) Replay(record []byte) error {
+	event, err := clt.decodeEvent(record)
+	if err != nil {
+		return err
+	}
+	clt.push(event)
+	return nil
+}
+
+// push queues an event, in memory or on the disk
+func (clt *Client) push(event *LogEvent) {
+	// Once events were spilled, the following ones are spilled too until they're sent, so that they keep their order
+	if clt.queue != nil && (!clt.spill || clt.queue.Len() > 0) {
+		clt.store(event)
+		return
+	}
+	clt.enqueue(event)
+}
+
+// enqueue queues an event in memory, the overflow policy is applied when the queue is full
+func (clt *Client) enqueue(event *LogEvent) {
+	atomic.AddInt64(&clt.pending, 1)
+	event.source.Pending.Add(clt.name, 1)
+	if clt.config.OverflowPolicy == clients.OverflowBlock {
+		clt.events <- event
+		return
+	}
+
+	for {
+		select {
+		case clt.events <- event:
+			return
+		default:
+		}
+
+		switch clt.config.OverflowPolicy {
+		case clients.OverflowDropOldest:
+			select {
+			case oldest := <-clt.events:
+				clt.dropOverflow()
+				clt.handled(oldest)
+			default:
+			}
+		case clients.OverflowSpill:
+			clt.handled(event)
+			clt.store(event)
+			return
+		default:
+			clt.dropOverflow()
+			clt.handled(event)
+			return
+		}
+	}
+}
+
+// dropOverflow accounts for an event dropped by the overflow policy
+func (clt *Client) dropOverflow() {
+	clients.OutputEventsOverflowed.Inc(clt.name, clt.config.OverflowPolicy)
+	clients.OutputEventsDropped.Inc(clt.name)
+}
+
+// store writes an event to the disk queue, its client doesn't wait for it to be sent
+func (clt *Client) store(event *LogEvent) {
+	if clt.spill {
+		clients.OutputEventsOverflowed.Inc(clt.name, clients.OverflowSpill)
+	}
+	record, err := json.Marshal(newStoredEvent(event))
+	if err == nil {
+		if clt.config.OverflowPolicy == clients.OverflowDropNewest {
+			err = clt.queue.TryPush(record)
+		} else {
+			err = clt.queue.Push(record)
+		}
+	}
+	if err == diskqueue.ErrFull {
+		clt.dropOverflow()
+	} else if err != nil {
+		clt.log.Warnw(
+			"Couldn't write event to the disk queue",
+			"err", err,
+		)
+		clients.OutputEventsDropped.Inc(clt.name)
+		clients.ReportFailure(clt.name, err)
+		clt.deadLetter(event, err)
+	}
+}
+
+// deadLetter writes an event which couldn't be sent to the dead letters
+func (clt *Client) deadLetter(event *LogEvent, cause error) {
+	if err := clients.DeadLetter(clt.name, newStoredEvent(event), event.attempts, cause); err != nil {
+		clt.log.Errorw(
+			"Couldn't write dead letter",
+			"err", err,
+		)
+	}
+}
+
+// deadLetterRecord writes a record of the disk queue which couldn't be decoded to the dead letters
+func (clt *Client) deadLetterRecord(record []byte, cause error) {
+	if err := clients.DeadLetter(clt.name, json.RawMessage(record), 0, cause); err != nil {
+		clt.log.Errorw(
+			"Couldn't write dead letter",
+			"err", err,
+		)
+	}
+}
+
+// readQueue feeds the writer with the events of the disk queue, until the client is closed
+func (clt *Client) readQueue() {
+	for {
+		record, seq, err := clt.reader.Pop()
+		if err == diskqueue.ErrStopped {
+			break
+		}
+		var event *LogEvent
+		if err == nil {
+			if event, err = clt.decodeEvent(record); err != nil {
+				// It can still be replayed once its tenant is back
+				clt.deadLetterRecord(record, err)
+			}
+		}
+		if err != nil {
+			clt.log.Warnw(
+				"Dropping event which couldn't be read from the disk queue",
+				"err", err,
+			)
+			clients.OutputEventsDropped.Inc(clt.name)
+			clt.queue.Ack(seq)
+			continue
+		}
+
+		event.seq = seq
+		event.stored = true
+		clt.events <- event
+	}
+
+	// Event closing the datadog sender
+	clt.events <- nil
+}
+
+// handled accounts for an event which was sent or dropped, it's removed from the disk queue if it was read from it
+func (clt *Client) handled(event *LogEvent) {
+	if event.stored {
+		clt.queue.Ack(event.seq)
+		return
+	}
+	atomic.AddInt64(&clt.pending, -1)
+	event.source.Pending.Add(clt.name, -1)
 }
 
 func (clt *Client) Close() error {
+	if clt.queue != nil {
+		// The events which weren't read from the disk queue are sent by the client replacing this one after a reload,
+		// or after a restart
+		clt.reader.Stop()
+		return nil
+	}
+
 	// Event closing the scaly HTTP sender
 	clt.events <- nil
 	return nil
 }
 
+func (clt *Client) Done() <-chan struct{} {
+	return clt.done
+}
+
+func (clt *Client) Pending() int {
+	pending := int(atomic.LoadInt64(&clt.pending))
+	if clt.queue != nil {
+		pending += clt.queue.Len()
+	}
+	return pending
+}
+
+func (clt *Client) QueueLength() int {
+	switch {
+	case clt.spill:
+		return int(atomic.LoadInt64(&clt.pending)) + clt.queue.Len()
+	case clt.queue != nil:
+		return clt.queue.Len()
+	}
+	return len(clt.events)
+}
+
+// QueueUsage returns the usage of the disk queue if there's one, as the memory queue is expected to be full when the
+// events are spilled
+func (clt *Client) QueueUsage() int {
+	if clt.queue != nil {
+		return clt.queue.Usage()
+	}
+	return len(clt.events) * 100 / cap(clt.events)
+}
+
 func (clt *Client) Name() string {
-	return "datadog"
+	return clt.name
+}
+
+// closeQueue closes the disk queue once the writer is done with its events
+func (clt *Client) closeQueue() {
+	if err := clt.queue.Close(); err != nil {
+		clt.log.Errorw(
+			"Issue closing disk queue",
+			"err", err,
+		)
+	}
 }
 
 func (clt *Client) writeToDatadogTCPInput() {
+	defer close(clt.done)
+	if clt.queue != nil {
+		defer clt.closeQueue()
+	}
 
 	var conn *tls.Conn
 	var err error
+	var retry *LogEvent // Event which couldn't be sent, it's sent again before the next ones
 	connectionAttempts := 0
 
 	for {
-		event := <-clt.events
+		event := retry
+		retry = nil
+		if event == nil {
+			event = <-clt.events
+		}
 
 		if event == nil {
 			if conn != nil {
@@ -117,6 +420,7 @@ func (clt *Client) writeToDatadogTCPInput() {
 			break
 		}
 
+		event.attempts++
 		if conn == nil {
 			connectionAttempts++
 			conn, err = tls.Dial("tcp", clt.config.Server, &tls.Config{})
@@ -127,13 +431,25 @@ func (clt *Client) writeToDatadogTCPInput() {
 					"connectionAttempts", connectionAttempts,
 					"err", err,
 				)
-				if connectionAttempts > 10 {
-					clt.log.Warnw("Too many connection attempts")
-					break
+				clients.ReportFailure(clt.name, err)
+				if clt.queue != nil {
+					// The event is kept until it's sent
+					retry = event
+					clients.OutputRetries.Inc(clt.name)
+				} else {
+					clients.OutputEventsDropped.Inc(clt.name)
+					clt.deadLetter(event, err)
+					clt.handled(event)
 				}
-				time.Sleep(time.Second * time.Duration(5*connectionAttempts))
+				// The connection is shared by all the clients, we never give up
+				delay := time.Second * time.Duration(5*connectionAttempts)
+				if delay > maxReconnectionDelay {
+					delay = maxReconnectionDelay
+				}
+				time.Sleep(delay)
 				continue
 			} else {
+				connections.Inc(clt.name)
 				clt.log.Debug(
 					"Successfully connected to datadog server",
 					"server", clt.config.Server,
@@ -142,16 +458,16 @@ func (clt *Client) writeToDatadogTCPInput() {
 			}
 		}
 
-		line := fmt.Sprintf("%s %s\n", clt.config.Token, event.export())
+		line := fmt.Sprintf("%s %s\n", event.token, event.export())
 		clt.log.Debugw(
 			"Sending data",
 			"line", line,
 		)
 
 		if _, err := conn.Write([]byte(line)); err != nil {
-			go func() {
-				clt.events <- event
-			}()
+			retry = event
+			clients.OutputRetries.Inc(clt.name)
+			clients.ReportFailure(clt.name, err)
 
 			clt.log.Warnw(
 				"Could not send data",
@@ -165,6 +481,11 @@ func (clt *Client) writeToDatadogTCPInput() {
 				)
 			}
 			conn = nil
+			continue
 		}
+
+		clt.handled(event)
+		clients.OutputEventsSent.Inc(clt.name)
+		clients.ReportSuccess(clt.name)
 	}
 }
@@ -0,0 +1,183 @@
+package datadog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+	"go.uber.org/zap"
+)
+
+type letterRecorder struct {
+	letters []*clients.EventDeadLetter
+}
+
+func (r *letterRecorder) WriteEvent(letter *clients.EventDeadLetter) error {
+	r.letters = append(r.letters, letter)
+	return nil
+}
+
+func newTestClient() *Client {
+	config := NewConfig()
+	config.Token = "default-token"
+	return &Client{
+		name:   "dd",
+		config: config,
+		log:    zap.NewNop().Sugar(),
+		events: make(chan *LogEvent, 10),
+	}
+}
+
+func TestReplay(t *testing.T) {
+	recorder := &letterRecorder{}
+	clients.SetDeadLetterWriter(recorder)
+	defer clients.SetDeadLetterWriter(nil)
+	defer clients.SetTenants(nil)
+
+	tenant := &clients.Tenant{Name: "acme", OutputTokens: map[string]string{"dd": "old-token"}}
+	clients.SetTenants([]*clients.Tenant{tenant})
+	clt := newTestClient()
+	for _, source := range []*clients.Source{
+		{ID: 1, Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, Tenant: tenant, Pending: clients.NewPending()},
+		{ID: 2, Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}, Pending: clients.NewPending()},
+	} {
+		clt.Send(&clients.LogEvent{
+			Timestamp:  time.Unix(1, 0),
+			Attributes: map[string]interface{}{"message": "lost", "appname": "app"},
+			Source:     source,
+		})
+		clt.deadLetter(<-clt.events, errors.New("connection refused"))
+	}
+	if len(recorder.letters) != 2 {
+		t.Fatalf("got %d letters", len(recorder.letters))
+	}
+
+	// The events are replayed with the current tokens of their tenants
+	clients.SetTenants([]*clients.Tenant{{Name: "acme", OutputTokens: map[string]string{"dd": "new-token"}}})
+	for i, want := range []string{"new-token", "default-token"} {
+		if err := clt.Replay(recorder.letters[i].Event); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		event := <-clt.events
+		if event.token != want {
+			t.Errorf("got token %q, want %q", event.token, want)
+		}
+		if event.Attributes["message"] != "lost" || event.Attributes["service"] != "app" {
+			t.Errorf("unexpected attributes %v", event.Attributes)
+		}
+		if event.source == nil || event.source.ID != i+1 {
+			t.Errorf("unexpected source %+v", event.source)
+		}
+	}
+
+	// The events of a tenant which doesn't exist anymore can't be replayed
+	clients.SetTenants(nil)
+	if err := clt.Replay(recorder.letters[0].Event); err == nil {
+		t.Error("expected an error for an unknown tenant")
+	}
+	if err := clt.Replay([]byte(`{"event":{}}`)); err == nil {
+		t.Error("expected an error for an event without its source")
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		policy    string
+		queued    string // Events left in the memory queue
+		nbDropped float64
+	}{
+		{clients.OverflowDropNewest, "event 1,event 2", 2},
+		{clients.OverflowDropOldest, "event 3,event 4", 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			clt := newTestClient()
+			clt.name = "dd_" + test.policy
+			clt.config.OverflowPolicy = test.policy
+			clt.events = make(chan *LogEvent, 2)
+			dropped := clients.OutputEventsDropped.Value(clt.name)
+			overflowed := clients.OutputEventsOverflowed.Value(clt.name, test.policy)
+			source := &clients.Source{ID: 1, Addr: &net.TCPAddr{}, Pending: clients.NewPending()}
+			for i := 1; i <= 4; i++ {
+				clt.Send(&clients.LogEvent{
+					Attributes: map[string]interface{}{"message": fmt.Sprintf("event %d", i)},
+					Source:     source,
+				})
+			}
+
+			if got := clients.OutputEventsDropped.Value(clt.name) - dropped; got != test.nbDropped {
+				t.Errorf("got %g dropped events, want %g", got, test.nbDropped)
+			}
+			if got := clients.OutputEventsOverflowed.Value(clt.name, test.policy) - overflowed; got != test.nbDropped {
+				t.Errorf("got %g overflowed events, want %g", got, test.nbDropped)
+			}
+			if clt.Pending() != 2 || source.Pending.Total() != 2 {
+				t.Errorf("got %d pending events", clt.Pending())
+			}
+			var queued []string
+			for len(clt.events) > 0 {
+				queued = append(queued, fmt.Sprint((<-clt.events).Attributes["message"]))
+			}
+			if got := strings.Join(queued, ","); got != test.queued {
+				t.Errorf("got queued events %s, want %s", got, test.queued)
+			}
+		})
+	}
+}
+
+func TestOverflowSpill(t *testing.T) {
+	clt := newTestClient()
+	clt.name = "dd_spill"
+	clt.config.OverflowPolicy = clients.OverflowSpill
+	clt.config.QueueDir = t.TempDir()
+	clt.events = make(chan *LogEvent, 2)
+	queue, err := clt.config.OpenQueue(clt.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close() // nolint: errcheck
+	clt.queue, clt.reader, clt.spill = queue, queue.NewReader(), true
+
+	// Once events were spilled, the next ones are spilled too so that they're sent after them
+	dropped := clients.OutputEventsDropped.Value(clt.name)
+	spilled := clients.OutputEventsOverflowed.Value(clt.name, clients.OverflowSpill)
+	source := &clients.Source{ID: 1, Addr: &net.TCPAddr{}, Pending: clients.NewPending()}
+	for i := 1; i <= 5; i++ {
+		clt.Send(&clients.LogEvent{
+			Attributes: map[string]interface{}{"message": fmt.Sprintf("event %d", i)},
+			Source:     source,
+		})
+	}
+	if queue.Len() != 3 || len(clt.events) != 2 {
+		t.Fatalf("got %d spilled events and %d events in memory", queue.Len(), len(clt.events))
+	}
+	if got := clients.OutputEventsOverflowed.Value(clt.name, clients.OverflowSpill) - spilled; got != 3 {
+		t.Errorf("got %g spilled events", got)
+	}
+	if got := clients.OutputEventsDropped.Value(clt.name) - dropped; got != 0 {
+		t.Errorf("got %g dropped events", got)
+	}
+
+	go clt.readQueue()
+	var sent []string
+	for i := 0; i < 5; i++ {
+		event := <-clt.events
+		sent = append(sent, fmt.Sprint(event.Attributes["message"]))
+		clt.handled(event)
+	}
+	if got := strings.Join(sent, ","); got != "event 1,event 2,event 3,event 4,event 5" {
+		t.Errorf("got events %s", got)
+	}
+	if clt.Pending() != 0 || source.Pending.Total() != 0 {
+		t.Errorf("got %d pending events", clt.Pending())
+	}
+	clt.reader.Stop()
+	if event := <-clt.events; event != nil {
+		t.Errorf("unexpected event %v", event)
+	}
+}
@@ -2,40 +2,51 @@ package datadog
 
 import (
 	"fmt"
+	"net"
 
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/clients/diskqueue"
 	"github.com/kelseyhightower/envconfig"
 )
 
 // Config is the datadog output client config
 type Config struct {
-	Token                    string            `envconfig:"DATADOG_TOKEN"`               // Datadog token
-	Server                   string            `envconfig:"DATADOG_SERVER"`              // Datadog server
-	QueueSize                int               `envconfig:"DATADOG_QUEUESIZE"`           // Datadog queue size
-	KeysToMessageConversions map[string]string `envconfig:"DATADOG_FIELDS_CONV_MESSAGE"` // Logstash to events fields conversion
-	KeysToTagsConversions    map[string]string `envconfig:"DATADOG_FIELDS_CONV_TAGS"`    // Logstash to session fields conversion
+	Token                    clients.Secret      `envconfig:"DATADOG_TOKEN" yaml:"token"`                             // Datadog token
+	Server                   string              `envconfig:"DATADOG_SERVER" yaml:"server"`                           // Datadog server
+	QueueSize                int                 `envconfig:"DATADOG_QUEUESIZE" yaml:"queue_size"`                    // Datadog queue size
+	OverflowPolicy           string              `envconfig:"DATADOG_OVERFLOW_POLICY" yaml:"overflow_policy"`         // What to do with the events which don't fit in the queue
+	KeysToMessageConversions clients.Conversions `envconfig:"DATADOG_FIELDS_CONV_MESSAGE" yaml:"message_conversions"` // Logstash to events fields conversion
+	KeysToTagsConversions    clients.Conversions `envconfig:"DATADOG_FIELDS_CONV_TAGS" yaml:"tags_conversions"`       // Logstash to session fields conversion
+
+	diskqueue.Config `yaml:",inline"` // Disk queue, its settings are shared by all the outputs unless they're prefixed
 }
 
 // NewConfig creates a new config instance
 func NewConfig() *Config {
 	return &Config{
 		// "tcp-intake.logs.datadoghq.eu:443" for europe
-		Server:    "intake.logs.datadoghq.com:15516",
-		QueueSize: 20,
-		KeysToMessageConversions: map[string]string{
+		Server:         "intake.logs.datadoghq.com:15516",
+		QueueSize:      20,
+		OverflowPolicy: clients.OverflowBlock,
+		Config:         diskqueue.NewConfig(),
+		KeysToMessageConversions: clients.Conversions{
 			"appname": "service",
 			// "hostname": "ddhostname",
 		},
-		KeysToTagsConversions: map[string]string{
+		KeysToTagsConversions: clients.Conversions{
 			"env": "env",
 		},
 	}
 }
 
 // Load performs the config loading
-func (c *Config) Load() error {
-	if err := envconfig.Process("", c); err != nil {
+func (c *Config) Load(prefix string) error {
+	if err := envconfig.Process(prefix, c); err != nil {
 		return fmt.Errorf("couldn't load config from env vars: %s", err)
 	}
+	if err := clients.LoadSecretFiles(prefix, c); err != nil {
+		return fmt.Errorf("couldn't load secrets: %s", err)
+	}
 	if err := c.check(); err != nil {
 		return fmt.Errorf("config check issue: %s", err)
 	}
@@ -47,6 +58,25 @@ func (c *Config) Enabled() bool {
 	return c.Token != ""
 }
 
+// SetReplay sets the config up for replaying the dead letters: the events are queued in memory (the disk queue belongs to
+// the server) and the overflow policy doesn't drop any of them
+func (c *Config) SetReplay() {
+	c.QueueDir = ""
+	c.OverflowPolicy = clients.OverflowBlock
+}
+
 func (c *Config) check() error {
-	return nil
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		return fmt.Errorf("DATADOG_SERVER must be a host:port address: %s", err)
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("DATADOG_QUEUESIZE must be positive")
+	}
+	if err := c.CheckQueue(); err != nil {
+		return err
+	}
+	if err := clients.CheckOverflowPolicy("DATADOG_OVERFLOW_POLICY", c.OverflowPolicy, c.QueueOnDisk()); err != nil {
+		return err
+	}
+	return clients.CheckConversions(c.KeysToMessageConversions, c.KeysToTagsConversions)
 }
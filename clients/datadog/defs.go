@@ -1,6 +1,9 @@
 package datadog
 
-import "github.com/habx/service-logfwd/clients"
+import (
+	"github.com/habx/service-logfwd/clients"
+	"go.uber.org/zap"
+)
 
 type outputClientDefinition struct{}
 
@@ -12,8 +15,16 @@ func (t outputClientDefinition) Config() clients.Config {
 	return NewConfig()
 }
 
-func (t outputClientDefinition) Create(ch clients.ClientHandler, config clients.Config) clients.OutputClient {
-	return NewClient(ch, config)
+func (t outputClientDefinition) Create(
+	name string,
+	config clients.Config,
+	log *zap.SugaredLogger,
+) (clients.OutputClient, error) {
+	clt, err := NewClient(name, config, log)
+	if err != nil {
+		return nil, err
+	}
+	return clt, nil
 }
 
 func OutputClientDefinition() clients.OutputClientDefinition {
@@ -0,0 +1,74 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventDeadLetter is an event an output couldn't send, as it's written to the dead letters
+type EventDeadLetter struct {
+	Time     time.Time       `json:"time"`
+	Output   string          `json:"output"` // Name of the output instance
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`         // Attempts to send the event (0 if it couldn't be sent at all)
+	Status   int             `json:"status,omitempty"` // Status of the response rejecting the event, if it was rejected
+	Event    json.RawMessage `json:"event"`            // Event in the format of the output, it's replayed from it
+}
+
+// StatusError is the error of a request its server rejected
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.Status)
+}
+
+// DeadLetterWriter writes the events the outputs couldn't send
+type DeadLetterWriter interface {
+	WriteEvent(letter *EventDeadLetter) error
+}
+
+var (
+	deadLettersLock  sync.Mutex
+	deadLetterWriter DeadLetterWriter
+)
+
+// SetDeadLetterWriter sets where the outputs write the events they couldn't send, they're only dropped without one
+func SetDeadLetterWriter(writer DeadLetterWriter) {
+	deadLettersLock.Lock()
+	defer deadLettersLock.Unlock()
+	deadLetterWriter = writer
+}
+
+// DeadLetter writes an event an output couldn't send to the dead letters, if they're enabled
+func DeadLetter(output string, event interface{}, attempts int, cause error) error {
+	deadLettersLock.Lock()
+	writer := deadLetterWriter
+	deadLettersLock.Unlock()
+	if writer == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("couldn't encode event: %s", err)
+	}
+	letter := &EventDeadLetter{
+		Time:     time.Now(),
+		Output:   output,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		Event:    data,
+	}
+	if statusErr, ok := cause.(*StatusError); ok {
+		letter.Status = statusErr.Status
+	}
+	if err := writer.WriteEvent(letter); err != nil {
+		return err
+	}
+	OutputEventsDeadLettered.Inc(output)
+	return nil
+}
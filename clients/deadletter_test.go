@@ -0,0 +1,43 @@
+package clients
+
+import (
+	"errors"
+	"testing"
+)
+
+type letterRecorder struct {
+	letters []*EventDeadLetter
+}
+
+func (r *letterRecorder) WriteEvent(letter *EventDeadLetter) error {
+	r.letters = append(r.letters, letter)
+	return nil
+}
+
+func TestDeadLetter(t *testing.T) {
+	if err := DeadLetter("out", map[string]int{"a": 1}, 1, errors.New("lost")); err != nil {
+		t.Fatalf("unexpected error without writer: %s", err)
+	}
+
+	recorder := &letterRecorder{}
+	SetDeadLetterWriter(recorder)
+	defer SetDeadLetterWriter(nil)
+
+	if err := DeadLetter("out", map[string]int{"a": 1}, 3, errors.New("timeout")); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeadLetter("out", map[string]int{"a": 2}, 1, &StatusError{Status: 400}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.letters) != 2 {
+		t.Fatalf("got %d letters", len(recorder.letters))
+	}
+	first, second := recorder.letters[0], recorder.letters[1]
+	if first.Output != "out" || first.Attempts != 3 || first.Status != 0 || string(first.Event) != `{"a":1}` {
+		t.Errorf("unexpected letter %+v", first)
+	}
+	if second.Status != 400 || second.Error != "unexpected status 400" || string(second.Event) != `{"a":2}` {
+		t.Errorf("unexpected letter %+v", second)
+	}
+}
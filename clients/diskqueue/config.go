@@ -0,0 +1,68 @@
+package diskqueue
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Sync policies of the records written to the disk
+const (
+	SyncAlways   = "always"   // Before a record is pushed and when records are acknowledged
+	SyncPeriodic = "periodic" // Every second
+	SyncNever    = "never"    // When the system wants to
+)
+
+// Options of a queue
+type Options struct {
+	MaxSize     int64  // Maximum size of the segments, pushing waits beyond it
+	SegmentSize int64  // Size from which a new segment is started
+	Sync        string // Sync policy
+}
+
+// Config is the config of the disk queue of an output instance, it's embedded in the config of the outputs. The queues
+// are in memory when it's not enabled.
+type Config struct {
+	QueueDir         string `envconfig:"DISK_QUEUE_DIR" yaml:"disk_queue_dir"`                   // Directory of the disk queues
+	QueueMaxSize     int64  `envconfig:"DISK_QUEUE_MAX_SIZE" yaml:"disk_queue_max_size"`         // Maximum size of the queue of an output instance
+	QueueSegmentSize int64  `envconfig:"DISK_QUEUE_SEGMENT_SIZE" yaml:"disk_queue_segment_size"` // Size of the segment files
+	QueueSync        string `envconfig:"DISK_QUEUE_SYNC" yaml:"disk_queue_sync"`                 // Sync policy: always, periodic or never
+}
+
+// NewConfig creates a config with the default values
+func NewConfig() Config {
+	return Config{
+		QueueMaxSize:     1024 * 1024 * 1024, // 1GB
+		QueueSegmentSize: 64 * 1024 * 1024,   // 64MB
+		QueueSync:        SyncPeriodic,
+	}
+}
+
+// QueueOnDisk tells if the queue is on the disk
+func (c *Config) QueueOnDisk() bool {
+	return c.QueueDir != ""
+}
+
+// CheckQueue checks the config
+func (c *Config) CheckQueue() error {
+	if c.QueueMaxSize <= 0 {
+		return fmt.Errorf("DISK_QUEUE_MAX_SIZE must be positive")
+	}
+	if c.QueueSegmentSize <= 0 || c.QueueSegmentSize > c.QueueMaxSize {
+		return fmt.Errorf("DISK_QUEUE_SEGMENT_SIZE must be positive and not bigger than DISK_QUEUE_MAX_SIZE")
+	}
+	switch c.QueueSync {
+	case SyncAlways, SyncPeriodic, SyncNever:
+	default:
+		return fmt.Errorf("unknown DISK_QUEUE_SYNC value %s", c.QueueSync)
+	}
+	return nil
+}
+
+// OpenQueue opens the queue of an output instance, in its own subdirectory
+func (c *Config) OpenQueue(name string) (*Queue, error) {
+	return Open(filepath.Join(c.QueueDir, name), Options{
+		MaxSize:     c.QueueMaxSize,
+		SegmentSize: c.QueueSegmentSize,
+		Sync:        c.QueueSync,
+	})
+}
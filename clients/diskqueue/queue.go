@@ -0,0 +1,539 @@
+// Package diskqueue is a persistent FIFO queue of records, stored in segment files. The records are kept until they're
+// acknowledged, the ones which weren't are read again once the queue is opened after a restart (at least once
+// delivery).
+package diskqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt  = ".seg"
+	ackFileName = "ack" // Sequence number of the first record which wasn't acknowledged
+	headerSize  = 8     // Length and CRC32 of the record
+	flushPeriod = time.Second
+)
+
+var (
+	// ErrClosed is returned when pushing to a closed queue
+	ErrClosed = errors.New("queue is closed")
+
+	// ErrStopped is returned when popping from a stopped reader
+	ErrStopped = errors.New("reader is stopped")
+
+	// ErrFull is returned when pushing to a full queue without waiting
+	ErrFull = errors.New("queue is full")
+)
+
+// Queue is a disk queue, it's safe for concurrent use
+type Queue struct {
+	dir     string
+	options Options
+
+	sync.Mutex
+	cond       *sync.Cond // Signaled when records are pushed or acknowledged, or when a reader is stopped
+	segments   []*segment // The last one is written
+	writer     *os.File   // Last segment
+	nextSeq    uint64     // Sequence number of the next record pushed
+	size       int64      // Size of all the segments
+	readSeg    int        // Index of the segment of the next record popped
+	readOffset int64      // Offset of the next record popped in its segment
+	readSeq    uint64     // Sequence number of the next record popped
+	reader     *os.File   // Segment being read
+	acked      uint64     // All the records before it are acknowledged
+	ackedAhead map[uint64]bool
+	unsynced   bool // Records were written since the last sync
+	ackChanged bool // The acknowledged records changed since the ack file was written
+	truncated  int64
+	refs       int
+	closed     bool
+	done       chan struct{} // Stops the flusher
+}
+
+type segment struct {
+	first uint64 // Sequence number of the first record
+	count uint64 // Number of records
+	size  int64
+	path  string
+}
+
+var (
+	openLock sync.Mutex
+	opened   = make(map[string]*Queue)
+)
+
+// Open opens the queue of a directory, recovering the records which weren't acknowledged. A queue which is already open
+// is shared, with the options it was opened with, until everyone closed it.
+func Open(dir string, options Options) (*Queue, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	openLock.Lock()
+	defer openLock.Unlock()
+
+	if q, ok := opened[dir]; ok {
+		q.Lock()
+		q.refs++
+		q.Unlock()
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create %s: %s", dir, err)
+	}
+	q := &Queue{
+		dir:        dir,
+		options:    options,
+		ackedAhead: make(map[uint64]bool),
+		refs:       1,
+		done:       make(chan struct{}),
+	}
+	q.cond = sync.NewCond(q)
+	if err := q.recover(); err != nil {
+		return nil, fmt.Errorf("couldn't recover %s: %s", dir, err)
+	}
+	opened[dir] = q
+
+	go q.flush()
+
+	return q, nil
+}
+
+// recover reads the segments, truncating the records which weren't completely written, and sets the read position to
+// the first record which wasn't acknowledged
+func (q *Queue) recover() error {
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths) // The names are zero padded
+
+	for _, path := range paths {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid segment name %s", path)
+		}
+		seg := &segment{first: first, path: path}
+		if err := q.scan(seg); err != nil {
+			return err
+		}
+		q.segments = append(q.segments, seg)
+		q.size += seg.size
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(q.dir, ackFileName)); err == nil {
+		if q.acked, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return fmt.Errorf("invalid ack file: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(q.segments) == 0 {
+		q.nextSeq = q.acked
+		return q.rotate()
+	}
+	last := q.segments[len(q.segments)-1]
+	q.nextSeq = last.first + last.count
+	if q.acked > q.nextSeq {
+		q.acked = q.nextSeq
+	}
+	if q.acked < q.segments[0].first {
+		q.acked = q.segments[0].first
+	}
+	q.skipGaps()
+
+	// The read position is moved to the first record which wasn't acknowledged, it can be in a following segment
+	q.readSeq = q.segments[0].first
+	for q.normalizeRead(); q.readSeq < q.acked; q.normalizeRead() {
+		if _, err := q.read(); err != nil {
+			return err
+		}
+	}
+	q.removeAcked()
+
+	q.writer, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// scan counts the records of a segment, the ones following an incomplete or corrupted record are truncated
+func (q *Queue) scan(seg *segment) error {
+	file, err := os.OpenFile(seg.path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	for seg.size < info.Size() {
+		record, err := readRecord(file, seg.size)
+		if err != nil {
+			break
+		}
+		seg.size += headerSize + int64(len(record))
+		seg.count++
+	}
+	if seg.size < info.Size() {
+		q.truncated += info.Size() - seg.size
+		return file.Truncate(seg.size)
+	}
+	return nil
+}
+
+// readRecord reads the record at an offset of a segment
+func readRecord(file *os.File, offset int64) ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	record := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := file.ReadAt(record, offset+headerSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("corrupted record")
+	}
+	return record, nil
+}
+
+// rotate starts a new segment
+func (q *Queue) rotate() error {
+	if q.writer != nil {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+		if err := q.writer.Close(); err != nil {
+			return err
+		}
+	}
+	seg := &segment{
+		first: q.nextSeq,
+		path:  filepath.Join(q.dir, fmt.Sprintf("%020d%s", q.nextSeq, segmentExt)),
+	}
+	writer, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	q.writer = writer
+	q.segments = append(q.segments, seg)
+	return nil
+}
+
+// Push adds a record to the queue, it waits while the queue is full
+func (q *Queue) Push(record []byte) error {
+	return q.push(record, true)
+}
+
+// TryPush adds a record to the queue, it returns ErrFull instead of waiting when the queue is full
+func (q *Queue) TryPush(record []byte) error {
+	return q.push(record, false)
+}
+
+func (q *Queue) push(record []byte, wait bool) error {
+	length := headerSize + int64(len(record))
+	if length > q.options.MaxSize {
+		return fmt.Errorf("record of %d bytes is bigger than the queue", len(record))
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	// The segment is rotated first, so that it can be removed once its records are acknowledged
+	if seg := q.segments[len(q.segments)-1]; seg.count > 0 && seg.size+length > q.options.SegmentSize {
+		if err := q.rotate(); err != nil {
+			return fmt.Errorf("couldn't start a segment: %s", err)
+		}
+		q.removeAcked()
+	}
+	for q.size+length > q.options.MaxSize && !q.closed {
+		if !wait {
+			return ErrFull
+		}
+		q.cond.Wait()
+	}
+	if q.closed {
+		return ErrClosed
+	}
+
+	seg := q.segments[len(q.segments)-1]
+
+	data := make([]byte, length)
+	binary.BigEndian.PutUint32(data, uint32(len(record)))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(record))
+	copy(data[headerSize:], record)
+	if _, err := q.writer.Write(data); err != nil {
+		// A partial record would corrupt the following ones
+		q.writer.Truncate(seg.size) // nolint: errcheck
+		return err
+	}
+	if q.options.Sync == SyncAlways {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+	} else {
+		q.unsynced = true
+	}
+
+	seg.size += length
+	seg.count++
+	q.size += length
+	q.nextSeq++
+	q.cond.Broadcast()
+	return nil
+}
+
+// normalizeRead moves the read position to the next segment once the current one is read
+func (q *Queue) normalizeRead() {
+	for q.readSeg < len(q.segments)-1 && q.readOffset >= q.segments[q.readSeg].size {
+		q.readSeg++
+		q.readOffset = 0
+		q.readSeq = q.segments[q.readSeg].first
+		if q.reader != nil {
+			q.reader.Close() // nolint: errcheck
+			q.reader = nil
+		}
+	}
+}
+
+// read reads the record at the read position and moves it forward
+func (q *Queue) read() ([]byte, error) {
+	q.normalizeRead()
+	seg := q.segments[q.readSeg]
+	if q.reader == nil {
+		reader, err := os.Open(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		q.reader = reader
+	}
+	record, err := readRecord(q.reader, q.readOffset)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read record %d: %s", q.readSeq, err)
+	}
+	q.readOffset += headerSize + int64(len(record))
+	q.readSeq++
+	return record, nil
+}
+
+// Ack acknowledges records, they're removed from the disk once all the records before them are acknowledged
+func (q *Queue) Ack(seqs ...uint64) {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, seq := range seqs {
+		if seq >= q.acked {
+			q.ackedAhead[seq] = true
+		}
+	}
+	for q.ackedAhead[q.acked] {
+		delete(q.ackedAhead, q.acked)
+		q.acked++
+		q.skipGaps()
+	}
+	q.ackChanged = true
+	q.removeAcked()
+
+	if q.options.Sync == SyncAlways {
+		q.writeAck() // nolint: errcheck (it's written again by the flusher)
+	}
+	q.cond.Broadcast()
+}
+
+// skipGaps moves the acknowledged position over the records lost in a truncated segment
+func (q *Queue) skipGaps() {
+	for i, seg := range q.segments[:len(q.segments)-1] {
+		if q.acked == seg.first+seg.count {
+			q.acked = q.segments[i+1].first
+		}
+	}
+}
+
+// removeAcked removes the segments which were read and whose records are all acknowledged
+func (q *Queue) removeAcked() {
+	q.normalizeRead()
+	for q.readSeg > 0 && q.segments[1].first <= q.acked {
+		if err := os.Remove(q.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		q.size -= q.segments[0].size
+		q.segments = q.segments[1:]
+		q.readSeg--
+	}
+}
+
+// writeAck writes the position of the first record which wasn't acknowledged
+func (q *Queue) writeAck() error {
+	path := filepath.Join(q.dir, ackFileName)
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%d\n", q.acked); err != nil {
+		file.Close() // nolint: errcheck
+		return err
+	}
+	if q.options.Sync != SyncNever {
+		if err := file.Sync(); err != nil {
+			file.Close() // nolint: errcheck
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	q.ackChanged = false
+	return nil
+}
+
+// flush syncs the records and writes the ack file periodically
+func (q *Queue) flush() {
+	ticker := time.NewTicker(flushPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			q.Lock()
+			q.sync() // nolint: errcheck
+			q.Unlock()
+		}
+	}
+}
+
+func (q *Queue) sync() error {
+	if q.unsynced && q.options.Sync != SyncNever {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+		q.unsynced = false
+	}
+	if q.ackChanged {
+		return q.writeAck()
+	}
+	return nil
+}
+
+// Len returns the number of records which weren't acknowledged
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return int(q.nextSeq - q.acked - uint64(len(q.ackedAhead)))
+}
+
+// Usage returns the size of the queue, in percent of its maximum size
+func (q *Queue) Usage() int {
+	q.Lock()
+	defer q.Unlock()
+	return int(q.size * 100 / q.options.MaxSize)
+}
+
+// Truncated returns the number of bytes of incomplete or corrupted records removed when opening the queue
+func (q *Queue) Truncated() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.truncated
+}
+
+// Close releases the queue, it's closed once everyone who opened it closed it
+func (q *Queue) Close() error {
+	openLock.Lock()
+	defer openLock.Unlock()
+	q.Lock()
+	defer q.Unlock()
+
+	if q.refs--; q.refs > 0 {
+		return nil
+	}
+	delete(opened, q.dir)
+	q.closed = true
+	close(q.done)
+	q.cond.Broadcast()
+
+	err := q.sync()
+	if q.reader != nil {
+		q.reader.Close() // nolint: errcheck
+	}
+	if closeErr := q.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Reader pops the records of a queue, several readers can share a queue
+type Reader struct {
+	queue   *Queue
+	stopped bool
+}
+
+// NewReader creates a reader
+func (q *Queue) NewReader() *Reader {
+	return &Reader{queue: q}
+}
+
+// Pop returns the next record and its sequence number, which is used to acknowledge it. It waits until there's one or
+// until the reader is stopped. The sequence number of a record which couldn't be read is returned with the error, the
+// record must be acknowledged to be removed.
+func (r *Reader) Pop() ([]byte, uint64, error) {
+	q := r.queue
+	q.Lock()
+	defer q.Unlock()
+
+	for {
+		q.normalizeRead()
+		if r.stopped || q.closed {
+			return nil, 0, ErrStopped
+		}
+		if q.readSeq < q.nextSeq {
+			break
+		}
+		q.cond.Wait()
+	}
+
+	seq := q.readSeq
+	record, err := q.read()
+	if err != nil {
+		// The rest of the segment can't be read, its records are dropped
+		seg := q.segments[q.readSeg]
+		for dropped := seq + 1; dropped < seg.first+seg.count; dropped++ {
+			q.ackedAhead[dropped] = true
+		}
+		q.readOffset = seg.size
+		q.readSeq = seg.first + seg.count
+	}
+	return record, seq, err
+}
+
+// Stop stops the reader, it doesn't pop any record afterwards
+func (r *Reader) Stop() {
+	r.queue.Lock()
+	defer r.queue.Unlock()
+	r.stopped = true
+	r.queue.cond.Broadcast()
+}
@@ -0,0 +1,264 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testOptions = Options{MaxSize: 1024 * 1024, SegmentSize: 64, Sync: SyncAlways}
+
+func openQueue(t *testing.T, dir string) *Queue {
+	q, err := Open(dir, testOptions)
+	if err != nil {
+		t.Fatalf("couldn't open the queue: %s", err)
+	}
+	return q
+}
+
+func pushRecords(t *testing.T, q *Queue, first, last int) {
+	for i := first; i <= last; i++ {
+		if err := q.Push([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// popRecords pops n records, they're acknowledged if ack is set
+func popRecords(t *testing.T, q *Queue, n int, ack bool) []string {
+	reader := q.NewReader()
+	var records []string
+	for i := 0; i < n; i++ {
+		record, seq, err := reader.Pop()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		records = append(records, string(record))
+		if ack {
+			q.Ack(seq)
+		}
+	}
+	return records
+}
+
+// crash copies the files of a queue as they would be found after a crash, without closing it
+func crash(t *testing.T, q *Queue) string {
+	q.Lock()
+	defer q.Unlock()
+	if err := q.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(path)), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func segmentPaths(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir)
+	pushRecords(t, q, 1, 10)
+
+	// The records which were popped but not acknowledged are read again
+	if records := popRecords(t, q, 4, true); records[3] != "record 4" {
+		t.Fatalf("got records %q", records)
+	}
+	popRecords(t, q, 2, false)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openQueue(t, dir)
+	defer q.Close() // nolint: errcheck
+	if q.Len() != 6 {
+		t.Errorf("got %d records, want 6", q.Len())
+	}
+	records := popRecords(t, q, 6, true)
+	if records[0] != "record 5" || records[5] != "record 10" {
+		t.Errorf("got records %q", records)
+	}
+	if q.Len() != 0 {
+		t.Errorf("got %d records, want 0", q.Len())
+	}
+	// The segments whose records were all acknowledged are removed
+	if paths := segmentPaths(t, dir); len(paths) != 1 {
+		t.Errorf("got segments %v", paths)
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	q := openQueue(t, t.TempDir())
+	defer q.Close() // nolint: errcheck
+	pushRecords(t, q, 1, 10)
+	popRecords(t, q, 3, true)
+
+	tests := []struct {
+		name      string
+		damage    func(last string) error
+		first     string
+		nbRecords int
+	}{
+		{
+			name:      "clean",
+			damage:    func(string) error { return nil },
+			first:     "record 4",
+			nbRecords: 7,
+		},
+		{
+			name: "record partially written",
+			damage: func(last string) error {
+				file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0600)
+				if err != nil {
+					return err
+				}
+				defer file.Close() // nolint: errcheck
+				_, err = file.Write([]byte{0, 0, 0, 9, 1, 2, 3, 4, 'r', 'e'})
+				return err
+			},
+			first:     "record 4",
+			nbRecords: 7,
+		},
+		{
+			name: "record corrupted",
+			damage: func(last string) error {
+				data, err := ioutil.ReadFile(last)
+				if err != nil {
+					return err
+				}
+				data[len(data)-1] ^= 0xff
+				return ioutil.WriteFile(last, data, 0600)
+			},
+			first:     "record 4",
+			nbRecords: 6,
+		},
+		{
+			name: "acknowledgements lost",
+			damage: func(last string) error {
+				return os.Remove(filepath.Join(filepath.Dir(last), ackFileName))
+			},
+			first:     "record 1",
+			nbRecords: 10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := crash(t, q)
+			paths := segmentPaths(t, dir)
+			if err := test.damage(paths[len(paths)-1]); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered := openQueue(t, dir)
+			defer recovered.Close() // nolint: errcheck
+			if recovered.Len() != test.nbRecords {
+				t.Fatalf("got %d records, want %d", recovered.Len(), test.nbRecords)
+			}
+			records := popRecords(t, recovered, test.nbRecords, true)
+			if records[0] != test.first {
+				t.Errorf("got records %q", records)
+			}
+
+			// The queue is still usable
+			pushRecords(t, recovered, 11, 11)
+			if records := popRecords(t, recovered, 1, true); records[0] != "record 11" {
+				t.Errorf("got records %q", records)
+			}
+		})
+	}
+}
+
+func TestTruncatedSegment(t *testing.T) {
+	q := openQueue(t, t.TempDir())
+	defer q.Close() // nolint: errcheck
+	pushRecords(t, q, 1, 10)
+
+	// The records following a corrupted one are lost, the next segments are still read
+	dir := crash(t, q)
+	paths := segmentPaths(t, dir)
+	data, err := ioutil.ReadFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[headerSize] ^= 0xff
+	if err := ioutil.WriteFile(paths[0], data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := openQueue(t, dir)
+	defer recovered.Close() // nolint: errcheck
+	if recovered.Truncated() != int64(len(data)) {
+		t.Errorf("got %d truncated bytes, want %d", recovered.Truncated(), len(data))
+	}
+	if want := 10 - int(q.segments[0].count); recovered.Len() != want {
+		t.Fatalf("got %d records, want %d", recovered.Len(), want)
+	}
+	records := popRecords(t, recovered, recovered.Len(), true)
+	if want := fmt.Sprintf("record %d", q.segments[0].count+1); records[0] != want {
+		t.Errorf("got records %q, want %s first", records, want)
+	}
+	if recovered.Len() != 0 {
+		t.Errorf("got %d records, want 0", recovered.Len())
+	}
+}
+
+func TestFull(t *testing.T) {
+	q, err := Open(t.TempDir(), Options{MaxSize: 64, SegmentSize: 64, Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close() // nolint: errcheck
+
+	for i := 0; i < 4; i++ {
+		if err := q.TryPush([]byte("0123456789abcdef")); i < 2 && err != nil || i >= 2 && err != ErrFull {
+			t.Errorf("push %d: got error %v", i, err)
+		}
+	}
+	if err := q.Push(make([]byte, 64)); err == nil {
+		t.Error("expected an error for a record bigger than the queue")
+	}
+
+	// The space of the acknowledged records is available again
+	popRecords(t, q, 2, true)
+	if err := q.TryPush([]byte("0123456789abcdef")); err != nil {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestStop(t *testing.T) {
+	q := openQueue(t, t.TempDir())
+	defer q.Close() // nolint: errcheck
+	reader := q.NewReader()
+
+	done := make(chan error)
+	go func() {
+		_, _, err := reader.Pop()
+		done <- err
+	}()
+	reader.Stop()
+	if err := <-done; err != ErrStopped {
+		t.Errorf("got error %v, want %v", err, ErrStopped)
+	}
+}
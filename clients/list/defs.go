@@ -11,3 +11,13 @@ var LIST = []clients.OutputClientDefinition{
 	scalyr.OutputClientDefinition(),
 	datadog.OutputClientDefinition(),
 }
+
+// Find returns the definition of an output client type, or nil if there's none
+func Find(name string) clients.OutputClientDefinition {
+	for _, def := range LIST {
+		if def.Name() == name {
+			return def
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package clients
+
+import (
+	"github.com/habx/service-logfwd/metrics"
+)
+
+// Metrics shared by the output clients, by output instance
+var (
+	OutputEventsSent = metrics.NewCounter(
+		"logfwd_output_events_sent_total",
+		"Events sent by the outputs",
+		"output",
+	)
+	OutputEventsDropped = metrics.NewCounter(
+		"logfwd_output_events_dropped_total",
+		"Events the outputs couldn't send",
+		"output",
+	)
+	OutputEventsOverflowed = metrics.NewCounter(
+		"logfwd_output_events_overflowed_total",
+		"Events which didn't fit in the queue of the outputs, by overflow policy",
+		"output", "policy",
+	)
+	OutputEventsDeadLettered = metrics.NewCounter(
+		"logfwd_output_events_deadlettered_total",
+		"Events the outputs couldn't send written to the dead letters",
+		"output",
+	)
+	OutputRetries = metrics.NewCounter(
+		"logfwd_output_retries_total",
+		"Attempts to send events again after a failure",
+		"output",
+	)
+)
@@ -0,0 +1,31 @@
+package clients
+
+import (
+	"fmt"
+)
+
+// Overflow policies of the output queues, applied to the events which don't fit in a full queue
+const (
+	OverflowBlock      = "block"       // The client waits until there's room in the queue
+	OverflowDropNewest = "drop_newest" // The event is dropped
+	OverflowDropOldest = "drop_oldest" // The oldest event of the queue is dropped (memory queue only)
+	OverflowSpill      = "spill"       // The event is written to the disk queue (the queue is in memory until it's full)
+)
+
+// CheckOverflowPolicy checks the overflow policy of an output, key is the name of its setting
+func CheckOverflowPolicy(key, policy string, diskQueue bool) error {
+	switch policy {
+	case OverflowBlock, OverflowDropNewest:
+	case OverflowDropOldest:
+		if diskQueue {
+			return fmt.Errorf("%s %s isn't supported with a disk queue", key, policy)
+		}
+	case OverflowSpill:
+		if !diskQueue {
+			return fmt.Errorf("%s %s requires DISK_QUEUE_DIR", key, policy)
+		}
+	default:
+		return fmt.Errorf("unknown %s value %s", key, policy)
+	}
+	return nil
+}
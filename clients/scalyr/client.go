@@ -3,38 +3,113 @@ package scalyr
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/clients/diskqueue"
+	"github.com/habx/service-logfwd/metrics"
 	uuid "github.com/satori/go.uuid"
 	"go.uber.org/zap"
 )
 
+// Metrics of the scalyr requests, by output instance
+var (
+	requests = metrics.NewCounter(
+		"logfwd_scalyr_requests_total",
+		"Requests sent to scalyr by status code",
+		"output", "status",
+	)
+	requestDuration = metrics.NewHistogram(
+		"logfwd_scalyr_request_duration_seconds",
+		"Duration of the scalyr requests",
+		metrics.DurationBuckets,
+		"output",
+	)
+)
+
+// sessionExpiry is the time after which an unused scalyr session, or the session info of a client, is forgotten
+const sessionExpiry = 10 * time.Minute
+
+// maxRetryDelay is the maximum time between two attempts of a request
+const maxRetryDelay = time.Minute
+
+// maxAttempts is the number of attempts of a request before giving up, unless its events are kept in a disk queue
+const maxAttempts = 6
+
+// retryDelay is the time before the first retry of a request, the delay increases with the next ones
+var retryDelay = time.Second
+
+// Client sends the events of all the clients in batches, with one scalyr session per token and session info. The
+// attributes of the clients are sent as the attributes of scalyr logs.
 type Client struct {
-	srcClient   clients.ClientHandler
+	name        string  // Name of the output instance
 	config      *Config // This doesn't belong to us (we MUST not modify it)
 	log         *zap.SugaredLogger
 	events      chan *LogEvent
 	httpClient  http.Client
 	maxNbEvents int
+	pending     int64             // Events received but not sent yet (in memory)
+	queue       *diskqueue.Queue  // Disk queue feeding the events channel, nil if the queue is in memory
+	spill       bool              // The disk queue is only used once the events channel is full
+	reader      *diskqueue.Reader // Reader of the disk queue
+	done        chan struct{}
+
+	// Only used by the writer
+	sessions       map[string]*session       // Scalyr sessions by token and session info
+	sourceSessions map[string]*sourceSession // Session info of each client, by client key
+	lastExpiry     time.Time
+}
+
+// session is a scalyr session, shared by the clients with the same token and session info
+type session struct {
+	id       string
+	token    string
+	info     map[string]interface{}
+	lastUsed time.Time
 }
 
-func NewClient(ch clients.ClientHandler, baseConfig clients.Config) *Client {
+// sourceSession is the session info of a client, which is updated by the session attributes of its events
+type sourceSession struct {
+	info     map[string]interface{}
+	lastUsed time.Time
+}
+
+func NewClient(name string, baseConfig clients.Config, log *zap.SugaredLogger) (*Client, error) {
 	config := baseConfig.(*Config)
 	clt := &Client{
-		srcClient:   ch,
-		config:      config,
-		log:         ch.Logger().With("log2x", "scalyr"),
-		events:      make(chan *LogEvent, config.QueueSize),
-		maxNbEvents: config.RequestMaxNbEvents,
+		name:           name,
+		config:         config,
+		log:            log.With("log2x", name),
+		events:         make(chan *LogEvent, config.QueueSize),
+		maxNbEvents:    config.RequestMaxNbEvents,
+		done:           make(chan struct{}),
+		sessions:       make(map[string]*session),
+		sourceSessions: make(map[string]*sourceSession),
+		lastExpiry:     time.Now(),
+	}
+
+	if config.QueueOnDisk() {
+		queue, err := config.OpenQueue(name)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open the disk queue of %s: %s", name, err)
+		}
+		clt.queue = queue
+		clt.reader = queue.NewReader()
+		clt.spill = config.OverflowPolicy == clients.OverflowSpill
+		clt.log.Infow("Opened disk queue", "nbEvents", queue.Len(), "truncatedBytes", queue.Truncated())
+		go clt.readQueue()
 	}
 
 	go clt.writeToScalyr()
 
-	return clt
+	return clt, nil
 }
 
 // The request as specified in the API doc ( https://www.scalyr.com/help/api#addEvents )
@@ -43,7 +118,15 @@ type UploadData struct {
 	Session     string                 `json:"session"`
 	SessionInfo map[string]interface{} `json:"sessionInfo,omitempty"`
 	Threads     map[string]interface{} `json:"threads,omitempty"`
+	Logs        []*Log                 `json:"logs,omitempty"`
 	Events      []*LogEvent            `json:"events"`
+	logIDs      map[string]bool        // IDs of the logs of the request
+}
+
+// Log holds the attributes shared by the events of a client
+type Log struct {
+	ID    string                 `json:"id"`
+	Attrs map[string]interface{} `json:"attrs"`
 }
 
 // The log event as specified in the API doc
@@ -51,7 +134,53 @@ type LogEvent struct {
 	Timestamp   int64                  `json:"ts"`
 	Severity    uint8                  `json:"sev"`
 	Attributes  map[string]interface{} `json:"attrs"`
+	Log         string                 `json:"log,omitempty"`
 	sessionInfo map[string]interface{}
+	token       string          // Token of the tenant of the client
+	source      *clients.Source // Client which sent the event
+	seq         uint64          // Sequence number in the disk queue
+	stored      bool            // Read from the disk queue
+}
+
+// storedEvent is an event as it's stored in the disk queue and in the dead letters, with what's needed to send it
+// after a restart. Its token isn't stored, it's the one of its tenant when it's read.
+type storedEvent struct {
+	Event       *LogEvent              `json:"event"`
+	SessionInfo map[string]interface{} `json:"session_info,omitempty"`
+	Source      *clients.StoredSource  `json:"source"`
+}
+
+func newStoredEvent(event *LogEvent) *storedEvent {
+	return &storedEvent{
+		Event:       event,
+		SessionInfo: event.sessionInfo,
+		Source:      event.source.Store(),
+	}
+}
+
+// decodeEvent decodes a stored event, which fails if its tenant doesn't exist anymore
+func (clt *Client) decodeEvent(record []byte) (*LogEvent, error) {
+	stored := &storedEvent{}
+	if err := json.Unmarshal(record, stored); err != nil {
+		return nil, err
+	}
+	if stored.Event == nil || stored.Source == nil {
+		return nil, errors.New("incomplete event")
+	}
+	source, err := stored.Source.Restore()
+	if err != nil {
+		return nil, err
+	}
+	event := stored.Event
+	event.sessionInfo = stored.SessionInfo
+	event.source = source
+	event.token = clt.token(source)
+	return event, nil
+}
+
+// token returns the token of the events of a client
+func (clt *Client) token(source *clients.Source) string {
+	return source.Tenant.OutputToken(clt.name, string(clt.config.Token))
 }
 
 func scalyrSeverityConversion(level clients.Level) uint8 {
@@ -59,7 +188,7 @@ func scalyrSeverityConversion(level clients.Level) uint8 {
 }
 
 func (clt *Client) Name() string {
-	return "scalyr"
+	return clt.name
 }
 
 func (clt *Client) Send(srcEvent *clients.LogEvent) {
@@ -67,6 +196,8 @@ func (clt *Client) Send(srcEvent *clients.LogEvent) {
 		Timestamp:  srcEvent.Timestamp.UnixNano(),
 		Severity:   scalyrSeverityConversion(srcEvent.Severity),
 		Attributes: make(map[string]interface{}),
+		token:      clt.token(srcEvent.Source),
+		source:     srcEvent.Source,
 	}
 
 	// Converting some keys to other keys in the message
@@ -97,181 +228,498 @@ func (clt *Client) Send(srcEvent *clients.LogEvent) {
 		}
 	}
 
-	clt.events <- dstEvent
+	clt.push(dstEvent)
+}
+
+// Replay sends an event written to the dead letters, with the current token of its tenant
+func (clt *Client) Replay(record []byte) error {
+	event, err := clt.decodeEvent(record)
+	if err != nil {
+		return err
+	}
+	clt.push(event)
+	return nil
+}
+
+// push queues an event, in memory or on the disk
+func (clt *Client) push(event *LogEvent) {
+	// Once events were spilled, the following ones are spilled too until they're sent, so that they keep their order
+	if clt.queue != nil && (!clt.spill || clt.queue.Len() > 0) {
+		clt.store(event)
+		return
+	}
+	clt.enqueue(event)
+}
+
+// enqueue queues an event in memory, the overflow policy is applied when the queue is full
+func (clt *Client) enqueue(event *LogEvent) {
+	atomic.AddInt64(&clt.pending, 1)
+	event.source.Pending.Add(clt.name, 1)
+	if clt.config.OverflowPolicy == clients.OverflowBlock {
+		clt.events <- event
+		return
+	}
+
+	for {
+		select {
+		case clt.events <- event:
+			return
+		default:
+		}
+
+		switch clt.config.OverflowPolicy {
+		case clients.OverflowDropOldest:
+			select {
+			case oldest := <-clt.events:
+				clt.dropOverflow()
+				clt.handled(oldest)
+			default:
+			}
+		case clients.OverflowSpill:
+			clt.handled(event)
+			clt.store(event)
+			return
+		default:
+			clt.dropOverflow()
+			clt.handled(event)
+			return
+		}
+	}
+}
+
+// dropOverflow accounts for an event dropped by the overflow policy
+func (clt *Client) dropOverflow() {
+	clients.OutputEventsOverflowed.Inc(clt.name, clt.config.OverflowPolicy)
+	clients.OutputEventsDropped.Inc(clt.name)
+}
+
+// store writes an event to the disk queue, its client doesn't wait for it to be sent
+func (clt *Client) store(event *LogEvent) {
+	if clt.spill {
+		clients.OutputEventsOverflowed.Inc(clt.name, clients.OverflowSpill)
+	}
+	record, err := json.Marshal(newStoredEvent(event))
+	if err == nil {
+		if clt.config.OverflowPolicy == clients.OverflowDropNewest {
+			err = clt.queue.TryPush(record)
+		} else {
+			err = clt.queue.Push(record)
+		}
+	}
+	if err == diskqueue.ErrFull {
+		clt.dropOverflow()
+	} else if err != nil {
+		clt.log.Warnw(
+			"Couldn't write event to the disk queue",
+			"err", err,
+		)
+		clients.OutputEventsDropped.Inc(clt.name)
+		clients.ReportFailure(clt.name, err)
+		clt.deadLetter([]*LogEvent{event}, 0, err)
+	}
+}
+
+// readQueue feeds the writer with the events of the disk queue, until the client is closed
+func (clt *Client) readQueue() {
+	for {
+		record, seq, err := clt.reader.Pop()
+		if err == diskqueue.ErrStopped {
+			break
+		}
+		var event *LogEvent
+		if err == nil {
+			if event, err = clt.decodeEvent(record); err != nil {
+				// It can still be replayed once its tenant is back
+				clt.deadLetterRecord(record, err)
+			}
+		}
+		if err != nil {
+			clt.log.Warnw(
+				"Dropping event which couldn't be read from the disk queue",
+				"err", err,
+			)
+			clients.OutputEventsDropped.Inc(clt.name)
+			clt.queue.Ack(seq)
+			continue
+		}
+
+		event.seq = seq
+		event.stored = true
+		clt.events <- event
+	}
+
+	// Event closing the scaly HTTP sender
+	clt.events <- nil
+}
+
+// handled accounts for events which were sent or dropped, the ones read from the disk queue are removed from it
+func (clt *Client) handled(events ...*LogEvent) {
+	var seqs []uint64
+	for _, event := range events {
+		if event.stored {
+			seqs = append(seqs, event.seq)
+			continue
+		}
+		atomic.AddInt64(&clt.pending, -1)
+		event.source.Pending.Add(clt.name, -1)
+	}
+	if len(seqs) > 0 {
+		clt.queue.Ack(seqs...)
+	}
 }
 
 func (clt *Client) Close() error {
+	if clt.queue != nil {
+		// The events which weren't read from the disk queue are sent by the client replacing this one after a reload,
+		// or after a restart
+		clt.reader.Stop()
+		return nil
+	}
+
 	// Event closing the scaly HTTP sender
 	clt.events <- nil
 	return nil
 }
 
-func (clt *Client) writeToScalyr() {
-	uploadData := &UploadData{
-		Token:   clt.config.Token,
-		Session: fmt.Sprint(uuid.NewV4()),
+func (clt *Client) Done() <-chan struct{} {
+	return clt.done
+}
+
+func (clt *Client) Pending() int {
+	pending := int(atomic.LoadInt64(&clt.pending))
+	if clt.queue != nil {
+		pending += clt.queue.Len()
 	}
+	return pending
+}
 
-	loop := true
+func (clt *Client) QueueLength() int {
+	switch {
+	case clt.spill:
+		return int(atomic.LoadInt64(&clt.pending)) + clt.queue.Len()
+	case clt.queue != nil:
+		return clt.queue.Len()
+	}
+	return len(clt.events)
+}
+
+// QueueUsage returns the usage of the disk queue if there's one, as the memory queue is expected to be full when the
+// events are spilled
+func (clt *Client) QueueUsage() int {
+	if clt.queue != nil {
+		return clt.queue.Usage()
+	}
+	return len(clt.events) * 100 / cap(clt.events)
+}
 
-	sessionInfo := map[string]interface{}{
-		"conn_src": clt.srcClient.Addr().String(),
-		"conn_id":  clt.srcClient.ID(),
-		"source":   "logfwd",
+func (clt *Client) writeToScalyr() {
+	defer close(clt.done)
+	if clt.queue != nil {
+		defer clt.closeQueue()
 	}
-	// sessionInfoLastTransmission := time.Unix(0, 0)
+
+	loop := true
 	events := make([]*LogEvent, clt.config.RequestMaxNbEvents)
 
 	for loop {
 		events := events[:0]
 
-		// Every 3 minutes, we give some info about the current steam
-		// sessionInfoSend := time.Now().Sub(sessionInfoLastTransmission) > time.Second*30
-
 		// We read all the events
-		for len(events) == 0 || (len(clt.events) > 0 && len(events) < clt.maxNbEvents) {
+		for loop && (len(events) == 0 || (len(clt.events) > 0 && len(events) < clt.maxNbEvents)) {
 			event := <-clt.events
 			if event == nil {
 				loop = false
-				// sessionInfoSend = true
 			} else {
-				// Adding all the event's sessionInfo to the stream session info
-				if event.sessionInfo != nil {
-					for k, v := range event.sessionInfo {
-						if sessionInfo[k] != v {
-							sessionInfo[k] = v
-							// sessionInfoSend = true
-						}
-					}
-					event.sessionInfo = nil
-				}
 				events = append(events, event)
 			}
 		}
 
-		// Always send sessionInfo for now
-		// sessionInfoSend = true
+		// The client was closed while there wasn't any event left to send
+		if len(events) == 0 {
+			break
+		}
 
-		// If we have some session data to send
-		// if sessionInfoSend {
-		// sessionInfoSend = false
-		// sessionInfoLastTransmission = time.Now()
-		uploadData.SessionInfo = sessionInfo
-		// }
+		for _, uploadData := range clt.uploads(events) {
+			clt.send(uploadData)
+		}
 
-		uploadData.Events = events
+		clt.expireSessions()
+	}
+}
 
-		if err := clt.sendRequest(uploadData); err != nil {
-			clt.log.Warnw(
-				"Problem sending data",
-				"err", err,
+// send sends the events of a request, it's split in two halves when it's too big
+func (clt *Client) send(uploadData *UploadData) {
+	rawJSON, err := json.Marshal(uploadData)
+	if err != nil {
+		clt.log.Errorw(
+			"Problem generating JSON",
+			"err", err,
+		)
+	} else if size := len(rawJSON); size > clt.config.RequestMaxSize {
+		if len(uploadData.Events) > 1 {
+			// The next batches are smaller, until the requests succeed again
+			clt.maxNbEvents = len(uploadData.Events) / 2
+			clt.log.Debugw(
+				"Query too big, splitting it",
+				"nbEvents", len(uploadData.Events),
+				"maxNbEvents", clt.maxNbEvents,
+				"size", size,
+				"maxSize", clt.config.RequestMaxSize,
 			)
+			first, second := uploadData.split()
+			clt.send(first)
+			clt.send(second)
+			return
 		}
+		err = fmt.Errorf(
+			"request is too big: requestSize=%d > maxRequestSize=%d",
+			size,
+			clt.config.RequestMaxSize,
+		)
+	}
+
+	attempts := 0
+	if err == nil {
+		attempts, err = clt.sendRequest(rawJSON, len(uploadData.Events))
 	}
+	if err != nil {
+		clt.log.Warnw(
+			"Problem sending data",
+			"err", err,
+		)
+		clients.OutputEventsDropped.Add(float64(len(uploadData.Events)), clt.name)
+		clt.deadLetter(uploadData.Events, attempts, err)
+	} else {
+		clients.OutputEventsSent.Add(float64(len(uploadData.Events)), clt.name)
+	}
+	clt.handled(uploadData.Events...)
 }
 
-func (clt *Client) sendRequest(uploadData *UploadData) error {
-	var rawJSON []byte
-	var err error
-	for {
-		rawJSON, err = json.Marshal(uploadData)
-		size := len(rawJSON)
-		if size > clt.config.RequestMaxSize {
-			if clt.maxNbEvents > 1 {
-				clt.log.Debugw(
-					"Query too big, reducing the number of events",
-					"nbEvents", len(uploadData.Events),
-					"maxNbEvents", clt.maxNbEvents,
-					"size", size,
-					"maxSize", clt.config.RequestMaxSize,
-				)
-				clt.maxNbEvents = len(uploadData.Events) - 1
-				lastEvent := uploadData.Events[len(uploadData.Events)-1]
-				uploadData.Events = uploadData.Events[:len(uploadData.Events)-1]
-				go func() { // It could already be full and we would create a deadlock
-					clt.events <- lastEvent
-				}()
-				continue
-			} else {
-				return fmt.Errorf(
-					"request is too big: requestSize=%d > maxRequestSize=%d",
-					len(rawJSON),
-					clt.config.RequestMaxSize,
-				)
-			}
+// deadLetter writes events which couldn't be sent to the dead letters
+func (clt *Client) deadLetter(events []*LogEvent, attempts int, cause error) {
+	for _, event := range events {
+		if err := clients.DeadLetter(clt.name, newStoredEvent(event), attempts, cause); err != nil {
+			clt.log.Errorw(
+				"Couldn't write dead letter",
+				"err", err,
+			)
 		}
-		break
 	}
+}
 
-	if err != nil {
+// deadLetterRecord writes a record of the disk queue which couldn't be decoded to the dead letters
+func (clt *Client) deadLetterRecord(record []byte, cause error) {
+	if err := clients.DeadLetter(clt.name, json.RawMessage(record), 0, cause); err != nil {
 		clt.log.Errorw(
-			"Problem generating JSON",
+			"Couldn't write dead letter",
 			"err", err,
 		)
-		return err
 	}
+}
+
+// closeQueue closes the disk queue once the writer is done with its events
+func (clt *Client) closeQueue() {
+	if err := clt.queue.Close(); err != nil {
+		clt.log.Errorw(
+			"Issue closing disk queue",
+			"err", err,
+		)
+	}
+}
+
+// uploads groups the events by scalyr session, each client whose events are in a request is described by a log
+func (clt *Client) uploads(events []*LogEvent) []*UploadData {
+	var uploads []*UploadData
+	bySession := make(map[*session]*UploadData)
+	now := time.Now()
+
+	for _, event := range events {
+		sess := clt.session(event, now)
+		uploadData, ok := bySession[sess]
+		if !ok {
+			// Always send sessionInfo for now
+			uploadData = &UploadData{
+				Token:       sess.token,
+				Session:     sess.id,
+				SessionInfo: sess.info,
+			}
+			bySession[sess] = uploadData
+			uploads = append(uploads, uploadData)
+		}
+		event.Log = event.source.Key()
+		uploadData.add(event)
+	}
+	return uploads
+}
+
+// add adds an event to a request, with the log describing its client if it's the first one of the client
+func (uploadData *UploadData) add(event *LogEvent) {
+	if uploadData.logIDs == nil {
+		uploadData.logIDs = make(map[string]bool)
+	}
+	if !uploadData.logIDs[event.Log] {
+		uploadData.logIDs[event.Log] = true
+		uploadData.Logs = append(uploadData.Logs, &Log{ID: event.Log, Attrs: sourceAttributes(event.source)})
+	}
+	uploadData.Events = append(uploadData.Events, event)
+}
+
+// split splits the events of a request in two requests of the same session, the first one gets the oldest events
+func (uploadData *UploadData) split() (*UploadData, *UploadData) {
+	first := &UploadData{Token: uploadData.Token, Session: uploadData.Session, SessionInfo: uploadData.SessionInfo}
+	second := &UploadData{Token: uploadData.Token, Session: uploadData.Session, SessionInfo: uploadData.SessionInfo}
+	half := len(uploadData.Events) / 2
+	for _, event := range uploadData.Events[:half] {
+		first.add(event)
+	}
+	for _, event := range uploadData.Events[half:] {
+		second.add(event)
+	}
+	return first, second
+}
+
+// session returns the scalyr session of an event, from the session info of its client updated by the event
+func (clt *Client) session(event *LogEvent, now time.Time) *session {
+	src, ok := clt.sourceSessions[event.source.Key()]
+	if !ok {
+		src = &sourceSession{info: map[string]interface{}{"source": "logfwd"}}
+		if tenant := event.source.Tenant; tenant != nil {
+			src.info["tenant"] = tenant.Name
+		}
+		clt.sourceSessions[event.source.Key()] = src
+	}
+	for k, v := range event.sessionInfo {
+		src.info[k] = v
+	}
+	src.lastUsed = now
+
+	key := fmt.Sprintf("%s\n%v", event.token, src.info) // The maps are printed in the keys order
+	sess, ok := clt.sessions[key]
+	if !ok {
+		sess = &session{
+			id:    fmt.Sprint(uuid.NewV4()),
+			token: event.token,
+			info:  make(map[string]interface{}, len(src.info)),
+		}
+		for k, v := range src.info {
+			sess.info[k] = v
+		}
+		clt.sessions[key] = sess
+	}
+	sess.lastUsed = now
+	return sess
+}
+
+// expireSessions forgets the sessions and the session info of the clients which weren't used recently
+func (clt *Client) expireSessions() {
+	now := time.Now()
+	if now.Sub(clt.lastExpiry) < time.Minute {
+		return
+	}
+	clt.lastExpiry = now
+
+	for key, sess := range clt.sessions {
+		if now.Sub(sess.lastUsed) > sessionExpiry {
+			delete(clt.sessions, key)
+		}
+	}
+	for id, src := range clt.sourceSessions {
+		if now.Sub(src.lastUsed) > sessionExpiry {
+			delete(clt.sourceSessions, id)
+		}
+	}
+}
 
+// sourceAttributes returns the attributes describing a client
+func sourceAttributes(source *clients.Source) map[string]interface{} {
+	attrs := map[string]interface{}{
+		"conn_src": source.Addr.String(),
+		"conn_id":  source.ID,
+	}
+	if identity := source.Identity; identity != nil {
+		attrs["tls_cn"] = identity.CommonName
+		if len(identity.SANs) > 0 {
+			attrs["tls_sans"] = strings.Join(identity.SANs, ",")
+		}
+	}
+	return attrs
+}
+
+// sendRequest sends a request, it returns the number of attempts when it gives up
+func (clt *Client) sendRequest(rawJSON []byte, nbEvents int) (int, error) {
 	clt.log.Debugw(
 		"Scalyr HTTP Request",
-		"nbSentEvents", len(uploadData.Events),
+		"nbSentEvents", nbEvents,
 		"nbWaitingEvents", len(clt.events),
 		"data", string(rawJSON),
 	)
 
+	// With a disk queue, the events are kept until they're sent, we never give up
 	backoffTime := time.Duration(0)
-	backoffIncrement := time.Second
-	for backoffIncrement < time.Minute {
+	backoffIncrement := retryDelay
+	attempts := 0
+	var err error
+	for clt.queue != nil || attempts < maxAttempts {
 		time.Sleep(time.Millisecond * time.Duration(clt.config.RequestMinPeriod))
-
-		var resp *http.Response
-		resp, err = clt.httpClient.Post(clt.config.scalyrEndpoint, "application/json", bytes.NewBuffer(rawJSON))
-
-		if err != nil {
-			clt.log.Warnw(
-				"HTTP request error",
-				"err", err,
-			)
-			backoffTime += backoffIncrement
-			time.Sleep(backoffTime)
-			backoffIncrement *= 2
-			continue
-		}
-
-		if resp.StatusCode == 200 {
-			if uploadData.SessionInfo != nil {
-				uploadData.SessionInfo = nil
+		attempts++
+
+		var status int
+		status, err = clt.post(rawJSON)
+		if err == nil {
+			if status == http.StatusOK {
+				clients.ReportSuccess(clt.name)
+				if clt.maxNbEvents < clt.config.RequestMaxNbEvents {
+					clt.maxNbEvents++
+				}
+				return attempts, nil
 			}
-			if clt.maxNbEvents < clt.config.RequestMaxNbEvents {
-				clt.maxNbEvents++
+			err = &clients.StatusError{Status: status}
+			// The other client errors would fail again
+			if status < 500 && status != http.StatusTooManyRequests {
+				clients.ReportFailure(clt.name, err)
+				return attempts, err
 			}
 		}
 
-		{
-			var body []byte
-			if body, err = ioutil.ReadAll(resp.Body); err != nil {
-				clt.log.Warnw(
-					"Issue reading response",
-					"err", err,
-				)
-				continue
-			} else {
-				clt.log.Debugw("Scalyr HTTP Response",
-					"statusCode", resp.StatusCode,
-					"statusMsg", resp.Status,
-					"body", string(body),
-				)
-			}
+		clt.log.Warnw(
+			"HTTP request error",
+			"err", err,
+		)
+		clients.ReportFailure(clt.name, err)
+		clients.OutputRetries.Inc(clt.name)
+		if backoffTime += backoffIncrement; backoffTime > maxRetryDelay {
+			backoffTime = maxRetryDelay
 		}
-
-		if err = resp.Body.Close(); err != nil {
-			clt.log.Errorw(
-				"Problem closing HTTP response body",
-				"err", err,
-			)
-			continue
+		time.Sleep(backoffTime)
+		if backoffIncrement < time.Minute {
+			backoffIncrement *= 2
 		}
+	}
+	return attempts, fmt.Errorf("couldn't send our data: %s", err)
+}
 
-		return nil
+// post sends a request to scalyr, it returns the status of the response once its body was read
+func (clt *Client) post(rawJSON []byte) (int, error) {
+	start := time.Now()
+	resp, err := clt.httpClient.Post(clt.config.scalyrEndpoint, "application/json", bytes.NewBuffer(rawJSON))
+	requestDuration.Observe(time.Since(start).Seconds(), clt.name)
+	if err != nil {
+		requests.Inc(clt.name, "error")
+		return 0, err
+	}
+	requests.Inc(clt.name, strconv.Itoa(resp.StatusCode))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if closeErr := resp.Body.Close(); err == nil {
+		err = closeErr
 	}
-	return fmt.Errorf("couldn't send our data")
+	if err != nil {
+		return 0, fmt.Errorf("issue reading response: %s", err)
+	}
+	clt.log.Debugw("Scalyr HTTP Response",
+		"statusCode", resp.StatusCode,
+		"statusMsg", resp.Status,
+		"body", string(body),
+	)
+	return resp.StatusCode, nil
 }
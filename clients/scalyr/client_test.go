@@ -0,0 +1,512 @@
+package scalyr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/clients/diskqueue"
+	"go.uber.org/zap"
+)
+
+// fakeScalyr records the requests it accepts, it answers with the statuses it's given and then with 200
+type fakeScalyr struct {
+	*httptest.Server
+	sync.Mutex
+	statuses []int
+	failing  bool // Answers 503 while it's set
+	attempts int  // Requests received, including the failed ones
+	requests []*UploadData
+	sizes    []int
+}
+
+func newFakeScalyr(t *testing.T, statuses ...int) *fakeScalyr {
+	fake := &fakeScalyr{statuses: statuses}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploadData := &UploadData{}
+		size := r.ContentLength
+		if err := json.NewDecoder(r.Body).Decode(uploadData); err != nil {
+			t.Errorf("invalid request: %s", err)
+		}
+		fake.Lock()
+		fake.attempts++
+		status := http.StatusOK
+		if fake.failing {
+			status = http.StatusServiceUnavailable
+		} else if len(fake.statuses) > 0 {
+			status, fake.statuses = fake.statuses[0], fake.statuses[1:]
+		}
+		if status == http.StatusOK {
+			fake.requests = append(fake.requests, uploadData)
+			fake.sizes = append(fake.sizes, int(size))
+		}
+		fake.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// messages returns the messages of the events which were accepted, in the order they were received
+func (fake *fakeScalyr) messages() []string {
+	fake.Lock()
+	defer fake.Unlock()
+	var messages []string
+	for _, uploadData := range fake.requests {
+		for _, event := range uploadData.Events {
+			messages = append(messages, fmt.Sprint(event.Attributes["message"]))
+		}
+	}
+	return messages
+}
+
+func (fake *fakeScalyr) setFailing(failing bool) {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.failing = failing
+}
+
+func (fake *fakeScalyr) nbAttempts() int {
+	fake.Lock()
+	defer fake.Unlock()
+	return fake.attempts
+}
+
+type letterRecorder struct {
+	sync.Mutex
+	letters []*clients.EventDeadLetter
+}
+
+func (r *letterRecorder) WriteEvent(letter *clients.EventDeadLetter) error {
+	r.Lock()
+	defer r.Unlock()
+	r.letters = append(r.letters, letter)
+	return nil
+}
+
+func recordDeadLetters(t *testing.T) *letterRecorder {
+	recorder := &letterRecorder{}
+	clients.SetDeadLetterWriter(recorder)
+	t.Cleanup(func() { clients.SetDeadLetterWriter(nil) })
+	return recorder
+}
+
+func testConfig(server *fakeScalyr) *Config {
+	config := NewConfig()
+	config.Token = "token"
+	config.scalyrEndpoint = server.URL + "/addEvents"
+	return config
+}
+
+// newTestClient creates a client with a memory queue whose writer isn't started, so that the events sent before
+// starting it are read in a single batch
+func newTestClient(config *Config) *Client {
+	return &Client{
+		name:           "scalyr",
+		config:         config,
+		log:            zap.NewNop().Sugar(),
+		events:         make(chan *LogEvent, config.QueueSize),
+		maxNbEvents:    config.RequestMaxNbEvents,
+		done:           make(chan struct{}),
+		sessions:       make(map[string]*session),
+		sourceSessions: make(map[string]*sourceSession),
+		lastExpiry:     time.Now(),
+	}
+}
+
+func newSource(id int) *clients.Source {
+	return &clients.Source{
+		ID:      id,
+		Addr:    &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(id)), Port: 1234},
+		Pending: clients.NewPending(),
+	}
+}
+
+func send(clt *Client, source *clients.Source, message, appname string) {
+	clt.Send(&clients.LogEvent{
+		Timestamp:  time.Now(),
+		Attributes: map[string]interface{}{"message": message, "appname": appname},
+		Source:     source,
+	})
+}
+
+// closeClient closes a client and waits until its events were handled
+func closeClient(t *testing.T, clt *Client) {
+	if err := clt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-clt.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("the client didn't send its events")
+	}
+}
+
+func TestSessions(t *testing.T) {
+	server := newFakeScalyr(t)
+	clt := newTestClient(testConfig(server))
+	a, b := newSource(1), newSource(2)
+	for i := 1; i <= 3; i++ {
+		send(clt, a, fmt.Sprintf("a%d", i), "app-a")
+		send(clt, b, fmt.Sprintf("b%d", i), "app-b")
+	}
+	go clt.writeToScalyr()
+	closeClient(t, clt)
+
+	// The events of each session are in a request of their own, in the order they were sent
+	if len(server.requests) != 2 {
+		t.Fatalf("got %d requests", len(server.requests))
+	}
+	for i, want := range []string{"a", "b"} {
+		uploadData := server.requests[i]
+		if uploadData.SessionInfo["serverHost"] != "app-"+want || uploadData.Token != "token" {
+			t.Errorf("unexpected session info %v", uploadData.SessionInfo)
+		}
+		var messages []string
+		for _, event := range uploadData.Events {
+			messages = append(messages, fmt.Sprint(event.Attributes["message"]))
+			if event.Log != uploadData.Logs[0].ID {
+				t.Errorf("event of log %s, want %s", event.Log, uploadData.Logs[0].ID)
+			}
+		}
+		if got := strings.Join(messages, ","); got != want+"1,"+want+"2,"+want+"3" {
+			t.Errorf("got events %s", got)
+		}
+		if len(uploadData.Logs) != 1 || uploadData.Logs[0].Attrs["conn_id"] != float64(i+1) {
+			t.Errorf("unexpected logs %v", uploadData.Logs)
+		}
+	}
+	if server.requests[0].Session == server.requests[1].Session {
+		t.Error("the sessions have the same ID")
+	}
+	if clt.Pending() != 0 || a.Pending.Total() != 0 || b.Pending.Total() != 0 {
+		t.Errorf("got %d pending events", clt.Pending())
+	}
+}
+
+func TestSplit(t *testing.T) {
+	recorder := recordDeadLetters(t)
+	server := newFakeScalyr(t)
+	config := testConfig(server)
+	config.RequestMaxSize = 1000
+	clt := newTestClient(config)
+	source := newSource(1)
+
+	var want []string
+	for i := 1; i <= 8; i++ {
+		message := fmt.Sprintf("%d %s", i, strings.Repeat("x", 100))
+		if i == 5 {
+			// It doesn't fit in a request at all
+			message = strings.Repeat("y", 1000)
+		} else {
+			want = append(want, message)
+		}
+		send(clt, source, message, "app")
+	}
+	go clt.writeToScalyr()
+	closeClient(t, clt)
+
+	// The requests are split in halves until they fit, the events keep their order
+	if got := server.messages(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got events %q", got)
+	}
+	if len(server.requests) < 2 {
+		t.Errorf("got %d requests", len(server.requests))
+	}
+	for i, uploadData := range server.requests {
+		if len(uploadData.Events) == 0 || server.sizes[i] > config.RequestMaxSize {
+			t.Errorf("request %d has %d events and %d bytes", i, len(uploadData.Events), server.sizes[i])
+		}
+	}
+	if len(recorder.letters) != 1 || !strings.Contains(recorder.letters[0].Error, "too big") {
+		t.Errorf("unexpected dead letters %v", recorder.letters)
+	}
+	if clt.maxNbEvents < 1 || clt.maxNbEvents >= config.RequestMaxNbEvents {
+		t.Errorf("got a maximum of %d events", clt.maxNbEvents)
+	}
+	if source.Pending.Total() != 0 {
+		t.Errorf("got %d pending events", source.Pending.Total())
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = time.Millisecond
+
+	tests := []struct {
+		name     string
+		statuses []int
+		sent     bool
+		status   int // Status of the dead letter
+	}{
+		{"server errors", []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, true, 0},
+		{"rate limited", []int{http.StatusTooManyRequests}, true, 0},
+		{"rejected", []int{http.StatusBadRequest}, false, http.StatusBadRequest},
+		{"gave up", []int{500, 500, 500, 500, 500, 500}, false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := recordDeadLetters(t)
+			server := newFakeScalyr(t, test.statuses...)
+			clt := newTestClient(testConfig(server))
+			send(clt, newSource(1), "first", "app")
+			send(clt, newSource(1), "second", "app")
+			go clt.writeToScalyr()
+			closeClient(t, clt)
+
+			if test.sent {
+				// The events are sent once, in order
+				if got := server.messages(); strings.Join(got, ",") != "first,second" {
+					t.Errorf("got events %q", got)
+				}
+				if len(recorder.letters) != 0 {
+					t.Errorf("unexpected dead letters %v", recorder.letters)
+				}
+				return
+			}
+			if len(server.requests) != 0 {
+				t.Errorf("got %d requests", len(server.requests))
+			}
+			if len(recorder.letters) != 2 {
+				t.Fatalf("got %d dead letters", len(recorder.letters))
+			}
+			if letter := recorder.letters[0]; letter.Status != test.status || letter.Attempts != len(test.statuses) {
+				t.Errorf("got status %d after %d attempts", letter.Status, letter.Attempts)
+			}
+		})
+	}
+}
+
+// newDiskClient creates a client whose events are queued in a disk queue
+func newDiskClient(t *testing.T, server *fakeScalyr, dir string) *Client {
+	config := testConfig(server)
+	config.QueueDir = dir
+	config.QueueSync = diskqueue.SyncAlways
+	clt, err := NewClient("scalyr", config, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clt
+}
+
+// waitSent waits until the events of the disk queue were sent, as they're left in the queue when the client is closed
+func waitSent(t *testing.T, clt *Client) {
+	deadline := time.Now().Add(10 * time.Second)
+	for clt.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events weren't sent", clt.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// queueLen returns the number of events left in the disk queue of a closed client
+func queueLen(t *testing.T, dir string) int {
+	queue, err := diskqueue.Open(filepath.Join(dir, "scalyr"), diskqueue.Options{
+		MaxSize:     1024 * 1024,
+		SegmentSize: 1024 * 1024,
+		Sync:        diskqueue.SyncAlways,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close() // nolint: errcheck
+	return queue.Len()
+}
+
+// copyQueue copies the disk queue files as they'd be found after a crash
+func copyQueue(t *testing.T, dir string) string {
+	copied := t.TempDir()
+	if err := os.Mkdir(filepath.Join(copied, "scalyr"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "scalyr", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(copied, "scalyr", filepath.Base(path)), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return copied
+}
+
+func TestDiskQueueRestart(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = time.Millisecond
+
+	server := newFakeScalyr(t)
+	server.setFailing(true)
+	dir := t.TempDir()
+	clt := newDiskClient(t, server, dir)
+	source := newSource(1)
+	for i := 1; i <= 5; i++ {
+		send(clt, source, fmt.Sprintf("event %d", i), "app")
+	}
+
+	// Nothing is acknowledged until an upload succeeds, the events are read again after a crash
+	deadline := time.Now().Add(10 * time.Second)
+	for server.nbAttempts() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	crashed := copyQueue(t, dir)
+
+	// The events are kept in the queue until they're sent, they're acknowledged once uploaded
+	server.setFailing(false)
+	waitSent(t, clt)
+	closeClient(t, clt)
+	want := "event 1,event 2,event 3,event 4,event 5"
+	if got := strings.Join(server.messages(), ","); got != want {
+		t.Errorf("got events %s", got)
+	}
+	if n := queueLen(t, dir); n != 0 {
+		t.Errorf("%d events are left in the queue", n)
+	}
+
+	// After a restart, the events are sent again, exactly once
+	restarted := newFakeScalyr(t)
+	clt = newDiskClient(t, restarted, crashed)
+	waitSent(t, clt)
+	closeClient(t, clt)
+	if got := strings.Join(restarted.messages(), ","); got != want {
+		t.Errorf("got events %s after the restart", got)
+	}
+	if restarted.requests[0].Logs[0].Attrs["conn_id"] != float64(1) {
+		t.Errorf("unexpected logs %v", restarted.requests[0].Logs)
+	}
+	if n := queueLen(t, crashed); n != 0 {
+		t.Errorf("%d events are left in the queue after the restart", n)
+	}
+}
+
+func TestDiskQueueReload(t *testing.T) {
+	server := newFakeScalyr(t)
+	dir := t.TempDir()
+	source := newSource(1)
+
+	// The client replacing another one after a reload shares its queue, it's still open once the old client is closed
+	old := newDiskClient(t, server, dir)
+	for i := 1; i <= 3; i++ {
+		send(old, source, fmt.Sprintf("event %d", i), "app")
+	}
+	clt := newDiskClient(t, server, dir)
+	closeClient(t, old)
+	for i := 4; i <= 6; i++ {
+		send(clt, source, fmt.Sprintf("event %d", i), "app")
+	}
+	waitSent(t, clt)
+	closeClient(t, clt)
+
+	got := server.messages()
+	sort.Strings(got)
+	if strings.Join(got, ",") != "event 1,event 2,event 3,event 4,event 5,event 6" {
+		t.Errorf("got events %q", got)
+	}
+	if n := queueLen(t, dir); n != 0 {
+		t.Errorf("%d events are left in the queue", n)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		policy    string
+		queued    string // Events left in the memory queue
+		nbDropped float64
+	}{
+		{clients.OverflowDropNewest, "event 1,event 2", 2},
+		{clients.OverflowDropOldest, "event 3,event 4", 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			config := NewConfig()
+			config.QueueSize = 2
+			config.OverflowPolicy = test.policy
+			clt := newTestClient(config)
+			clt.name = "scalyr_" + test.policy
+			dropped := clients.OutputEventsDropped.Value(clt.name)
+			overflowed := clients.OutputEventsOverflowed.Value(clt.name, test.policy)
+			source := newSource(1)
+			for i := 1; i <= 4; i++ {
+				send(clt, source, fmt.Sprintf("event %d", i), "app")
+			}
+
+			if got := clients.OutputEventsDropped.Value(clt.name) - dropped; got != test.nbDropped {
+				t.Errorf("got %g dropped events, want %g", got, test.nbDropped)
+			}
+			if got := clients.OutputEventsOverflowed.Value(clt.name, test.policy) - overflowed; got != test.nbDropped {
+				t.Errorf("got %g overflowed events, want %g", got, test.nbDropped)
+			}
+			if clt.Pending() != 2 || source.Pending.Total() != 2 {
+				t.Errorf("got %d pending events", clt.Pending())
+			}
+			var queued []string
+			for len(clt.events) > 0 {
+				queued = append(queued, fmt.Sprint((<-clt.events).Attributes["message"]))
+			}
+			if got := strings.Join(queued, ","); got != test.queued {
+				t.Errorf("got queued events %s, want %s", got, test.queued)
+			}
+		})
+	}
+}
+
+func TestOverflowSpill(t *testing.T) {
+	server := newFakeScalyr(t)
+	config := testConfig(server)
+	config.QueueSize = 2
+	config.OverflowPolicy = clients.OverflowSpill
+	config.QueueDir = t.TempDir()
+	clt := newTestClient(config)
+	clt.name = "scalyr_spill"
+	queue, err := config.OpenQueue(clt.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clt.queue, clt.reader, clt.spill = queue, queue.NewReader(), true
+
+	// Once events were spilled, the next ones are spilled too so that they're sent after them
+	dropped := clients.OutputEventsDropped.Value(clt.name)
+	spilled := clients.OutputEventsOverflowed.Value(clt.name, clients.OverflowSpill)
+	source := newSource(1)
+	for i := 1; i <= 5; i++ {
+		send(clt, source, fmt.Sprintf("event %d", i), "app")
+	}
+	if queue.Len() != 3 || len(clt.events) != 2 {
+		t.Fatalf("got %d spilled events and %d events in memory", queue.Len(), len(clt.events))
+	}
+	if got := clients.OutputEventsOverflowed.Value(clt.name, clients.OverflowSpill) - spilled; got != 3 {
+		t.Errorf("got %g spilled events", got)
+	}
+	if got := clients.OutputEventsDropped.Value(clt.name) - dropped; got != 0 {
+		t.Errorf("got %g dropped events", got)
+	}
+
+	go clt.readQueue()
+	go clt.writeToScalyr()
+	waitSent(t, clt)
+	closeClient(t, clt)
+	if got := strings.Join(server.messages(), ","); got != "event 1,event 2,event 3,event 4,event 5" {
+		t.Errorf("got events %s", got)
+	}
+	if source.Pending.Total() != 0 {
+		t.Errorf("got %d pending events", source.Pending.Total())
+	}
+}
@@ -2,21 +2,27 @@ package scalyr
 
 import (
 	"fmt"
+	"net/url"
 	"strings"
 
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/clients/diskqueue"
 	"github.com/kelseyhightower/envconfig"
 )
 
 type Config struct {
-	Server                       string            `envconfig:"SCALYR_SERVER"`                   // Scalyr target URL
-	Token                        string            `envconfig:"SCALYR_WRITELOG_TOKEN"`           // Scalyr token
-	KeysToMessageConversions     map[string]string `envconfig:"SCALYR_FIELDS_CONV_MESSAGE"`      // Logstash to scalyr events fields conversion
-	KeysToSessionInfoConversions map[string]string `envconfig:"SCALYR_FIELDS_CONV_SESSION"`      // Logstash to scalyr session fields conversion
-	RequestMaxNbEvents           int               `envconfig:"SCALYR_REQUEST_MAX_NB_EVENTS"`    // Scalyr max nb of events
-	RequestMaxSize               int               `envconfig:"SCALYR_REQUEST_MAX_REQUEST_SIZE"` // Scalyr max request size
-	RequestMinPeriod             int               `envconfig:"SCALYR_REQUEST_MIN_PERIOD"`       // Milliseconds between queries (mostly used for tests)
-	QueueSize                    int               `envconfig:"SCALYR_QUEUE_SIZE"`               // Maximum number of events to queue between logstash and scalyr
+	Server                       string              `envconfig:"SCALYR_SERVER" yaml:"server"`                               // Scalyr target URL
+	Token                        clients.Secret      `envconfig:"SCALYR_WRITELOG_TOKEN" yaml:"token"`                        // Scalyr token
+	KeysToMessageConversions     clients.Conversions `envconfig:"SCALYR_FIELDS_CONV_MESSAGE" yaml:"message_conversions"`     // Logstash to scalyr events fields conversion
+	KeysToSessionInfoConversions clients.Conversions `envconfig:"SCALYR_FIELDS_CONV_SESSION" yaml:"session_conversions"`     // Logstash to scalyr session fields conversion
+	RequestMaxNbEvents           int                 `envconfig:"SCALYR_REQUEST_MAX_NB_EVENTS" yaml:"request_max_nb_events"` // Scalyr max nb of events
+	RequestMaxSize               int                 `envconfig:"SCALYR_REQUEST_MAX_REQUEST_SIZE" yaml:"request_max_size"`   // Scalyr max request size
+	RequestMinPeriod             int                 `envconfig:"SCALYR_REQUEST_MIN_PERIOD" yaml:"request_min_period"`       // Milliseconds between queries (mostly used for tests)
+	QueueSize                    int                 `envconfig:"SCALYR_QUEUE_SIZE" yaml:"queue_size"`                       // Maximum number of events to queue between logstash and scalyr
+	OverflowPolicy               string              `envconfig:"SCALYR_OVERFLOW_POLICY" yaml:"overflow_policy"`             // What to do with the events which don't fit in the queue
 	scalyrEndpoint               string
+
+	diskqueue.Config `yaml:",inline"` // Disk queue, its settings are shared by all the outputs unless they're prefixed
 }
 
 func NewConfig() *Config {
@@ -26,27 +32,35 @@ func NewConfig() *Config {
 		RequestMaxSize:     2 * 1024 * 1024, // 2MB is much lower than the allowed 3MB
 		RequestMinPeriod:   0,
 		QueueSize:          1000,
+		OverflowPolicy:     clients.OverflowBlock,
+		Config:             diskqueue.NewConfig(),
 		// These are the attribute keys to convert within a message
-		KeysToMessageConversions: map[string]string{
+		KeysToMessageConversions: clients.Conversions{
 			"@source_host": "hostname",
 			"@source_path": "file_path",
 			"@message":     "message",
 			"@type":        "logstash_type",
 			"@source":      "logstash_source",
 			"@tags":        "tags",
+			// beats equivalents
+			"host.name":     "hostname",
+			"log.file.path": "file_path",
 		},
 		// These are the attribute keys to convert and move to the session
-		KeysToSessionInfoConversions: map[string]string{
+		KeysToSessionInfoConversions: clients.Conversions{
 			"appname": "serverHost",
 			"env":     "logfile",
 		},
 	}
 }
 
-func (c *Config) Load() error {
-	if err := envconfig.Process("", c); err != nil {
+func (c *Config) Load(prefix string) error {
+	if err := envconfig.Process(prefix, c); err != nil {
 		return fmt.Errorf("couldn't load config from env vars: %s", err)
 	}
+	if err := clients.LoadSecretFiles(prefix, c); err != nil {
+		return fmt.Errorf("couldn't load secrets: %s", err)
+	}
 	if err := c.check(); err != nil {
 		return fmt.Errorf("config check issue: %s", err)
 	}
@@ -60,9 +74,37 @@ func (c *Config) Enabled() bool {
 	return c.Token != ""
 }
 
+// SetReplay sets the config up for replaying the dead letters: the events are queued in memory (the disk queue belongs to
+// the server) and the overflow policy doesn't drop any of them
+func (c *Config) SetReplay() {
+	c.QueueDir = ""
+	c.OverflowPolicy = clients.OverflowBlock
+}
+
 func (c *Config) check() error {
 	if strings.HasSuffix(c.Server, "/") {
 		return fmt.Errorf("do not end the URL by a /")
 	}
-	return nil
+	if u, err := url.Parse(c.Server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("SCALYR_SERVER must be an http(s) URL: %s", c.Server)
+	}
+	if c.RequestMaxNbEvents <= 0 {
+		return fmt.Errorf("SCALYR_REQUEST_MAX_NB_EVENTS must be positive")
+	}
+	if c.RequestMaxSize <= 0 {
+		return fmt.Errorf("SCALYR_REQUEST_MAX_REQUEST_SIZE must be positive")
+	}
+	if c.RequestMinPeriod < 0 {
+		return fmt.Errorf("SCALYR_REQUEST_MIN_PERIOD can't be negative")
+	}
+	if c.QueueSize <= 0 {
+		return fmt.Errorf("SCALYR_QUEUE_SIZE must be positive")
+	}
+	if err := c.CheckQueue(); err != nil {
+		return err
+	}
+	if err := clients.CheckOverflowPolicy("SCALYR_OVERFLOW_POLICY", c.OverflowPolicy, c.QueueOnDisk()); err != nil {
+		return err
+	}
+	return clients.CheckConversions(c.KeysToMessageConversions, c.KeysToSessionInfoConversions)
 }
@@ -0,0 +1,70 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Secret is a credential. It's redacted when it's printed, logged or marshalled, its value is only available through
+// a conversion to string.
+type Secret string
+
+const redacted = "[REDACTED]"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// GoString redacts the secret for the %#v format
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalJSON redacts the secret in JSON, which is used when logging the config
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// LoadSecretFiles reads the secrets of a config struct from the files given by the <VAR>_FILE env vars (like the
+// docker and kubernetes secrets), for the secrets that weren't set by their env var. It's called after the struct was
+// loaded by envconfig with the same prefix, the prefixed variables override the unprefixed ones.
+func LoadSecretFiles(prefix string, spec interface{}) error {
+	value := reflect.ValueOf(spec).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		key := value.Type().Field(i).Tag.Get("envconfig")
+		if key == "" || field.Type() != reflect.TypeOf(Secret("")) {
+			continue
+		}
+
+		keys := []string{key}
+		if prefix != "" {
+			keys = []string{prefix + "_" + key, key}
+		}
+		for _, k := range keys {
+			path, hasFile := os.LookupEnv(k + "_FILE")
+			if _, ok := os.LookupEnv(k); ok {
+				if hasFile {
+					return fmt.Errorf("%s and %s_FILE can't both be set", k, k)
+				}
+				break
+			}
+			if hasFile {
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("couldn't read %s_FILE: %s", k, err)
+				}
+				field.SetString(strings.TrimRight(string(data), "\r\n"))
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretRedaction(t *testing.T) {
+	config := struct {
+		Token Secret
+		Empty Secret
+	}{Token: "s3cret"}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		if printed := fmt.Sprintf(format, config); strings.Contains(printed, "s3cret") {
+			t.Errorf("%s printed the secret: %s", format, printed)
+		}
+	}
+	if printed := fmt.Sprint(config.Token); printed != redacted {
+		t.Errorf("got %s", printed)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"Token":"[REDACTED]","Empty":""}` {
+		t.Errorf("got JSON %s", data)
+	}
+
+	// The value is only available through a conversion
+	if string(config.Token) != "s3cret" {
+		t.Errorf("got value %s", string(config.Token))
+	}
+}
+
+type secretSpec struct {
+	Token Secret `envconfig:"TOKEN"`
+	Key   Secret `envconfig:"KEY"`
+	Name  string `envconfig:"NAME"`
+}
+
+// writeSecret writes a secret file and returns its path
+func writeSecret(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	t.Run("trailing newline", func(t *testing.T) {
+		t.Setenv("TOKEN_FILE", writeSecret(t, "from-file\n"))
+		t.Setenv("KEY_FILE", writeSecret(t, "windows\r\n"))
+		t.Setenv("NAME_FILE", writeSecret(t, "ignored"))
+		spec := &secretSpec{Name: "name"}
+		if err := LoadSecretFiles("", spec); err != nil {
+			t.Fatal(err)
+		}
+		if spec.Token != "from-file" || spec.Key != "windows" || spec.Name != "name" {
+			t.Errorf("unexpected values %q, %q and %q", string(spec.Token), string(spec.Key), spec.Name)
+		}
+	})
+
+	t.Run("env var and file", func(t *testing.T) {
+		t.Setenv("TOKEN", "from-env")
+		t.Setenv("TOKEN_FILE", writeSecret(t, "from-file"))
+		err := LoadSecretFiles("", &secretSpec{Token: "from-env"})
+		if err == nil || !strings.Contains(err.Error(), "TOKEN and TOKEN_FILE can't both be set") {
+			t.Errorf("got error %v", err)
+		}
+	})
+
+	t.Run("prefixed", func(t *testing.T) {
+		// The prefixed variables override the unprefixed ones
+		t.Setenv("TOKEN_FILE", writeSecret(t, "shared"))
+		t.Setenv("OUT_TOKEN_FILE", writeSecret(t, "prefixed"))
+		t.Setenv("KEY_FILE", writeSecret(t, "shared key"))
+		t.Setenv("OUT_KEY", "prefixed key")
+		spec := &secretSpec{Key: "prefixed key"}
+		if err := LoadSecretFiles("OUT", spec); err != nil {
+			t.Fatal(err)
+		}
+		if spec.Token != "prefixed" || spec.Key != "prefixed key" {
+			t.Errorf("unexpected values %q and %q", string(spec.Token), string(spec.Key))
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		t.Setenv("TOKEN_FILE", filepath.Join(t.TempDir(), "missing"))
+		if err := LoadSecretFiles("", &secretSpec{}); err == nil || !strings.Contains(err.Error(), "TOKEN_FILE") {
+			t.Errorf("got error %v", err)
+		}
+	})
+}
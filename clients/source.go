@@ -0,0 +1,132 @@
+package clients
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RunID identifies the run of logfwd, the IDs of the clients are only unique within a run
+var RunID = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// Source describes the client which sent an event. The outputs are shared by all the clients, they keep it as metadata
+// of the event.
+type Source struct {
+	ID       int       // ID of the client on the server side
+	Addr     net.Addr  // Address of the client
+	Identity *Identity // Verified identity of the client (nil if it didn't present a certificate)
+	Tenant   *Tenant   // Tenant of the client (nil for the default one)
+	Pending  *Pending  // Events of the client the outputs haven't handled yet (nil for the restored sources)
+	Run      string    // Run of logfwd which received the events, set for the sources restored from a disk queue
+}
+
+// Key identifies the client among the ones of all the runs
+func (s *Source) Key() string {
+	if s.Run == "" || s.Run == RunID {
+		return strconv.Itoa(s.ID)
+	}
+	return s.Run + "-" + strconv.Itoa(s.ID)
+}
+
+// StoredSource is a source as it's stored with its events in a disk queue
+type StoredSource struct {
+	Run      string    `json:"run"`
+	ID       int       `json:"id"`
+	Addr     string    `json:"addr"`
+	Identity *Identity `json:"identity,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+}
+
+// Store returns the source as it's stored in a disk queue
+func (s *Source) Store() *StoredSource {
+	stored := &StoredSource{
+		Run:      s.Run,
+		ID:       s.ID,
+		Addr:     s.Addr.String(),
+		Identity: s.Identity,
+	}
+	if stored.Run == "" {
+		stored.Run = RunID
+	}
+	if s.Tenant != nil {
+		stored.Tenant = s.Tenant.Name
+	}
+	return stored
+}
+
+// Restore returns the source of events read from a disk queue or from the dead letters. Its tenant is the current one
+// with the same name, the tokens aren't stored with the events.
+func (s *StoredSource) Restore() (*Source, error) {
+	source := &Source{
+		ID:       s.ID,
+		Addr:     StoredAddr(s.Addr),
+		Identity: s.Identity,
+		Run:      s.Run,
+	}
+	if s.Tenant != "" {
+		tenant, err := LookupTenant(s.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		source.Tenant = tenant
+	}
+	return source, nil
+}
+
+// StoredAddr is the address of a client restored from a disk queue
+type StoredAddr string
+
+// Network returns the name of the network, which isn't stored
+func (a StoredAddr) Network() string {
+	return "stored"
+}
+
+func (a StoredAddr) String() string {
+	return string(a)
+}
+
+// Pending counts the events of a client which the outputs haven't handled (sent or dropped) yet, by output instance
+type Pending struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+// NewPending creates an empty counter
+func NewPending() *Pending {
+	return &Pending{counts: make(map[string]int)}
+}
+
+// Add adds events to the count of an output instance, they're removed with a negative number once handled
+func (p *Pending) Add(output string, nb int) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.counts[output] += nb; p.counts[output] == 0 {
+		delete(p.counts, output)
+	}
+}
+
+// Counts returns the number of events by output instance
+func (p *Pending) Counts() map[string]int {
+	p.Lock()
+	defer p.Unlock()
+	counts := make(map[string]int, len(p.counts))
+	for output, nb := range p.counts {
+		counts[output] = nb
+	}
+	return counts
+}
+
+// Total returns the number of events of all the output instances
+func (p *Pending) Total() int {
+	p.Lock()
+	defer p.Unlock()
+	total := 0
+	for _, nb := range p.counts {
+		total += nb
+	}
+	return total
+}
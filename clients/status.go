@@ -0,0 +1,59 @@
+package clients
+
+import (
+	"sync"
+	"time"
+)
+
+// OutputStatus is the delivery status of an output instance, reported by its clients
+type OutputStatus struct {
+	LastSuccess  time.Time // Last time events were delivered
+	LastFailure  time.Time // Last time events couldn't be delivered
+	FailingSince time.Time // First failure since the last success, zero if the last attempt succeeded
+	LastError    string    // Error of the last failure
+}
+
+var (
+	statusLock     sync.Mutex
+	outputStatuses = make(map[string]*OutputStatus)
+)
+
+func outputStatus(output string) *OutputStatus {
+	status, ok := outputStatuses[output]
+	if !ok {
+		status = &OutputStatus{}
+		outputStatuses[output] = status
+	}
+	return status
+}
+
+// ReportSuccess records that an output instance delivered events
+func ReportSuccess(output string) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	status := outputStatus(output)
+	status.LastSuccess = time.Now()
+	status.FailingSince = time.Time{}
+}
+
+// ReportFailure records that an output instance couldn't deliver events
+func ReportFailure(output string, err error) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	status := outputStatus(output)
+	status.LastFailure = time.Now()
+	status.LastError = err.Error()
+	if status.FailingSince.IsZero() {
+		status.FailingSince = status.LastFailure
+	}
+}
+
+// Status returns the status of an output instance, it's empty until its clients tried to deliver events
+func Status(output string) OutputStatus {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+	if status, ok := outputStatuses[output]; ok {
+		return *status
+	}
+	return OutputStatus{}
+}
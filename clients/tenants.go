@@ -0,0 +1,34 @@
+package clients
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	tenantsLock sync.RWMutex
+	tenants     map[string]*Tenant // By name
+)
+
+// SetTenants sets the tenants of the events restored from a disk queue or from the dead letters, which are only
+// stored with the name of their tenant. They're replaced by the reloads.
+func SetTenants(list []*Tenant) {
+	byName := make(map[string]*Tenant, len(list))
+	for _, tenant := range list {
+		byName[tenant.Name] = tenant
+	}
+	tenantsLock.Lock()
+	defer tenantsLock.Unlock()
+	tenants = byName
+}
+
+// LookupTenant returns a tenant by name, an error is returned if it doesn't exist (anymore)
+func LookupTenant(name string) (*Tenant, error) {
+	tenantsLock.RLock()
+	defer tenantsLock.RUnlock()
+	tenant, ok := tenants[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown tenant %s", name)
+	}
+	return tenant, nil
+}
@@ -1,8 +1,8 @@
 package clients
 
 import (
+	"fmt"
 	"io"
-	"net"
 	"time"
 
 	"go.uber.org/zap"
@@ -39,26 +39,67 @@ type LogEvent struct {
 	Timestamp  time.Time              // Timestamp of the event
 	Attributes map[string]interface{} // Attributes of the event
 	Severity   Level                  // Severity of logging
+	Tenant     *Tenant                // Tenant which sent the event (nil for the default one)
+	Source     *Source                // Client which sent the event
 }
 
-// OutputClient is the interface an output client needs
+// OutputClient is the interface an output client needs. An output client is shared by all the clients, it's replaced
+// when the config is reloaded.
 type OutputClient interface {
 	io.Closer
-	Send(event *LogEvent)
+	Send(event *LogEvent) // Mustn't be called once the client is closed
 	Name() string
+	Done() <-chan struct{}     // Closed once the events sent before closing have been handled
+	Pending() int              // Number of events that haven't been handled yet
+	QueueLength() int          // Number of events waiting in the queue
+	QueueUsage() int           // Usage of the queue, in percent
+	Replay(event []byte) error // Sends again an event written to the dead letters by an output of the same type
 }
 
-// ClientHandler describes the inbound connection
-type ClientHandler interface {
-	ID() int                    // ID of the connection on the server side
-	Addr() net.Addr             // Address of the remote connection
-	Logger() *zap.SugaredLogger // Logger used for this client
+// Identity is the verified identity of a client presenting a certificate
+type Identity struct {
+	CommonName string   // Subject common name
+	SANs       []string // Subject alternative names (DNS names, emails, IPs and URIs)
+}
+
+// Tenant is a team sharing the instance, whose events are sent to its own accounts
+type Tenant struct {
+	Name         string                 // Name of the tenant
+	OutputTokens map[string]string      // Token of each output client (by name), the default one is used if missing
+	Attributes   map[string]interface{} // Attributes added to the events which don't have them
+}
+
+// OutputToken returns the token to use for an output client
+func (t *Tenant) OutputToken(output, defaultToken string) string {
+	if t != nil {
+		if token, ok := t.OutputTokens[output]; ok {
+			return token
+		}
+	}
+	return defaultToken
+}
+
+// PeerAddr is the address of a client connected through a unix socket, identified by its credentials
+type PeerAddr struct {
+	PID int // Process ID
+	UID int // User ID
+	GID int // Group ID
+}
+
+// Network returns the name of the network
+func (a *PeerAddr) Network() string {
+	return "unix"
+}
+
+func (a *PeerAddr) String() string {
+	return fmt.Sprintf("pid=%d,uid=%d,gid=%d", a.PID, a.UID, a.GID)
 }
 
 // Config describes a generic minimal requirement for the output clients
 type Config interface {
-	Load() error   // Loads the config
-	Enabled() bool // Defines if the output client should be enabled
+	Load(prefix string) error // Loads the config, from the env vars prefixed by the name of the instance if set
+	Enabled() bool            // Defines if the output client should be enabled
+	SetReplay()               // Sets the config up for replaying the dead letters (memory queue, no event dropped)
 }
 
 // OutputClientDefinition defines the client in a modular architecture
@@ -69,6 +110,6 @@ type OutputClientDefinition interface {
 	// Config instanciation
 	Config() Config
 
-	// Factory method
-	Create(ch ClientHandler, config Config) OutputClient
+	// Factory method, name is the name of the instance
+	Create(name string, config Config, log *zap.SugaredLogger) (OutputClient, error)
 }
@@ -2,65 +2,323 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/habx/service-logfwd/clients"
 	"github.com/habx/service-logfwd/clients/list"
+	"github.com/habx/service-logfwd/inputs/proxyproto"
 	"github.com/kelseyhightower/envconfig"
 )
 
 // Config is the main config
 type Config struct {
-	ListenAddr              string `envconfig:"LISTEN_ADDR"`                // Listening address
-	LogEnv                  string `envconfig:"LOG_ENV"`                    // Logging environment: dev or prod
-	LogstashMaxEventSize    int    `envconfig:"LOGSTASH_EVENT_MAX_SIZE"`    // Maximum size accepted for reading data in logstash
-	LogstashAuthPrefixToken string `envconfig:"LOGSTASH_AUTH_PREFIX_TOKEN"` // Logstash prefix auth token (logmatic format)
-	LogstashAuthKey         string `envconfig:"LOGSTASH_AUTH_KEY"`          // Logstash authentication key
-	LogstashAuthValue       string `envconfig:"LOGSTASH_AUTH_VALUE"`        // Logstash authentication value
-	OutputClientConfigs     map[string]clients.Config
+	ListenAddr              string         `envconfig:"LISTEN_ADDR"`                // Listening address
+	TLSListenAddr           string         `envconfig:"TLS_LISTEN_ADDR"`            // TLS listening address
+	TLSCertFile             string         `envconfig:"TLS_CERT_FILE"`              // TLS certificate file (PEM)
+	TLSKeyFile              string         `envconfig:"TLS_KEY_FILE"`               // TLS private key file (PEM)
+	TLSCAFile               string         `envconfig:"TLS_CA_FILE"`                // CA used to verify client certificates (PEM)
+	TLSReloadPeriod         time.Duration  `envconfig:"TLS_RELOAD_PERIOD"`          // Period between checks of the TLS files
+	TLSClientAuth           string         `envconfig:"TLS_CLIENT_AUTH"`            // Client certificate policy: none, optional or require
+	UDPListenAddr           string         `envconfig:"UDP_LISTEN_ADDR"`            // UDP listening address
+	HTTPListenAddr          string         `envconfig:"HTTP_LISTEN_ADDR"`           // HTTP listening address
+	HTTPMaxBodySize         int64          `envconfig:"HTTP_MAX_BODY_SIZE"`         // Maximum size of an HTTP request body
+	LumberjackListenAddr    string         `envconfig:"LUMBERJACK_LISTEN_ADDR"`     // Lumberjack (beats) listening address
+	LumberjackTLS           bool           `envconfig:"LUMBERJACK_TLS"`             // Use TLS on the lumberjack listener
+	LumberjackMaxWindowSize int            `envconfig:"LUMBERJACK_MAX_WINDOW_SIZE"` // Maximum number of events of a lumberjack window
+	LumberjackMaxBatchSize  int            `envconfig:"LUMBERJACK_MAX_BATCH_SIZE"`  // Maximum size of the frames of a lumberjack window
+	SyslogListenAddr        string         `envconfig:"SYSLOG_LISTEN_ADDR"`         // Syslog (TCP and UDP) listening address
+	GELFListenAddr          string         `envconfig:"GELF_LISTEN_ADDR"`           // GELF (TCP and UDP) listening address
+	FluentListenAddr        string         `envconfig:"FLUENT_LISTEN_ADDR"`         // Fluentd forward listening address
+	FluentTLS               bool           `envconfig:"FLUENT_TLS"`                 // Use TLS on the fluentd forward listener
+	FluentSharedKey         clients.Secret `envconfig:"FLUENT_SHARED_KEY"`          // Fluentd forward shared key
+	FluentSelfHostname      string         `envconfig:"FLUENT_SELF_HOSTNAME"`       // Hostname sent during the fluentd handshake
+	FluentMaxMessageSize    int            `envconfig:"FLUENT_MAX_MESSAGE_SIZE"`    // Maximum size of a fluentd forward message
+	ProxyProtocol           bool           `envconfig:"PROXY_PROTOCOL"`             // Read the PROXY protocol header of the TCP connections
+	ProxyTrustedCIDRs       []string       `envconfig:"PROXY_TRUSTED_CIDRS"`        // Upstreams allowed to send a PROXY protocol header
+	UnixListenPath          string         `envconfig:"UNIX_LISTEN_PATH"`           // Unix stream socket path
+	UnixDgramListenPath     string         `envconfig:"UNIX_DGRAM_LISTEN_PATH"`     // Unix datagram socket path
+	UnixSocketMode          string         `envconfig:"UNIX_SOCKET_MODE"`           // Permissions of the unix sockets (octal)
+	UnixSocketOwner         string         `envconfig:"UNIX_SOCKET_OWNER"`          // Owner (name or uid) of the unix sockets
+	UnixSocketGroup         string         `envconfig:"UNIX_SOCKET_GROUP"`          // Group (name or gid) of the unix sockets
+	SessionKey              string         `envconfig:"SESSION_KEY"`                // Attribute grouping connectionless events into sessions
+	SessionIdleTimeout      time.Duration  `envconfig:"SESSION_IDLE_TIMEOUT"`       // Time after which an idle connectionless session ends
+	ShutdownDrainTimeout    time.Duration  `envconfig:"SHUTDOWN_DRAIN_TIMEOUT"`     // Time given to the outputs to send their events when stopping
+	MalformedLinePolicy     string         `envconfig:"MALFORMED_LINE_POLICY"`      // Handling of invalid lines: wrap, deadletter, drop or disconnect
+	DeadLetterFile          string         `envconfig:"DEADLETTER_FILE"`            // File receiving the lines that couldn't be handled
+	OutputDeadLetterFile    string         `envconfig:"OUTPUT_DEADLETTER_FILE"`     // File receiving the events the outputs couldn't send
+	DeadLetterMaxSize       int64          `envconfig:"DEADLETTER_MAX_SIZE"`        // Size from which the dead letter files are rotated
+	DeadLetterMaxFiles      int            `envconfig:"DEADLETTER_MAX_FILES"`       // Number of rotated dead letter files kept
+	LogEnv                  string         `envconfig:"LOG_ENV"`                    // Logging environment: dev or prod
+	LogstashMaxEventSize    int            `envconfig:"LOGSTASH_EVENT_MAX_SIZE"`    // Maximum size accepted for reading data in logstash
+	OversizedEventPolicy    string         `envconfig:"OVERSIZED_EVENT_POLICY"`     // Handling of lines bigger than the max size: truncate or discard
+	LogstashAuthPrefixToken clients.Secret `envconfig:"LOGSTASH_AUTH_PREFIX_TOKEN"` // Logstash prefix auth token (logmatic format)
+	LogstashAuthKey         string         `envconfig:"LOGSTASH_AUTH_KEY"`          // Logstash authentication key
+	LogstashAuthValue       clients.Secret `envconfig:"LOGSTASH_AUTH_VALUE"`        // Logstash authentication value
+	TenantsFile             string         `envconfig:"TENANTS_FILE"`               // File defining the tenants and their tokens
+	ConfigFile              string         `envconfig:"CONFIG_FILE"`                // YAML file defining the settings which aren't in the env vars
+	AdminListenAddr         string         `envconfig:"ADMIN_LISTEN_ADDR"`          // Admin API listening address
+	HealthListenAddr        string         `envconfig:"HEALTH_LISTEN_ADDR"`         // Health endpoints listening address
+	ReadyQueueWatermark     int            `envconfig:"READY_QUEUE_WATERMARK"`      // Queue usage (percent) above which we're not ready
+	ReadyFailurePeriod      time.Duration  `envconfig:"READY_FAILURE_PERIOD"`       // Time an output can fail before we're not ready
+
+	// Output instances
+	Outputs                 []string                                  `envconfig:"OUTPUTS"` // Names of the output instances
+	OutputClientConfigs     map[string]clients.Config                 // Config of each output instance, by name
+	OutputClientDefinitions map[string]clients.OutputClientDefinition // Type of each output instance, by name
 }
 
 func NewConfig() *Config {
 	return &Config{
-		ListenAddr:           ":5050",
-		LogstashMaxEventSize: 300 * 1024, // 300KB
-		LogEnv:               "prod",
-		OutputClientConfigs:  make(map[string]clients.Config),
+		ListenAddr:              ":5050",
+		LogstashMaxEventSize:    300 * 1024, // 300KB
+		LogEnv:                  "prod",
+		TLSReloadPeriod:         10 * time.Second,
+		TLSClientAuth:           "optional",
+		HTTPMaxBodySize:         10 * 1024 * 1024, // 10MB
+		LumberjackMaxWindowSize: 10000,
+		LumberjackMaxBatchSize:  64 * 1024 * 1024, // 64MB
+		FluentSelfHostname:      hostname(),
+		FluentMaxMessageSize:    8 * 1024 * 1024, // 8MB
+		UnixSocketMode:          "0660",
+		SessionKey:              "appname",
+		SessionIdleTimeout:      time.Minute,
+		ShutdownDrainTimeout:    25 * time.Second,
+		MalformedLinePolicy:     "wrap",
+		DeadLetterMaxSize:       100 * 1024 * 1024, // 100MB
+		DeadLetterMaxFiles:      5,
+		OversizedEventPolicy:    "truncate",
+		ReadyQueueWatermark:     90,
+		ReadyFailurePeriod:      30 * time.Second,
+
+		OutputClientConfigs:     make(map[string]clients.Config),
+		OutputClientDefinitions: make(map[string]clients.OutputClientDefinition),
 	}
 }
 
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "logfwd"
+	}
+	return name
+}
+
 func (c *Config) Load() error {
 	/*
 		if err := c.Scalyr.Load(); err != nil {
 			return fmt.Errorf("couldn't load scalyr config: %s", err)
 		}
 	*/
+	// The file is read first, so that the env vars override it
+	var fileOutputs map[string]*outputSection
+	path := c.ConfigFile // Set by check-config, before CONFIG_FILE
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path != "" {
+		outputs, err := c.loadConfigFile(path)
+		if err != nil {
+			return fmt.Errorf("couldn't load config file %s: %s", path, err)
+		}
+		fileOutputs = outputs
+	}
+
 	if err := envconfig.Process("", c); err != nil {
 		return fmt.Errorf("couldn't load config from env vars: %s", err)
 	}
+	c.ConfigFile = path
+	if err := clients.LoadSecretFiles("", c); err != nil {
+		return fmt.Errorf("couldn't load secrets: %s", err)
+	}
 	if err := c.check(); err != nil {
 		return fmt.Errorf("config check issue: %s", err)
 	}
 
-	{
-		anOutputWasEnabled := false
+	return c.loadOutputs(fileOutputs)
+}
+
+func (c *Config) check() error {
+	for name, addr := range map[string]string{
+		"LISTEN_ADDR":            c.ListenAddr,
+		"TLS_LISTEN_ADDR":        c.TLSListenAddr,
+		"UDP_LISTEN_ADDR":        c.UDPListenAddr,
+		"HTTP_LISTEN_ADDR":       c.HTTPListenAddr,
+		"LUMBERJACK_LISTEN_ADDR": c.LumberjackListenAddr,
+		"SYSLOG_LISTEN_ADDR":     c.SyslogListenAddr,
+		"GELF_LISTEN_ADDR":       c.GELFListenAddr,
+		"FLUENT_LISTEN_ADDR":     c.FluentListenAddr,
+		"ADMIN_LISTEN_ADDR":      c.AdminListenAddr,
+		"HEALTH_LISTEN_ADDR":     c.HealthListenAddr,
+	} {
+		if err := checkListenAddr(addr); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+	for name, size := range map[string]int64{
+		"LOGSTASH_EVENT_MAX_SIZE":    int64(c.LogstashMaxEventSize),
+		"HTTP_MAX_BODY_SIZE":         c.HTTPMaxBodySize,
+		"FLUENT_MAX_MESSAGE_SIZE":    int64(c.FluentMaxMessageSize),
+		"LUMBERJACK_MAX_WINDOW_SIZE": int64(c.LumberjackMaxWindowSize),
+		"LUMBERJACK_MAX_BATCH_SIZE":  int64(c.LumberjackMaxBatchSize),
+	} {
+		if size <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if c.LogEnv != "prod" && c.LogEnv != "dev" {
+		return fmt.Errorf("unknown LOG_ENV value %s", c.LogEnv)
+	}
+	if c.SessionKey == "" {
+		return fmt.Errorf("SESSION_KEY can't be empty")
+	}
+	if c.TLSReloadPeriod <= 0 {
+		return fmt.Errorf("TLS_RELOAD_PERIOD must be positive")
+	}
+	if (c.TLSListenAddr != "" || c.LumberjackTLS || c.FluentTLS) && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE are required to listen with TLS")
+	}
+	if c.SessionIdleTimeout <= 0 {
+		return fmt.Errorf("SESSION_IDLE_TIMEOUT must be positive")
+	}
+	if c.ShutdownDrainTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_DRAIN_TIMEOUT must be positive")
+	}
+	if c.ReadyQueueWatermark <= 0 || c.ReadyQueueWatermark > 100 {
+		return fmt.Errorf("READY_QUEUE_WATERMARK must be between 1 and 100")
+	}
+	if c.ReadyFailurePeriod < 0 {
+		return fmt.Errorf("READY_FAILURE_PERIOD can't be negative")
+	}
+	if _, err := strconv.ParseUint(c.UnixSocketMode, 8, 32); err != nil {
+		return fmt.Errorf("UNIX_SOCKET_MODE must be an octal mode: %s", err)
+	}
+	if c.ProxyProtocol {
+		if len(c.ProxyTrustedCIDRs) == 0 {
+			return fmt.Errorf("PROXY_TRUSTED_CIDRS is required to enable the PROXY protocol")
+		}
+		if _, err := proxyproto.ParseCIDRs(c.ProxyTrustedCIDRs); err != nil {
+			return fmt.Errorf("invalid PROXY_TRUSTED_CIDRS: %s", err)
+		}
+	}
+	switch c.MalformedLinePolicy {
+	case "wrap", "drop", "disconnect":
+	case "deadletter":
+		if c.DeadLetterFile == "" {
+			return fmt.Errorf("DEADLETTER_FILE is required by the deadletter policy")
+		}
+	default:
+		return fmt.Errorf("unknown MALFORMED_LINE_POLICY value %s", c.MalformedLinePolicy)
+	}
+	if c.DeadLetterMaxSize <= 0 {
+		return fmt.Errorf("DEADLETTER_MAX_SIZE must be positive")
+	}
+	if c.DeadLetterMaxFiles < 0 {
+		return fmt.Errorf("DEADLETTER_MAX_FILES can't be negative")
+	}
+	if c.OversizedEventPolicy != "truncate" && c.OversizedEventPolicy != "discard" {
+		return fmt.Errorf("unknown OVERSIZED_EVENT_POLICY value %s", c.OversizedEventPolicy)
+	}
+	switch c.TLSClientAuth {
+	case "none", "optional":
+	case "require":
+		if (c.TLSListenAddr != "" || c.LumberjackTLS || c.FluentTLS) && c.TLSCAFile == "" {
+			return fmt.Errorf("TLS_CA_FILE is required to require client certificates")
+		}
+	default:
+		return fmt.Errorf("unknown TLS_CLIENT_AUTH value %s", c.TLSClientAuth)
+	}
+	return nil
+}
+
+// outputInstanceName validates the names of the output instances, which are used as env var prefixes
+var outputInstanceName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// loadOutputs loads the config of the output instances, from the config file and the env vars. Without OUTPUTS (or
+// outputs in the config file), there's one instance of each type, named after it and configured without prefix.
+func (c *Config) loadOutputs(fileOutputs map[string]*outputSection) error {
+	if len(c.Outputs) == 0 {
+		for _, def := range list.LIST {
+			c.Outputs = append(c.Outputs, def.Name())
+			if err := c.loadOutput(def.Name(), def, "", nil); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, name := range c.Outputs {
+			if !outputInstanceName.MatchString(name) {
+				return fmt.Errorf("invalid output name %s", name)
+			}
+			if _, ok := c.OutputClientConfigs[name]; ok {
+				return fmt.Errorf("output %s is declared twice", name)
+			}
+
+			// The type defaults to the name of the instance, so that "OUTPUTS=scalyr" works
+			prefix := strings.ToUpper(name)
+			section := fileOutputs[name]
+			typeName, ok := os.LookupEnv(prefix + "_TYPE")
+			if !ok {
+				typeName = name
+				if section != nil && section.Type != "" {
+					typeName = section.Type
+				}
+			}
+			def := list.Find(typeName)
+			if def == nil {
+				return fmt.Errorf("unknown type %s for output %s (%s_TYPE)", typeName, name, prefix)
+			}
 
-		for _, oc := range list.LIST {
-			conf := oc.Config()
-			if err := conf.Load(); err != nil {
-				return fmt.Errorf("couldn't load output client of %s: %s", oc.Name(), err)
+			if err := c.loadOutput(name, def, prefix, section); err != nil {
+				return err
 			}
-			anOutputWasEnabled = anOutputWasEnabled || conf.Enabled()
-			c.OutputClientConfigs[oc.Name()] = conf
 		}
+	}
 
-		if !anOutputWasEnabled {
-			return fmt.Errorf("at least one output client should be enabled")
+	for _, conf := range c.OutputClientConfigs {
+		if conf.Enabled() {
+			return nil
 		}
 	}
+	return fmt.Errorf("at least one output client should be enabled")
+}
 
+// loadOutput loads the config of an output instance, the env vars override the settings of its section of the config
+// file (if there's one)
+func (c *Config) loadOutput(
+	name string,
+	def clients.OutputClientDefinition,
+	prefix string,
+	section *outputSection,
+) error {
+	conf := def.Config()
+	if section != nil {
+		if err := section.decode(conf); err != nil {
+			return fmt.Errorf("invalid settings of output %s in the config file: %s", name, err)
+		}
+	}
+	if err := conf.Load(prefix); err != nil {
+		return fmt.Errorf("couldn't load output client of %s: %s", name, err)
+	}
+	c.OutputClientConfigs[name] = conf
+	c.OutputClientDefinitions[name] = def
 	return nil
 }
 
-func (c *Config) check() error {
+// checkListenAddr checks a host:port address, the host being optional
+func checkListenAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || (n == 0 && port != "0") {
+		return fmt.Errorf("invalid port %s", port)
+	}
 	return nil
 }
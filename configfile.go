@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is the structure of the YAML config file. Its settings point to the fields of the config they set, so
+// that the ones missing from the file keep their default value. The env vars are read afterwards and override them.
+type configFile struct {
+	Listeners            listenersSection     `yaml:"listeners"`
+	TLS                  tlsSection           `yaml:"tls"`
+	ProxyProtocol        proxyProtocolSection `yaml:"proxy_protocol"`
+	UnixSockets          unixSocketsSection   `yaml:"unix_sockets"`
+	Auth                 authSection          `yaml:"auth"`
+	Inputs               inputsSection        `yaml:"inputs"`
+	DeadLetters          deadLettersSection   `yaml:"dead_letters"`
+	Health               healthSection        `yaml:"health"`
+	ShutdownDrainTimeout *time.Duration       `yaml:"shutdown_drain_timeout"`
+	LogEnv               *string              `yaml:"log_env"`
+	Outputs              []*outputSection     `yaml:"outputs"`
+}
+
+// listenersSection are the addresses and paths of the listeners
+type listenersSection struct {
+	TCP        *string `yaml:"tcp"`
+	TLS        *string `yaml:"tls"`
+	UDP        *string `yaml:"udp"`
+	HTTP       *string `yaml:"http"`
+	Lumberjack *string `yaml:"lumberjack"`
+	Syslog     *string `yaml:"syslog"`
+	GELF       *string `yaml:"gelf"`
+	Fluent     *string `yaml:"fluent"`
+	Unix       *string `yaml:"unix"`
+	UnixDgram  *string `yaml:"unix_dgram"`
+	Admin      *string `yaml:"admin"`
+	Health     *string `yaml:"health"`
+}
+
+// tlsSection are the TLS settings of the listeners
+type tlsSection struct {
+	CertFile     *string        `yaml:"cert_file"`
+	KeyFile      *string        `yaml:"key_file"`
+	CAFile       *string        `yaml:"ca_file"`
+	ClientAuth   *string        `yaml:"client_auth"`
+	ReloadPeriod *time.Duration `yaml:"reload_period"`
+	Lumberjack   *bool          `yaml:"lumberjack"`
+	Fluent       *bool          `yaml:"fluent"`
+}
+
+// proxyProtocolSection are the PROXY protocol settings
+type proxyProtocolSection struct {
+	Enabled      *bool     `yaml:"enabled"`
+	TrustedCIDRs *[]string `yaml:"trusted_cidrs"`
+}
+
+// unixSocketsSection are the settings of the unix sockets
+type unixSocketsSection struct {
+	Mode  *string `yaml:"mode"`
+	Owner *string `yaml:"owner"`
+	Group *string `yaml:"group"`
+}
+
+// authSection are the auth of the clients
+type authSection struct {
+	LogstashPrefixToken *clients.Secret `yaml:"logstash_prefix_token"`
+	LogstashKey         *string         `yaml:"logstash_key"`
+	LogstashValue       *clients.Secret `yaml:"logstash_value"`
+	FluentSharedKey     *clients.Secret `yaml:"fluent_shared_key"`
+	TenantsFile         *string         `yaml:"tenants_file"`
+}
+
+// inputsSection are the limits and policies of the inputs
+type inputsSection struct {
+	LogstashEventMaxSize    *int           `yaml:"logstash_event_max_size"`
+	OversizedEventPolicy    *string        `yaml:"oversized_event_policy"`
+	MalformedLinePolicy     *string        `yaml:"malformed_line_policy"`
+	HTTPMaxBodySize         *int64         `yaml:"http_max_body_size"`
+	LumberjackMaxWindowSize *int           `yaml:"lumberjack_max_window_size"`
+	LumberjackMaxBatchSize  *int           `yaml:"lumberjack_max_batch_size"`
+	FluentSelfHostname      *string        `yaml:"fluent_self_hostname"`
+	FluentMaxMessageSize    *int           `yaml:"fluent_max_message_size"`
+	SessionKey              *string        `yaml:"session_key"`
+	SessionIdleTimeout      *time.Duration `yaml:"session_idle_timeout"`
+}
+
+// deadLettersSection are the dead letter files
+type deadLettersSection struct {
+	File       *string `yaml:"file"`
+	OutputFile *string `yaml:"output_file"`
+	MaxSize    *int64  `yaml:"max_size"`
+	MaxFiles   *int    `yaml:"max_files"`
+}
+
+// healthSection are the readiness settings
+type healthSection struct {
+	ReadyQueueWatermark *int           `yaml:"ready_queue_watermark"`
+	ReadyFailurePeriod  *time.Duration `yaml:"ready_failure_period"`
+}
+
+// outputSection is an output instance of the config file
+type outputSection struct {
+	Name     string                 `yaml:"name"`
+	Type     string                 `yaml:"type"` // Defaults to the name of the instance, like <NAME>_TYPE
+	Settings map[string]interface{} `yaml:",inline"`
+}
+
+// newConfigFile returns a config file structure whose settings point to the fields of a config
+func newConfigFile(c *Config) *configFile {
+	f := &configFile{}
+
+	f.Listeners.TCP = &c.ListenAddr
+	f.Listeners.TLS = &c.TLSListenAddr
+	f.Listeners.UDP = &c.UDPListenAddr
+	f.Listeners.HTTP = &c.HTTPListenAddr
+	f.Listeners.Lumberjack = &c.LumberjackListenAddr
+	f.Listeners.Syslog = &c.SyslogListenAddr
+	f.Listeners.GELF = &c.GELFListenAddr
+	f.Listeners.Fluent = &c.FluentListenAddr
+	f.Listeners.Unix = &c.UnixListenPath
+	f.Listeners.UnixDgram = &c.UnixDgramListenPath
+	f.Listeners.Admin = &c.AdminListenAddr
+	f.Listeners.Health = &c.HealthListenAddr
+
+	f.TLS.CertFile = &c.TLSCertFile
+	f.TLS.KeyFile = &c.TLSKeyFile
+	f.TLS.CAFile = &c.TLSCAFile
+	f.TLS.ClientAuth = &c.TLSClientAuth
+	f.TLS.ReloadPeriod = &c.TLSReloadPeriod
+	f.TLS.Lumberjack = &c.LumberjackTLS
+	f.TLS.Fluent = &c.FluentTLS
+
+	f.ProxyProtocol.Enabled = &c.ProxyProtocol
+	f.ProxyProtocol.TrustedCIDRs = &c.ProxyTrustedCIDRs
+
+	f.UnixSockets.Mode = &c.UnixSocketMode
+	f.UnixSockets.Owner = &c.UnixSocketOwner
+	f.UnixSockets.Group = &c.UnixSocketGroup
+
+	f.Auth.LogstashPrefixToken = &c.LogstashAuthPrefixToken
+	f.Auth.LogstashKey = &c.LogstashAuthKey
+	f.Auth.LogstashValue = &c.LogstashAuthValue
+	f.Auth.FluentSharedKey = &c.FluentSharedKey
+	f.Auth.TenantsFile = &c.TenantsFile
+
+	f.Inputs.LogstashEventMaxSize = &c.LogstashMaxEventSize
+	f.Inputs.OversizedEventPolicy = &c.OversizedEventPolicy
+	f.Inputs.MalformedLinePolicy = &c.MalformedLinePolicy
+	f.Inputs.HTTPMaxBodySize = &c.HTTPMaxBodySize
+	f.Inputs.LumberjackMaxWindowSize = &c.LumberjackMaxWindowSize
+	f.Inputs.LumberjackMaxBatchSize = &c.LumberjackMaxBatchSize
+	f.Inputs.FluentSelfHostname = &c.FluentSelfHostname
+	f.Inputs.FluentMaxMessageSize = &c.FluentMaxMessageSize
+	f.Inputs.SessionKey = &c.SessionKey
+	f.Inputs.SessionIdleTimeout = &c.SessionIdleTimeout
+
+	f.DeadLetters.File = &c.DeadLetterFile
+	f.DeadLetters.OutputFile = &c.OutputDeadLetterFile
+	f.DeadLetters.MaxSize = &c.DeadLetterMaxSize
+	f.DeadLetters.MaxFiles = &c.DeadLetterMaxFiles
+
+	f.Health.ReadyQueueWatermark = &c.ReadyQueueWatermark
+	f.Health.ReadyFailurePeriod = &c.ReadyFailurePeriod
+
+	f.ShutdownDrainTimeout = &c.ShutdownDrainTimeout
+	f.LogEnv = &c.LogEnv
+	return f
+}
+
+// loadConfigFile reads a YAML config file into a config, it returns its output instances by name. The unknown keys
+// are rejected, as they're likely typos.
+func (c *Config) loadConfigFile(path string) (map[string]*outputSection, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newConfigFile(c)
+	if err := yaml.UnmarshalStrict(data, f); err != nil {
+		return nil, fmt.Errorf("invalid config file: %s", err)
+	}
+
+	outputs := make(map[string]*outputSection, len(f.Outputs))
+	for _, output := range f.Outputs {
+		if output == nil || output.Name == "" {
+			return nil, fmt.Errorf("the outputs of the config file need a name")
+		}
+		if _, ok := outputs[output.Name]; ok {
+			return nil, fmt.Errorf("output %s is defined twice in the config file", output.Name)
+		}
+		outputs[output.Name] = output
+		c.Outputs = append(c.Outputs, output.Name)
+	}
+	return outputs, nil
+}
+
+// decode sets the settings of the output instance in the config of its type
+func (s *outputSection) decode(conf clients.Config) error {
+	if len(s.Settings) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(s.Settings)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, conf)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/clients/datadog"
+	"github.com/habx/service-logfwd/clients/scalyr"
+)
+
+// writeConfigFile writes a config file and points CONFIG_FILE to it
+func writeConfigFile(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "logfwd.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestConfigFileSettings(t *testing.T) {
+	// Each setting of the file points to a field of the config, the ones that don't would be ignored
+	var check func(prefix string, v reflect.Value)
+	check = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field, name := v.Field(i), prefix+v.Type().Field(i).Tag.Get("yaml")
+			switch field.Kind() {
+			case reflect.Struct:
+				check(name+".", field)
+			case reflect.Ptr:
+				if field.IsNil() {
+					t.Errorf("%s isn't set", name)
+				}
+			}
+		}
+	}
+	check("", reflect.ValueOf(newConfigFile(NewConfig())).Elem())
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	writeConfigFile(t, `
+listeners:
+  tcp: ":6000"
+  http: ":8080"
+tls:
+  reload_period: 1m
+auth:
+  logstash_prefix_token: file-token
+inputs:
+  session_idle_timeout: 2m
+outputs:
+  - name: dd_eu
+    type: datadog
+    token: dd-token
+    server: eu.example.com:443
+    tags_conversions:
+      team: team
+  - name: scalyr
+    token: scalyr-token
+    queue_size: 10
+`)
+	t.Setenv("LISTEN_ADDR", ":7000")
+	t.Setenv("DD_EU_DATADOG_SERVER", "env.example.com:443")
+
+	config := NewConfig()
+	if err := config.Load(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The env vars override the file, which overrides the defaults
+	if config.ListenAddr != ":7000" || config.HTTPListenAddr != ":8080" {
+		t.Errorf("got listeners %s and %s", config.ListenAddr, config.HTTPListenAddr)
+	}
+	if config.TLSReloadPeriod != time.Minute || config.SessionIdleTimeout != 2*time.Minute {
+		t.Errorf("got durations %s and %s", config.TLSReloadPeriod, config.SessionIdleTimeout)
+	}
+	if config.LogstashAuthPrefixToken != "file-token" || config.ShutdownDrainTimeout != 25*time.Second {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if !reflect.DeepEqual(config.Outputs, []string{"dd_eu", "scalyr"}) {
+		t.Fatalf("got outputs %v", config.Outputs)
+	}
+
+	dd, ok := config.OutputClientConfigs["dd_eu"].(*datadog.Config)
+	if !ok {
+		t.Fatalf("dd_eu is a %T", config.OutputClientConfigs["dd_eu"])
+	}
+	if dd.Token != "dd-token" || dd.Server != "env.example.com:443" {
+		t.Errorf("got datadog token %s and server %s", string(dd.Token), dd.Server)
+	}
+	// The conversions replace the default ones
+	if !reflect.DeepEqual(dd.KeysToTagsConversions, clients.Conversions{"team": "team"}) {
+		t.Errorf("got conversions %v", dd.KeysToTagsConversions)
+	}
+	if sc := config.OutputClientConfigs["scalyr"].(*scalyr.Config); sc.Token != "scalyr-token" || sc.QueueSize != 10 {
+		t.Errorf("got scalyr token %s and queue size %d", string(sc.Token), sc.QueueSize)
+	}
+
+	// The file isn't applied to the environment
+	if _, ok := os.LookupEnv("HTTP_LISTEN_ADDR"); ok {
+		t.Error("HTTP_LISTEN_ADDR was set")
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"unknown section", "listener:\n  tcp: \":6000\"\n", "field listener not found"},
+		{"unknown setting", "listeners:\n  tpc: \":6000\"\n", "field tpc not found"},
+		{"invalid value", "inputs:\n  session_idle_timeout: soon\n", "invalid config file"},
+		{"unknown output setting", "outputs:\n  - name: scalyr\n    tokn: t\n", "field tokn not found"},
+		{"output without a name", "outputs:\n  - type: scalyr\n", "need a name"},
+		{"output defined twice", "outputs:\n  - name: scalyr\n  - name: scalyr\n", "defined twice"},
+		{"invalid setting", "outputs:\n  - name: scalyr\n    token: t\n    queue_size: 0\n", "SCALYR_QUEUE_SIZE"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writeConfigFile(t, test.content)
+			err := NewConfig().Load()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// deadLetter is a line that couldn't be handled
+type deadLetter struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Line       string    `json:"line"`
+	Error      string    `json:"error"`
+}
+
+// rotatingFile appends to a file, which is renamed with a .1 suffix (the previous ones being shifted) once it reaches
+// its maximum size
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int // Number of rotated files kept
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes a whole record, the file is rotated first if it doesn't fit
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	if f.file != nil && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("couldn't rotate %s: %s", f.path, err)
+		}
+	}
+	if f.file == nil {
+		// The file couldn't be opened again after the last rotation
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	if f.maxFiles == 0 {
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		return f.open()
+	}
+	for i := f.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// deadLetterSink appends the dead letters to a file, as one JSON object per line. The file is rotated once it reaches
+// DEADLETTER_MAX_SIZE.
+type deadLetterSink struct {
+	sync.Mutex
+	file    *rotatingFile
+	encoder *json.Encoder
+}
+
+func (c *Config) newDeadLetterSink(path string) (*deadLetterSink, error) {
+	file, err := openRotatingFile(path, c.DeadLetterMaxSize, c.DeadLetterMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterSink{
+		file:    file,
+		encoder: json.NewEncoder(file), // Each record is written at once
+	}, nil
+}
+
+func (s *deadLetterSink) write(addr net.Addr, line string, cause error) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.encoder.Encode(&deadLetter{
+		Time:       time.Now(),
+		RemoteAddr: addr.String(),
+		Line:       line,
+		Error:      cause.Error(),
+	})
+}
+
+// WriteEvent writes an event an output couldn't send
+func (s *deadLetterSink) WriteEvent(letter *clients.EventDeadLetter) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.encoder.Encode(letter)
+}
+
+// openDeadLetters opens the dead letter file of the malformed lines if the policy needs it, and the one of the events
+// the outputs couldn't send if it's set (it can be the same file)
+func (srv *Server) openDeadLetters() error {
+	if srv.config.MalformedLinePolicy == "deadletter" {
+		sink, err := srv.config.newDeadLetterSink(srv.config.DeadLetterFile)
+		if err != nil {
+			return fmt.Errorf("couldn't open dead letter file: %s", err)
+		}
+		srv.deadLetters = sink
+	}
+
+	if srv.config.OutputDeadLetterFile == "" {
+		return nil
+	}
+	sink := srv.deadLetters
+	if sink == nil || srv.config.OutputDeadLetterFile != srv.config.DeadLetterFile {
+		var err error
+		if sink, err = srv.config.newDeadLetterSink(srv.config.OutputDeadLetterFile); err != nil {
+			return fmt.Errorf("couldn't open output dead letter file: %s", err)
+		}
+	}
+	clients.SetDeadLetterWriter(sink)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/inputs/fluent"
+)
+
+func (srv *Server) listenFluent() (net.Listener, error) {
+	if srv.config.FluentListenAddr == "" {
+		return nil, nil
+	}
+
+	listener, err := srv.listenTCP(srv.config.FluentListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", srv.config.FluentListenAddr, err)
+	}
+
+	if srv.config.FluentTLS {
+		tlsConfig, err := srv.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	srv.log.Infow(
+		"Listening for fluentd forward connections",
+		"addr", srv.config.FluentListenAddr,
+		"tls", srv.config.FluentTLS,
+	)
+
+	go srv.acceptConnections(listener, "fluent", (*ClientHandler).runFluent)
+
+	return listener, nil
+}
+
+// runFluent reads the messages of a fluentd forward client. The chunks are acknowledged once their events have been
+// handed to the output clients.
+func (clt *ClientHandler) runFluent() {
+	clt.log.Infow("Client connected", "protocol", "fluent")
+
+	defer clt.end()
+
+	config := clt.server.config
+	conn := fluent.NewConn(clt.Conn, config.FluentMaxMessageSize)
+
+	authenticated := clt.identity != nil
+	if config.FluentSharedKey != "" {
+		if err := conn.Handshake(string(config.FluentSharedKey), config.FluentSelfHostname); err != nil {
+			authFailures.Inc(clt.input)
+			clt.log.Warnw("Fluent handshake failed", "err", err)
+			return
+		}
+		authenticated = true
+	}
+
+	// Fluent clients can't send the logstash prefix token, they have to use the auth key (in their records), the
+	// shared key or a certificate
+	if clt.server.prefixAuth() && !authenticated {
+		authFailures.Inc(clt.input)
+		clt.log.Warnw("Fluent clients can't use the auth prefix token, they need a shared key or a client certificate")
+		return
+	}
+
+	for {
+		batch, err := conn.ReadBatch()
+		if err != nil {
+			clt.readFailed(err)
+			return
+		}
+
+		for _, entry := range batch.Entries {
+			linesRead.Inc(clt.input)
+			event, err := clt.server.fluentEvent(batch.Tag, entry, authenticated)
+			if err != nil {
+				authFailures.Inc(clt.input)
+				clt.log.Errorw("Couldn't convert fluent event", "err", err)
+				return
+			}
+			if err := clt.checkTenant(event); err != nil {
+				authFailures.Inc(clt.input)
+				clt.log.Errorw("Rejected fluent event", "err", err)
+				return
+			}
+			clt.receive(event)
+		}
+
+		if batch.Chunk != "" {
+			if err := conn.Ack(batch.Chunk); err != nil {
+				clt.log.Errorw("Couldn't acknowledge chunk", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// fluentEvent converts a fluent entry. Its tag is exposed as the "fluent_tag" attribute and its "log" field (used by
+// the docker logs) becomes the message if there isn't any.
+func (srv *Server) fluentEvent(tag string, entry fluent.Entry, authenticated bool) (*clients.LogEvent, error) {
+	attributes := entry.Record
+
+	if _, ok := attributes["message"]; !ok {
+		if log, ok := attributes["log"]; ok {
+			attributes["message"] = log
+			delete(attributes, "log")
+		}
+	}
+
+	event, err := srv.logstashEvent(attributes, authenticated)
+	if err != nil {
+		return nil, err
+	}
+
+	event.Timestamp = entry.Time
+	event.Attributes["fluent_tag"] = tag
+
+	return event, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/habx/service-logfwd/inputs/gelf"
+)
+
+const (
+	gelfChunksTimeout      = 5 * time.Second  // Time after which an incomplete chunked message is dropped
+	gelfMaxPendingMessages = 1000             // Maximum number of incomplete chunked messages
+	gelfMaxPendingSize     = 32 * 1024 * 1024 // Maximum size of the chunks of the incomplete messages
+)
+
+// listenGELF listens for GELF messages on both TCP and UDP
+func (srv *Server) listenGELF() (net.Listener, net.PacketConn, error) {
+	addr := srv.config.GELFListenAddr
+	if addr == "" {
+		return nil, nil, nil
+	}
+
+	listener, err := srv.listenTCP(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't listen on TCP %s: %s", addr, err)
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't listen on UDP %s: %s", addr, err)
+	}
+
+	srv.log.Infow("Listening for GELF messages", "addr", addr)
+
+	go srv.acceptConnections(listener, "gelf", (*ClientHandler).runGELF)
+	go srv.readGELFDatagrams(conn, srv.newSessionTable("gelf"))
+
+	return listener, conn, nil
+}
+
+// runGELF reads the null byte delimited GELF messages of a TCP connection
+func (clt *ClientHandler) runGELF() {
+	clt.log.Infow("Client connected", "protocol", "gelf")
+
+	defer clt.end()
+
+	reader := gelf.NewReader(clt.Conn, clt.server.config.LogstashMaxEventSize)
+	for {
+		data, err := reader.ReadMessage()
+		if err != nil {
+			clt.readFailed(err)
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		linesRead.Inc(clt.input)
+		event, err := gelf.Parse(data)
+		if err != nil {
+			parseFailures.Inc(clt.input)
+			clt.log.Warnw("Couldn't parse GELF message", "message", string(data), "err", err)
+			continue
+		}
+
+		clt.receive(event)
+	}
+}
+
+func (srv *Server) readGELFDatagrams(conn net.PacketConn, sessions *sessionTable) {
+	srv.closeOnShutdown(conn)
+
+	assembler := gelf.NewAssembler(gelfChunksTimeout, gelfMaxPendingMessages, gelfMaxPendingSize)
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if srv.isStopping() {
+				return
+			}
+			srv.log.Fatalw("Couldn't read datagram", "err", err)
+			return
+		}
+
+		payload, err := assembler.Add(buffer[:n])
+		if err == nil && payload != nil {
+			payload, err = gelf.Decompress(payload, srv.config.LogstashMaxEventSize)
+		}
+		if err == gelf.ErrTooManyPending {
+			gelfDroppedChunks.Inc()
+			srv.log.Debugw("Dropping GELF chunk", "remoteAddr", addr, "err", err)
+			continue
+		} else if err != nil {
+			parseFailures.Inc(sessions.input)
+			srv.log.Warnw("Couldn't read GELF datagram", "remoteAddr", addr, "err", err)
+			continue
+		}
+		if payload == nil {
+			// Waiting for the other chunks
+			continue
+		}
+
+		linesRead.Inc(sessions.input)
+		event, err := gelf.Parse(payload)
+		if err != nil {
+			parseFailures.Inc(sessions.input)
+			srv.log.Warnw(
+				"Couldn't parse GELF message",
+				"remoteAddr", addr,
+				"message", string(payload),
+				"err", err,
+			)
+			continue
+		}
+
+		sessions.send(addr, event)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// readiness tells whether we can accept events, with the state of each enabled output instance
+type readiness struct {
+	Ready   bool                        `json:"ready"`
+	Reason  string                      `json:"reason,omitempty"`
+	Outputs map[string]*outputReadiness `json:"outputs"`
+}
+
+type outputReadiness struct {
+	Ready        bool       `json:"ready"`
+	Reason       string     `json:"reason,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastFailure  *time.Time `json:"last_failure,omitempty"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	QueueUsage   int        `json:"queue_usage"` // Usage of the queue, in percent
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// readiness checks that we're not shutting down, and that each enabled output delivered its last events (or hasn't
+// been failing for long) and doesn't have a queue above the watermark
+func (srv *Server) readiness() *readiness {
+	now := time.Now()
+	state := &readiness{
+		Ready:   true,
+		Outputs: make(map[string]*outputReadiness),
+	}
+	for _, name := range srv.current().enabledOutputs() {
+		status := clients.Status(name)
+		state.Outputs[name] = &outputReadiness{
+			Ready:        true,
+			LastSuccess:  optionalTime(status.LastSuccess),
+			LastFailure:  optionalTime(status.LastFailure),
+			FailingSince: optionalTime(status.FailingSince),
+			LastError:    status.LastError,
+		}
+		if !status.FailingSince.IsZero() && now.Sub(status.FailingSince) >= srv.config.ReadyFailurePeriod {
+			state.Outputs[name].Ready = false
+			state.Outputs[name].Reason = fmt.Sprintf("failing since %s", status.FailingSince.Format(time.RFC3339))
+		}
+	}
+
+	for _, out := range srv.allOutputs() {
+		output, ok := state.Outputs[out.Name()]
+		if !ok {
+			continue
+		}
+		if usage := out.QueueUsage(); usage > output.QueueUsage {
+			output.QueueUsage = usage
+		}
+	}
+
+	for name, output := range state.Outputs {
+		if output.Ready && output.QueueUsage >= srv.config.ReadyQueueWatermark {
+			output.Ready = false
+			output.Reason = fmt.Sprintf("queue usage above %d%%", srv.config.ReadyQueueWatermark)
+		}
+		if !output.Ready && state.Ready {
+			state.Ready = false
+			state.Reason = fmt.Sprintf("output %s isn't ready", name)
+		}
+	}
+	if srv.isStopping() {
+		state.Ready = false
+		state.Reason = "shutting down"
+	}
+	return state
+}
+
+// handleHealth serves the liveness and readiness endpoints
+func (srv *Server) handleHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		srv.nbHandlers() // Doesn't answer if the server is stuck
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		state := srv.readiness()
+		w.Header().Set("Content-Type", "application/json")
+		if !state.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			srv.log.Warnw("Couldn't write readiness", "err", err)
+		}
+	})
+}
+
+// listenHealth serves the health endpoints alone, so that they can be reached by the probes without exposing the
+// admin API. Like the admin API, it keeps serving while the events are drained.
+func (srv *Server) listenHealth() (net.Listener, error) {
+	if srv.config.HealthListenAddr == "" {
+		return nil, nil
+	}
+
+	listener, err := net.Listen("tcp", srv.config.HealthListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", srv.config.HealthListenAddr, err)
+	}
+
+	srv.log.Infow("Listening for health checks", "addr", srv.config.HealthListenAddr)
+
+	mux := http.NewServeMux()
+	srv.handleHealth(mux)
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			srv.log.Fatalw("Couldn't serve health checks", "err", err)
+		}
+	}()
+
+	return listener, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadinessDrain(t *testing.T) {
+	config := NewConfig()
+	config.ReadyQueueWatermark = 20
+	out := newFakeOutput("out")
+	out.hold = make(chan struct{})
+	srv := newTestServer(config, nil, out)
+	mux := http.NewServeMux()
+	srv.handleHealth(mux)
+
+	get := func(path string) (int, *readiness) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		state := &readiness{}
+		if path == "/readyz" {
+			if err := json.Unmarshal(w.Body.Bytes(), state); err != nil {
+				t.Fatalf("invalid readiness %s: %s", w.Body, err)
+			}
+		}
+		return w.Code, state
+	}
+	if status, state := get("/readyz"); status != http.StatusOK || !state.Ready || !state.Outputs["out"].Ready {
+		t.Fatalf("got status %d and readiness %+v", status, state)
+	}
+
+	// The queue of the output fills up
+	conn := connectClient(srv)
+	if _, err := fmt.Fprintln(conn, `{"message": "a"}`+"\n"+`{"message": "b"}`); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the events to be sent", func() bool { return out.Pending() == 2 })
+	if status, state := get("/readyz"); status != http.StatusServiceUnavailable || state.Reason != "output out isn't ready" {
+		t.Errorf("got status %d and readiness %+v", status, state)
+	}
+
+	// We aren't ready while the events are drained, but we're still alive
+	stopped := make(chan struct{})
+	go func() {
+		srv.shutdown(5 * time.Second)
+		close(stopped)
+	}()
+	waitFor(t, "the shutdown", srv.isStopping)
+	if status, state := get("/readyz"); status != http.StatusServiceUnavailable || state.Reason != "shutting down" {
+		t.Errorf("got status %d and readiness %+v while draining", status, state)
+	}
+	if status, _ := get("/healthz"); status != http.StatusOK {
+		t.Errorf("got status %d for the liveness while draining", status)
+	}
+
+	close(out.hold)
+	<-stopped
+	if status, state := get("/readyz"); status != http.StatusServiceUnavailable || state.Reason != "shutting down" {
+		t.Errorf("got status %d and readiness %+v once drained", status, state)
+	}
+}
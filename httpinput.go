@@ -0,0 +1,242 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// httpInput accepts events POSTed the same way as the logstash http input plugin does
+type httpInput struct {
+	server   *Server
+	sessions *sessionTable
+}
+
+func (srv *Server) listenHTTP() (net.Listener, error) {
+	if srv.config.HTTPListenAddr == "" {
+		return nil, nil
+	}
+
+	listener, err := srv.listenTCP(srv.config.HTTPListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", srv.config.HTTPListenAddr, err)
+	}
+
+	srv.log.Infow("Listening for HTTP requests", "addr", srv.config.HTTPListenAddr)
+
+	input := &httpInput{
+		server:   srv,
+		sessions: srv.newSessionTable("http"),
+	}
+
+	server := &http.Server{Handler: input}
+
+	// The requests being handled are completed before the sessions are ended
+	srv.onShutdown(func() {
+		if err := server.Shutdown(context.Background()); err != nil {
+			srv.log.Warnw("Issue shutting down HTTP server", "err", err)
+		}
+	})
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			srv.log.Fatalw("Couldn't serve HTTP requests", "err", err)
+		}
+	}()
+
+	return listener, nil
+}
+
+func (input *httpInput) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "only POST and PUT are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, tenant, err := input.authenticate(r)
+	if err != nil {
+		authFailures.Inc(input.sessions.input)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	maxSize := input.server.config.HTTPMaxBodySize
+	body := io.Reader(http.MaxBytesReader(w, r.Body, maxSize))
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid gzip body: %s", err), requestErrorStatus(err))
+			return
+		}
+		defer gzipReader.Close() // nolint: errcheck
+		// The decompressed body has the same limit as the compressed one
+		body = &limitedReader{reader: gzipReader, remaining: maxSize}
+	}
+
+	// All the events are parsed before sending any of them, a client can then safely retry a failed request
+	events, err := input.parseBody(body, authenticated, tenant)
+	if err != nil {
+		input.server.log.Warnw(
+			"Couldn't parse HTTP request",
+			"remoteAddr", r.RemoteAddr,
+			"err", err,
+		)
+		http.Error(w, err.Error(), requestErrorStatus(err))
+		return
+	}
+
+	addr := httpRemoteAddr(r)
+	for _, event := range events {
+		input.sessions.send(addr, event)
+	}
+
+	if _, err := w.Write([]byte("ok")); err != nil {
+		input.server.log.Infow("Couldn't write HTTP response", "err", err)
+	}
+}
+
+// authenticate checks the authentication headers, which can also choose the tenant. When authentication by key is
+// used, each event can also contain the auth key instead of the request.
+func (input *httpInput) authenticate(r *http.Request) (bool, *clients.Tenant, error) {
+	srv := input.server
+	config := srv.config
+
+	if srv.prefixAuth() {
+		authorization := r.Header.Get("Authorization")
+		tenant, ok := srv.tokenTenant(config.LogstashAuthPrefixToken, strings.TrimPrefix(authorization, "Bearer "))
+		if !ok || !strings.HasPrefix(authorization, "Bearer ") {
+			return false, nil, errors.New("wrong auth prefix token authentication")
+		}
+		return true, tenant, nil
+	}
+
+	if config.LogstashAuthKey != "" {
+		if value := r.Header.Get(config.LogstashAuthKey); value != "" {
+			tenant, ok := srv.tokenTenant(config.LogstashAuthValue, value)
+			if !ok {
+				return false, nil, fmt.Errorf("wrong authentication with key %s", config.LogstashAuthKey)
+			}
+			return true, tenant, nil
+		}
+	}
+
+	return false, nil, nil
+}
+
+// parseBody parses a single JSON object, a JSON array of objects or newline delimited JSON objects
+func (input *httpInput) parseBody(
+	body io.Reader,
+	authenticated bool,
+	tenant *clients.Tenant,
+) ([]*clients.LogEvent, error) {
+	var events []*clients.LogEvent
+
+	addEvent := func(value interface{}) error {
+		linesRead.Inc(input.sessions.input)
+		lineJSON, ok := value.(map[string]interface{})
+		if !ok {
+			parseFailures.Inc(input.sessions.input)
+			return fmt.Errorf("events must be JSON objects")
+		}
+		event, err := input.server.logstashEvent(lineJSON, authenticated)
+		if err != nil {
+			authFailures.Inc(input.sessions.input)
+			return err
+		}
+		// The events of the request all belong to the tenant of its headers
+		if tenant != nil {
+			if event.Tenant != nil && event.Tenant.Name != tenant.Name {
+				authFailures.Inc(input.sessions.input)
+				return errors.New("a request can't contain events of several tenants")
+			}
+			event.Tenant = tenant
+		}
+		events = append(events, event)
+		return nil
+	}
+
+	decoder := json.NewDecoder(body)
+	for {
+		var value interface{}
+		if err := decoder.Decode(&value); err == io.EOF {
+			break
+		} else if err != nil {
+			parseFailures.Inc(input.sessions.input)
+			return nil, err
+		}
+		if array, ok := value.([]interface{}); ok {
+			for _, value := range array {
+				if err := addEvent(value); err != nil {
+					return nil, err
+				}
+			}
+		} else if err := addEvent(value); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedReader fails with errBodyTooLarge once more than its limit is read
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	if int64(n) <= r.remaining {
+		r.remaining -= int64(n)
+		return n, err
+	}
+	n = int(r.remaining)
+	r.remaining = 0
+	return n, errBodyTooLarge
+}
+
+// requestErrorStatus returns the status of a request whose body couldn't be read or parsed
+func requestErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if err == errBodyTooLarge || errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// requestAddr is the remote address of a request which isn't an IP address, as the HTTP server gave it
+type requestAddr string
+
+// Network returns the name of the network
+func (a requestAddr) Network() string {
+	return "http"
+}
+
+func (a requestAddr) String() string {
+	return string(a)
+}
+
+// httpRemoteAddr returns the address of the client without its port, which changes with each connection
+func httpRemoteAddr(r *http.Request) net.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.IPAddr{IP: ip}
+	}
+	return requestAddr(r.RemoteAddr)
+}
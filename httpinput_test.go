@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPRemoteAddr(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1"},
+		// The addresses which aren't IP addresses are kept as they are
+		{"@", "@"},
+		{"proxy:1234", "proxy:1234"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if got := httpRemoteAddr(r).String(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.remoteAddr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package fluent
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Entry is an event of a fluentd forward message
+type Entry struct {
+	Time   time.Time
+	Record map[string]interface{}
+}
+
+// Batch contains the entries of a forward message, which all share the same tag
+type Batch struct {
+	Tag     string
+	Entries []Entry
+	Chunk   string // ID to acknowledge once the entries were handled (empty if the client doesn't expect an ack)
+}
+
+// Conn is the server side of a fluentd forward protocol connection
+// ( https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1 )
+type Conn struct {
+	rw      io.ReadWriter
+	decoder *decoder
+	maxSize int
+}
+
+// NewConn creates a connection refusing messages bigger than maxSize
+func NewConn(rw io.ReadWriter, maxSize int) *Conn {
+	return &Conn{
+		rw:      rw,
+		decoder: newDecoder(bufio.NewReader(rw)),
+		maxSize: maxSize,
+	}
+}
+
+func (c *Conn) write(value interface{}) error {
+	_, err := c.rw.Write(appendValue(nil, value))
+	return err
+}
+
+// Handshake authenticates the client with the shared key (HELO, PING, PONG)
+func (c *Conn) Handshake(sharedKey, selfHostname string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	if err := c.write([]interface{}{
+		"HELO",
+		map[string]interface{}{
+			"nonce":     nonce,
+			"auth":      "",
+			"keepalive": true,
+		},
+	}); err != nil {
+		return err
+	}
+
+	msg, err := c.decoder.decode(c.maxSize)
+	if err != nil {
+		return err
+	}
+	ping, ok := msg.([]interface{})
+	if !ok || len(ping) < 4 || toString(ping[0]) != "PING" {
+		return errors.New("expected a PING message")
+	}
+	clientHostname, salt, digest := toString(ping[1]), toString(ping[2]), toString(ping[3])
+
+	expected := sharedKeyDigest(salt, clientHostname, nonce, sharedKey)
+	authenticated := subtle.ConstantTimeCompare([]byte(digest), []byte(expected)) == 1
+	reason := ""
+	if !authenticated {
+		reason = "shared_key mismatch"
+	}
+
+	if err := c.write([]interface{}{
+		"PONG",
+		authenticated,
+		reason,
+		selfHostname,
+		sharedKeyDigest(salt, selfHostname, nonce, sharedKey),
+	}); err != nil {
+		return err
+	}
+
+	if !authenticated {
+		return fmt.Errorf("authentication failed for %s", clientHostname)
+	}
+	return nil
+}
+
+func sharedKeyDigest(salt, hostname string, nonce []byte, sharedKey string) string {
+	h := sha512.New()
+	h.Write([]byte(salt))      // nolint: errcheck
+	h.Write([]byte(hostname))  // nolint: errcheck
+	h.Write(nonce)             // nolint: errcheck
+	h.Write([]byte(sharedKey)) // nolint: errcheck
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ReadBatch reads the next message, whatever its mode: Message, Forward, PackedForward or CompressedPackedForward
+func (c *Conn) ReadBatch() (*Batch, error) {
+	msg, err := c.decoder.decode(c.maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	array, ok := msg.([]interface{})
+	if !ok || len(array) < 2 {
+		return nil, errors.New("a message must be an array of at least 2 elements")
+	}
+	batch := &Batch{Tag: toString(array[0])}
+	if batch.Tag == "" {
+		return nil, errors.New("invalid tag")
+	}
+
+	var options map[string]interface{}
+
+	switch entries := array[1].(type) {
+	case []interface{}: // Forward mode: [tag, [[time, record], ...], option]
+		for _, e := range entries {
+			entry, ok := e.([]interface{})
+			if !ok || len(entry) < 2 {
+				return nil, errors.New("invalid entry")
+			}
+			if err := batch.addEntry(entry[0], entry[1]); err != nil {
+				return nil, err
+			}
+		}
+		options = optionsAt(array, 2)
+	case []byte, string: // PackedForward mode: [tag, msgpack stream of [time, record], option]
+		options = optionsAt(array, 2)
+		if err := batch.addPackedEntries([]byte(toString(entries)), options, c.maxSize); err != nil {
+			return nil, err
+		}
+	default: // Message mode: [tag, time, record, option]
+		if len(array) < 3 {
+			return nil, errors.New("a message must have a time and a record")
+		}
+		if err := batch.addEntry(array[1], array[2]); err != nil {
+			return nil, err
+		}
+		options = optionsAt(array, 3)
+	}
+
+	if options != nil {
+		batch.Chunk = toString(options["chunk"])
+	}
+
+	return batch, nil
+}
+
+// Ack acknowledges a chunk
+func (c *Conn) Ack(chunk string) error {
+	return c.write(map[string]interface{}{"ack": chunk})
+}
+
+func optionsAt(array []interface{}, index int) map[string]interface{} {
+	if len(array) <= index {
+		return nil
+	}
+	options, _ := array[index].(map[string]interface{})
+	return options
+}
+
+func (b *Batch) addPackedEntries(packed []byte, options map[string]interface{}, maxSize int) error {
+	if options != nil && toString(options["compressed"]) == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(packed))
+		if err != nil {
+			return fmt.Errorf("invalid compressed entries: %s", err)
+		}
+		if packed, err = ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1)); err != nil {
+			return fmt.Errorf("invalid compressed entries: %s", err)
+		}
+		if len(packed) > maxSize {
+			return errTooBig
+		}
+	}
+
+	reader := bytes.NewReader(packed)
+	decoder := newDecoder(reader)
+	for reader.Len() > 0 {
+		value, err := decoder.decode(maxSize)
+		if err != nil {
+			return err
+		}
+		entry, ok := value.([]interface{})
+		if !ok || len(entry) < 2 {
+			return errors.New("invalid packed entry")
+		}
+		if err := b.addEntry(entry[0], entry[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Batch) addEntry(rawTime, rawRecord interface{}) error {
+	entry := Entry{}
+
+	switch t := rawTime.(type) {
+	case time.Time:
+		entry.Time = t
+	case int64:
+		entry.Time = time.Unix(t, 0)
+	case uint64:
+		entry.Time = time.Unix(int64(t), 0)
+	case float64:
+		entry.Time = time.Unix(0, int64(t*1e9))
+	default:
+		return fmt.Errorf("invalid time %v", rawTime)
+	}
+
+	record, ok := rawRecord.(map[string]interface{})
+	if !ok {
+		return errors.New("a record must be a map")
+	}
+	entry.Record = normalize(record).(map[string]interface{})
+
+	b.Entries = append(b.Entries, entry)
+	return nil
+}
+
+// normalize converts the binary values to strings, some clients use them for all their strings
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = normalize(v[k])
+		}
+	}
+	return value
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package fluent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshake runs the client side of the handshake with a shared key, it returns the PONG message
+func handshake(t *testing.T, sharedKey, clientKey string) ([]interface{}, error) {
+	server, client := net.Pipe()
+	defer server.Close() // nolint: errcheck
+	defer client.Close() // nolint: errcheck
+
+	result := make(chan error, 1)
+	go func() {
+		result <- NewConn(server, 1024).Handshake(sharedKey, "server")
+	}()
+
+	decoder := newDecoder(client)
+	helo, err := decoder.decode(1024)
+	if err != nil {
+		t.Fatalf("couldn't read HELO: %s", err)
+	}
+	nonce := helo.([]interface{})[1].(map[string]interface{})["nonce"].([]byte)
+
+	ping := []interface{}{"PING", "client", "salt", sharedKeyDigest("salt", "client", nonce, clientKey), "", ""}
+	if _, err := client.Write(appendValue(nil, ping)); err != nil {
+		t.Fatalf("couldn't write PING: %s", err)
+	}
+	pong, err := decoder.decode(1024)
+	if err != nil {
+		t.Fatalf("couldn't read PONG: %s", err)
+	}
+	return pong.([]interface{}), <-result
+}
+
+func TestHandshake(t *testing.T) {
+	pong, err := handshake(t, "key", "key")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if pong[0] != "PONG" || pong[1] != true || pong[3] != "server" {
+		t.Errorf("unexpected PONG %#v", pong)
+	}
+
+	pong, err = handshake(t, "key", "other")
+	if err == nil {
+		t.Error("expected an authentication failure")
+	}
+	if pong[1] != false || pong[2] != "shared_key mismatch" {
+		t.Errorf("unexpected PONG %#v", pong)
+	}
+}
+
+// encode encodes the messages of the clients, which also contain integers
+func encode(value interface{}) []byte {
+	switch v := value.(type) {
+	case int64:
+		return []byte{byte(v)} // positive fixint
+	case []interface{}:
+		buf := appendLength(nil, len(v), 0x90, 0x0f, 0xdc)
+		for _, e := range v {
+			buf = append(buf, encode(e)...)
+		}
+		return buf
+	default:
+		return appendValue(nil, value)
+	}
+}
+
+func readBatch(message interface{}) (*Batch, error) {
+	var buf bytes.Buffer
+	buf.Write(encode(message))
+	return NewConn(&buf, 1024).ReadBatch()
+}
+
+func TestReadBatch(t *testing.T) {
+	record := map[string]interface{}{"message": "hello"}
+	entry := []interface{}{int64(1), record}
+	packed := append(encode(entry), encode(entry)...)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(packed) // nolint: errcheck
+	writer.Close()       // nolint: errcheck
+
+	tests := []struct {
+		name    string
+		message []interface{}
+		entries int
+		chunk   string
+	}{
+		{"message", []interface{}{"tag", int64(1), record}, 1, ""},
+		{"message with options", []interface{}{"tag", int64(1), record, map[string]interface{}{"chunk": "c"}}, 1, "c"},
+		{"forward", []interface{}{"tag", []interface{}{entry, entry}}, 2, ""},
+		{"packed forward", []interface{}{"tag", packed, map[string]interface{}{"chunk": "c"}}, 2, "c"},
+		{"compressed packed forward", []interface{}{"tag", compressed.Bytes(), map[string]interface{}{"compressed": "gzip"}}, 2, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch, err := readBatch(test.message)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if batch.Tag != "tag" || len(batch.Entries) != test.entries || batch.Chunk != test.chunk {
+				t.Fatalf("unexpected batch %+v", batch)
+			}
+			for _, e := range batch.Entries {
+				if !e.Time.Equal(time.Unix(1, 0)) || e.Record["message"] != "hello" {
+					t.Errorf("unexpected entry %+v", e)
+				}
+			}
+		})
+	}
+}
+
+func TestReadBatchMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		message interface{}
+	}{
+		{"not an array", map[string]interface{}{}},
+		{"too short", []interface{}{"tag"}},
+		{"empty tag", []interface{}{"", int64(1), map[string]interface{}{}}},
+		{"missing record", []interface{}{"tag", int64(1)}},
+		{"invalid time", []interface{}{"tag", "now", map[string]interface{}{}}},
+		{"record not a map", []interface{}{"tag", int64(1), "record"}},
+		{"invalid entry", []interface{}{"tag", []interface{}{"entry"}}},
+		{"invalid packed entry", []interface{}{"tag", []byte{0x01}}},
+		{"invalid compressed entries", []interface{}{"tag", []byte{0x01}, map[string]interface{}{"compressed": "gzip"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if batch, err := readBatch(test.message); err == nil {
+				t.Errorf("expected an error, got %+v", batch)
+			}
+		})
+	}
+}
+
+func TestCompressedEntriesTooBig(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(make([]byte, 1<<20)) // nolint: errcheck
+	writer.Close()                    // nolint: errcheck
+
+	batch := &Batch{}
+	err := batch.addPackedEntries(compressed.Bytes(), map[string]interface{}{"compressed": "gzip"}, 1024)
+	if err != errTooBig {
+		t.Errorf("got error %v, want %v", err, errTooBig)
+	}
+}
@@ -0,0 +1,324 @@
+package fluent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// This is a minimal msgpack ( https://github.com/msgpack/msgpack/blob/master/spec.md ) implementation, covering
+// what the forward protocol uses.
+
+// eventTimeExt is the extension type used by fluentd for its nanosecond precision timestamps
+const eventTimeExt = 0
+
+// maxDepth is the maximum nesting of arrays and maps, which are decoded recursively
+const maxDepth = 100
+
+var (
+	errTooBig  = errors.New("message is too big")
+	errTooDeep = errors.New("message is nested too deeply")
+)
+
+// decoder decodes msgpack values, it refuses to allocate more than its budget for a value
+type decoder struct {
+	reader io.Reader
+	budget int
+	depth  int // Arrays and maps being decoded
+	buf    [8]byte
+}
+
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{reader: r}
+}
+
+// decode decodes the next value, limiting its size to maxSize
+func (d *decoder) decode(maxSize int) (interface{}, error) {
+	d.budget = maxSize
+	d.depth = 0
+	return d.value()
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if _, err := io.ReadFull(d.reader, d.buf[:n]); err != nil {
+		return nil, err
+	}
+	return d.buf[:n], nil
+}
+
+func (d *decoder) readBytes(n int) ([]byte, error) {
+	if d.budget -= n; d.budget < 0 {
+		return nil, errTooBig
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.reader, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+func (d *decoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *decoder) value() (interface{}, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f: // positive fixint
+		return int64(code), nil
+	case code >= 0xe0: // negative fixint
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80: // fixmap
+		return d.mapValue(int(code & 0x0f))
+	case code&0xf0 == 0x90: // fixarray
+		return d.arrayValue(int(code & 0x0f))
+	case code&0xe0 == 0xa0: // fixstr
+		return d.stringValue(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		n, err := d.readUint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(int(n))
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		n, err := d.readUint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.extValue(int(n))
+	case 0xca:
+		n, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.readUint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		n, err := d.readUint(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		n, err := d.readUint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.readUint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.readUint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.readUint(8)
+		return int64(n), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return d.extValue(1 << (code - 0xd4))
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		n, err := d.readUint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.stringValue(int(n))
+	case 0xdc, 0xdd: // array 16, 32
+		n, err := d.readUint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayValue(int(n))
+	case 0xde, 0xdf: // map 16, 32
+		n, err := d.readUint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(int(n))
+	}
+
+	return nil, fmt.Errorf("invalid msgpack code 0x%x", code)
+}
+
+func (d *decoder) stringValue(n int) (interface{}, error) {
+	b, err := d.readBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// enter accounts for a nested array or map, the returned function has to be called once it's decoded
+func (d *decoder) enter() (func(), error) {
+	if d.depth++; d.depth > maxDepth {
+		return nil, errTooDeep
+	}
+	return func() { d.depth-- }, nil
+}
+
+func (d *decoder) arrayValue(n int) (interface{}, error) {
+	// Each element takes at least one byte
+	if d.budget -= n; d.budget < 0 {
+		return nil, errTooBig
+	}
+	leave, err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	array := make([]interface{}, n)
+	for i := range array {
+		value, err := d.value()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		array[i] = value
+	}
+	return array, nil
+}
+
+func (d *decoder) mapValue(n int) (interface{}, error) {
+	if d.budget -= 2 * n; d.budget < 0 {
+		return nil, errTooBig
+	}
+	leave, err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.value()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		value, err := d.value()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		switch k := key.(type) {
+		case string:
+			m[k] = value
+		case []byte:
+			m[string(k)] = value
+		default:
+			m[fmt.Sprint(k)] = value
+		}
+	}
+	return m, nil
+}
+
+func (d *decoder) extValue(n int) (interface{}, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	extType := int8(b[0])
+	data, err := d.readBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if extType == eventTimeExt && n == 8 {
+		return time.Unix(int64(binary.BigEndian.Uint32(data[:4])), int64(binary.BigEndian.Uint32(data[4:]))), nil
+	}
+	return data, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// appendValue encodes the few types the server sends
+func appendValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, 0xc0)
+	case bool:
+		if v {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case string:
+		buf = appendLength(buf, len(v), 0xa0, 0x1f, 0xd9)
+		return append(buf, v...)
+	case []byte:
+		buf = append(buf, 0xc6)
+		buf = appendUint32(buf, uint32(len(v)))
+		return append(buf, v...)
+	case []interface{}:
+		buf = appendLength(buf, len(v), 0x90, 0x0f, 0xdc)
+		for _, e := range v {
+			buf = appendValue(buf, e)
+		}
+		return buf
+	case map[string]interface{}:
+		buf = appendLength(buf, len(v), 0x80, 0x0f, 0xde)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf = appendValue(buf, k)
+			buf = appendValue(buf, v[k])
+		}
+		return buf
+	default:
+		panic(fmt.Sprintf("unsupported msgpack type %T", value))
+	}
+}
+
+// appendLength writes the header of a string, an array or a map: its fix format if the length fits in it, or its 16
+// bits format (or 8 bits for strings) followed by its 32 bits format
+func appendLength(buf []byte, n int, fixCode, fixMax byte, code byte) []byte {
+	switch {
+	case n <= int(fixMax):
+		return append(buf, fixCode|byte(n))
+	case code == 0xd9 && n <= math.MaxUint8:
+		return append(buf, code, byte(n))
+	case code == 0xd9 && n <= math.MaxUint16:
+		return append(buf, code+1, byte(n>>8), byte(n))
+	case code != 0xd9 && n <= math.MaxUint16:
+		return append(buf, code, byte(n>>8), byte(n))
+	case code == 0xd9:
+		return appendUint32(append(buf, code+2), uint32(n))
+	default:
+		return appendUint32(append(buf, code+1), uint32(n))
+	}
+}
+
+func appendUint32(buf []byte, n uint32) []byte {
+	return append(buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
@@ -0,0 +1,135 @@
+package fluent
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeBytes(data []byte, maxSize int) (interface{}, error) {
+	return newDecoder(bytes.NewReader(data)).decode(maxSize)
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{"nil", []byte{0xc0}, nil},
+		{"false", []byte{0xc2}, false},
+		{"true", []byte{0xc3}, true},
+		{"positive fixint", []byte{0x7f}, int64(127)},
+		{"negative fixint", []byte{0xff}, int64(-1)},
+		{"uint 16", []byte{0xcd, 0x01, 0x00}, int64(256)},
+		{"uint 64", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(math.MaxUint64)},
+		{"int 8", []byte{0xd0, 0x80}, int64(-128)},
+		{"int 32", []byte{0xd2, 0xff, 0xff, 0xff, 0xfe}, int64(-2)},
+		{"float 32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, float64(1.5)},
+		{"float 64", []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, float64(1.5)},
+		{"fixstr", []byte{0xa3, 'a', 'b', 'c'}, "abc"},
+		{"str 8", []byte{0xd9, 0x02, 'h', 'i'}, "hi"},
+		{"bin 8", []byte{0xc4, 0x02, 0x01, 0x02}, []byte{0x01, 0x02}},
+		{"fixarray", []byte{0x92, 0x01, 0xa1, 'x'}, []interface{}{int64(1), "x"}},
+		{"array 16", []byte{0xdc, 0x00, 0x01, 0xc0}, []interface{}{nil}},
+		{"fixmap", []byte{0x81, 0xa1, 'k', 0xa1, 'v'}, map[string]interface{}{"k": "v"}},
+		{"map with a binary key", []byte{0x81, 0xc4, 0x01, 'k', 0x01}, map[string]interface{}{"k": int64(1)}},
+		{"map with an integer key", []byte{0x81, 0x07, 0x01}, map[string]interface{}{"7": int64(1)}},
+		{"event time", []byte{0xd7, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02}, time.Unix(1, 2)},
+		{"other extension", []byte{0xd4, 0x05, 0x2a}, []byte{0x2a}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := decodeBytes(test.data, 1024)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(value, test.want) {
+				t.Errorf("got %#v, want %#v", value, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	nested := func(depth int) []byte {
+		return append(bytes.Repeat([]byte{0x91}, depth), 0xc0)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize int
+		want    error
+	}{
+		{"empty", nil, 1024, io.EOF},
+		{"invalid code", []byte{0xc1}, 1024, nil},
+		{"truncated integer", []byte{0xcd, 0x01}, 1024, io.ErrUnexpectedEOF},
+		{"truncated string", []byte{0xa3, 'a'}, 1024, io.ErrUnexpectedEOF},
+		{"truncated array", []byte{0x92, 0x01}, 1024, io.ErrUnexpectedEOF},
+		{"truncated map", []byte{0x81, 0xa1, 'k'}, 1024, io.ErrUnexpectedEOF},
+		{"string too big", []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, 1024, errTooBig},
+		{"array too big", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, 1024, errTooBig},
+		{"map too big", []byte{0xdf, 0x7f, 0xff, 0xff, 0xff}, 1024, errTooBig},
+		{"budget shared by the elements", []byte{0x92, 0xa4, 'a', 'b', 'c', 'd', 0xa4, 'e', 'f', 'g', 'h'}, 8, errTooBig},
+		{"nested too deeply", nested(maxDepth + 1), 1024, errTooDeep},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := decodeBytes(test.data, test.maxSize)
+			if err == nil {
+				t.Fatalf("expected an error, got %#v", value)
+			}
+			if test.want != nil && err != test.want {
+				t.Errorf("got error %q, want %q", err, test.want)
+			}
+		})
+	}
+
+	if _, err := decodeBytes(nested(maxDepth), 1024); err != nil {
+		t.Errorf("unexpected error at the maximum depth: %s", err)
+	}
+}
+
+func TestDecoderResetsDepth(t *testing.T) {
+	// The depth of a value that failed doesn't count for the next one
+	data := append(bytes.Repeat([]byte{0x91}, 50), 0xc1)
+	data = append(data, append(bytes.Repeat([]byte{0x91}, 60), 0xc0)...)
+	decoder := newDecoder(bytes.NewReader(data))
+	if _, err := decoder.decode(1024); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := decoder.decode(1024); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestAppendValue(t *testing.T) {
+	values := []interface{}{
+		nil,
+		true,
+		"",
+		strings.Repeat("s", 300),
+		strings.Repeat("s", 70000),
+		[]byte{1, 2, 3},
+		[]interface{}{"a", false},
+		map[string]interface{}{"nonce": []byte("n"), "keepalive": true},
+	}
+
+	for _, value := range values {
+		decoded, err := decodeBytes(appendValue(nil, value), 1<<20)
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %s", value, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("got %#v, want %#v", decoded, value)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	chunkHeaderSize = 12 // magic (2) + message ID (8) + sequence number (1) + sequence count (1)
+	maxChunks       = 128
+)
+
+var chunkMagic = []byte{0x1e, 0x0f}
+
+// ErrTooManyPending is returned for the chunks of a message which was dropped as the incomplete messages reached the
+// limits of the assembler
+var ErrTooManyPending = errors.New("too many incomplete chunked messages")
+
+// Assembler reassembles the chunked GELF messages received over UDP
+type Assembler struct {
+	timeout     time.Duration
+	maxMessages int // Maximum number of incomplete messages
+	maxSize     int // Maximum size of the chunks of the incomplete messages
+	sync.Mutex
+	messages map[[8]byte]*chunkedMessage
+	size     int // Size of the chunks of the incomplete messages
+}
+
+type chunkedMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
+	arrival  time.Time
+}
+
+// NewAssembler creates an assembler dropping the messages that aren't complete after the timeout (5 seconds in the
+// GELF specification). The messages whose chunks don't fit in the limits of the incomplete messages are dropped too.
+func NewAssembler(timeout time.Duration, maxMessages, maxSize int) *Assembler {
+	return &Assembler{
+		timeout:     timeout,
+		maxMessages: maxMessages,
+		maxSize:     maxSize,
+		messages:    make(map[[8]byte]*chunkedMessage),
+	}
+}
+
+// Add adds a datagram and returns the whole message when it is complete (or if it wasn't chunked)
+func (a *Assembler) Add(datagram []byte) ([]byte, error) {
+	if !bytes.HasPrefix(datagram, chunkMagic) {
+		return datagram, nil
+	}
+	if len(datagram) < chunkHeaderSize {
+		return nil, errors.New("truncated chunk header")
+	}
+
+	var id [8]byte
+	copy(id[:], datagram[2:10])
+	seqNumber, seqCount := int(datagram[10]), int(datagram[11])
+	if seqCount == 0 || seqCount > maxChunks || seqNumber >= seqCount {
+		return nil, fmt.Errorf("invalid chunk %d/%d", seqNumber, seqCount)
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.expire()
+
+	msg, ok := a.messages[id]
+	if !ok {
+		if len(a.messages) >= a.maxMessages {
+			return nil, ErrTooManyPending
+		}
+		msg = &chunkedMessage{
+			chunks:  make([][]byte, seqCount),
+			arrival: time.Now(),
+		}
+		a.messages[id] = msg
+	}
+	if len(msg.chunks) != seqCount {
+		a.remove(id, msg)
+		return nil, errors.New("inconsistent chunks count")
+	}
+	if msg.chunks[seqNumber] == nil {
+		size := len(datagram) - chunkHeaderSize
+		if a.size+size > a.maxSize {
+			a.remove(id, msg)
+			return nil, ErrTooManyPending
+		}
+		// The datagram buffer is reused by the caller
+		msg.chunks[seqNumber] = append([]byte(nil), datagram[chunkHeaderSize:]...)
+		msg.received++
+		msg.size += size
+		a.size += size
+	}
+	if msg.received < seqCount {
+		return nil, nil
+	}
+
+	a.remove(id, msg)
+	payload := make([]byte, 0, msg.size)
+	for _, chunk := range msg.chunks {
+		payload = append(payload, chunk...)
+	}
+	return payload, nil
+}
+
+// remove removes a message which is complete or dropped, the assembler must be locked
+func (a *Assembler) remove(id [8]byte, msg *chunkedMessage) {
+	delete(a.messages, id)
+	a.size -= msg.size
+}
+
+func (a *Assembler) expire() {
+	for id, msg := range a.messages {
+		if time.Since(msg.arrival) > a.timeout {
+			a.remove(id, msg)
+		}
+	}
+}
+
+// Decompress decompresses a gzip or zlib payload, other payloads are returned as they are
+func Decompress(payload []byte, maxSize int) ([]byte, error) {
+	var reader io.Reader
+	var err error
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) >= 2 && payload[0]&0x0f == 0x08 && (uint16(payload[0])<<8|uint16(payload[1]))%31 == 0:
+		reader, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("message is too big: more than %d bytes", maxSize)
+	}
+	return data, nil
+}
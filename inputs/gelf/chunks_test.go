@@ -0,0 +1,204 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"testing"
+	"time"
+)
+
+func chunk(id byte, seqNumber, seqCount int, data string) []byte {
+	datagram := append([]byte{}, chunkMagic...)
+	datagram = append(datagram, id, 0, 0, 0, 0, 0, 0, 0, byte(seqNumber), byte(seqCount))
+	return append(datagram, data...)
+}
+
+func TestAssembler(t *testing.T) {
+	assembler := NewAssembler(time.Minute, 10, 1024)
+
+	payload, err := assembler.Add([]byte(`{"short_message":"not chunked"}`))
+	if err != nil || string(payload) != `{"short_message":"not chunked"}` {
+		t.Errorf("got %q, %v for a message which isn't chunked", payload, err)
+	}
+
+	// Chunks of two messages, interleaved, out of order and repeated
+	datagrams := [][]byte{
+		chunk(1, 2, 3, "c"),
+		chunk(2, 1, 2, "y"),
+		chunk(1, 0, 3, "a"),
+		chunk(1, 0, 3, "a"),
+		chunk(2, 0, 2, "x"),
+		chunk(1, 1, 3, "b"),
+	}
+	var messages []string
+	for _, datagram := range datagrams {
+		payload, err := assembler.Add(datagram)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if payload != nil {
+			messages = append(messages, string(payload))
+		}
+		// The buffer of the datagram is reused
+		for i := range datagram {
+			datagram[i] = 0
+		}
+	}
+	if len(messages) != 2 || messages[0] != "xy" || messages[1] != "abc" {
+		t.Errorf("got messages %q", messages)
+	}
+	if len(assembler.messages) != 0 {
+		t.Errorf("%d messages are still pending", len(assembler.messages))
+	}
+}
+
+func TestAssemblerMalformed(t *testing.T) {
+	assembler := NewAssembler(time.Minute, 10, 1024)
+
+	tests := []struct {
+		name     string
+		datagram []byte
+	}{
+		{"truncated header", chunk(1, 0, 2, "")[:8]},
+		{"no chunks", chunk(1, 0, 0, "a")},
+		{"too many chunks", chunk(1, 0, maxChunks+1, "a")},
+		{"sequence number out of range", chunk(1, 2, 2, "a")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if payload, err := assembler.Add(test.datagram); err == nil {
+				t.Errorf("expected an error, got %q", payload)
+			}
+		})
+	}
+
+	// The message is dropped when the chunks don't agree on their count
+	if _, err := assembler.Add(chunk(2, 0, 3, "a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := assembler.Add(chunk(2, 1, 2, "b")); err == nil {
+		t.Error("expected an error for an inconsistent count")
+	}
+	if len(assembler.messages) != 0 {
+		t.Errorf("%d messages are still pending", len(assembler.messages))
+	}
+}
+
+func TestAssemblerExpiry(t *testing.T) {
+	assembler := NewAssembler(10*time.Millisecond, 10, 1024)
+
+	if _, err := assembler.Add(chunk(1, 0, 2, "a")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	payload, err := assembler.Add(chunk(1, 1, 2, "b"))
+	if err != nil || payload != nil {
+		t.Errorf("got %q, %v, the first chunk should have expired", payload, err)
+	}
+}
+
+func TestAssemblerLimits(t *testing.T) {
+	assembler := NewAssembler(time.Minute, 2, 10)
+
+	// A message can't be started once the maximum number of incomplete messages is reached
+	for id := byte(1); id <= 2; id++ {
+		if _, err := assembler.Add(chunk(id, 0, 2, "a")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if _, err := assembler.Add(chunk(3, 0, 2, "a")); err != ErrTooManyPending {
+		t.Errorf("got error %v, want %v", err, ErrTooManyPending)
+	}
+	// The ones which were started can still be completed, which makes room for another one
+	if payload, err := assembler.Add(chunk(1, 1, 2, "b")); err != nil || string(payload) != "ab" {
+		t.Errorf("got %q, %v", payload, err)
+	}
+	if _, err := assembler.Add(chunk(3, 0, 2, "a")); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// A message whose chunks don't fit in the buffered bytes is dropped
+	if _, err := assembler.Add(chunk(3, 1, 2, "123456789")); err != ErrTooManyPending {
+		t.Errorf("got error %v, want %v", err, ErrTooManyPending)
+	}
+	if len(assembler.messages) != 1 || assembler.size != 1 {
+		t.Errorf("got %d messages of %d bytes", len(assembler.messages), assembler.size)
+	}
+	if payload, err := assembler.Add(chunk(2, 1, 2, "12345678")); err != nil || string(payload) != "a12345678" {
+		t.Errorf("got %q, %v", payload, err)
+	}
+	if len(assembler.messages) != 0 || assembler.size != 0 {
+		t.Errorf("got %d messages of %d bytes", len(assembler.messages), assembler.size)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	message := []byte(`{"short_message":"compressed"}`)
+
+	var gzipped, zlibbed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write(message) // nolint: errcheck
+	gzipWriter.Close()        // nolint: errcheck
+	zlibWriter := zlib.NewWriter(&zlibbed)
+	zlibWriter.Write(message) // nolint: errcheck
+	zlibWriter.Close()        // nolint: errcheck
+
+	for name, payload := range map[string][]byte{
+		"plain": message,
+		"gzip":  gzipped.Bytes(),
+		"zlib":  zlibbed.Bytes(),
+	} {
+		data, err := Decompress(payload, 1024)
+		if err != nil || !bytes.Equal(data, message) {
+			t.Errorf("%s: got %q, %v", name, data, err)
+		}
+	}
+
+	if data, err := Decompress(gzipped.Bytes(), 10); err == nil {
+		t.Errorf("expected an error for a message too big, got %q", data)
+	}
+	if data, err := Decompress(gzipped.Bytes()[:12], 1024); err == nil {
+		t.Errorf("expected an error for a truncated message, got %q", data)
+	}
+}
+
+func TestReader(t *testing.T) {
+	reader := NewReader(bytes.NewReader([]byte("first\x00second\n\x00\x00last")), 8)
+
+	for _, want := range []string{"first", "second", "", "last"} {
+		msg, err := reader.ReadMessage()
+		if err != nil || string(msg) != want {
+			t.Errorf("got %q, %v, want %q", msg, err, want)
+		}
+	}
+	if msg, err := reader.ReadMessage(); err == nil {
+		t.Errorf("expected the end of the stream, got %q", msg)
+	}
+
+	reader = NewReader(bytes.NewReader([]byte("a message too big\x00")), 8)
+	if msg, err := reader.ReadMessage(); err == nil {
+		t.Errorf("expected an error, got %q", msg)
+	}
+}
+
+func TestParse(t *testing.T) {
+	event, err := Parse([]byte(`{"version":"1.1","host":"h","short_message":"m","timestamp":1.5,"level":3,` +
+		`"_user":"u","_message":"ignored"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !event.Timestamp.Equal(time.Unix(1, 5e8)) {
+		t.Errorf("got timestamp %s", event.Timestamp)
+	}
+	attributes := event.Attributes
+	if attributes["message"] != "m" || attributes["hostname"] != "h" || attributes["user"] != "u" || len(attributes) != 3 {
+		t.Errorf("got attributes %v", attributes)
+	}
+
+	for _, invalid := range []string{`{"host":"h"}`, `not json`, `["short_message"]`} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
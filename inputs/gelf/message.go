@@ -0,0 +1,99 @@
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/inputs/syslog"
+)
+
+// Parse converts a GELF message ( https://docs.graylog.org/en/latest/pages/gelf.html ) to an event. The additional
+// fields lose their "_" prefix, the host becomes the "hostname" and the short message becomes the "message".
+func Parse(payload []byte) (*clients.LogEvent, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+
+	shortMessage, ok := fields["short_message"]
+	if !ok {
+		return nil, errors.New("missing short_message")
+	}
+
+	event := &clients.LogEvent{
+		Timestamp: time.Now(),
+		Severity:  clients.LvlInfo,
+		Attributes: map[string]interface{}{
+			"message": shortMessage,
+		},
+	}
+
+	if timestamp, ok := fields["timestamp"].(float64); ok {
+		sec, frac := math.Modf(timestamp)
+		event.Timestamp = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	if level, ok := fields["level"].(float64); ok {
+		event.Severity = syslog.SeverityLevel(int(level))
+	}
+	if host, ok := fields["host"]; ok {
+		event.Attributes["hostname"] = host
+	}
+
+	for key, value := range fields {
+		switch key {
+		case "version", "host", "short_message", "timestamp", "level":
+		default:
+			if strings.HasPrefix(key, "_") {
+				key = key[1:]
+				// The additional fields can't override the standard ones
+				if _, ok := event.Attributes[key]; ok {
+					continue
+				}
+			}
+			event.Attributes[key] = value
+		}
+	}
+
+	return event, nil
+}
+
+// Reader reads the null byte delimited messages of a TCP stream
+type Reader struct {
+	reader  *bufio.Reader
+	maxSize int
+}
+
+// NewReader creates a reader refusing messages bigger than maxSize
+func NewReader(r io.Reader, maxSize int) *Reader {
+	return &Reader{
+		reader:  bufio.NewReader(r),
+		maxSize: maxSize,
+	}
+}
+
+// ReadMessage returns the next message of the stream
+func (r *Reader) ReadMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		chunk, err := r.reader.ReadSlice(0)
+		if len(msg)+len(chunk) > r.maxSize {
+			return nil, fmt.Errorf("message is too big: more than %d bytes", r.maxSize)
+		}
+		msg = append(msg, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(msg) == 0) {
+			return nil, err
+		}
+		return bytes.TrimRight(msg, "\x00\n"), nil
+	}
+}
@@ -0,0 +1,80 @@
+package logstash
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const readBufferSize = 64 * 1024
+
+// OversizedError is returned for a line that was bigger than the maximum size and couldn't be truncated. The rest of
+// the stream can still be read.
+type OversizedError struct {
+	Size int // Size of the discarded line
+}
+
+func (e *OversizedError) Error() string {
+	return fmt.Sprintf("line of %d bytes is too big", e.Size)
+}
+
+// Reader reads newline delimited lines without buffering more than the maximum size of a line
+type Reader struct {
+	reader   *bufio.Reader
+	maxSize  int
+	truncate bool
+}
+
+// NewReader creates a reader. Lines bigger than maxSize are truncated if truncate is set, or discarded otherwise.
+func NewReader(r io.Reader, maxSize int, truncate bool) *Reader {
+	return &Reader{
+		reader:   bufio.NewReaderSize(r, readBufferSize),
+		maxSize:  maxSize,
+		truncate: truncate,
+	}
+}
+
+// ReadLine returns the next line, without its line ending. truncated is set if the line had to be truncated, and an
+// *OversizedError is returned if it had to be discarded.
+func (r *Reader) ReadLine() (line []byte, truncated bool, err error) {
+	var trunc *truncator
+	size := 0
+
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, false, err
+		}
+		size += len(chunk)
+
+		switch {
+		case trunc != nil:
+			trunc.write(chunk)
+		case size <= r.maxSize:
+			line = append(line, chunk...)
+		case r.truncate:
+			trunc = newTruncator(r.maxSize)
+			trunc.write(line)
+			trunc.write(chunk)
+			line = nil
+		default:
+			// The rest of the line is skipped
+			line = nil
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		if size <= r.maxSize {
+			return bytes.TrimRight(line, "\r\n"), false, nil
+		}
+		if trunc != nil {
+			if data, ok := trunc.bytes(); ok {
+				return data, true, nil
+			}
+		}
+		return nil, false, &OversizedError{Size: size}
+	}
+}
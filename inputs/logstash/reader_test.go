@@ -0,0 +1,144 @@
+package logstash
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	reader := NewReader(strings.NewReader("first\r\n\nsecond\nlast"), 16, false)
+
+	for _, want := range []string{"first", "", "second"} {
+		line, truncated, err := reader.ReadLine()
+		if err != nil || truncated || string(line) != want {
+			t.Errorf("got %q, %t, %v, want %q", line, truncated, err, want)
+		}
+	}
+	// A line which isn't terminated isn't complete
+	if line, _, err := reader.ReadLine(); err != io.EOF {
+		t.Errorf("got %q, %v, want the end of the stream", line, err)
+	}
+}
+
+func TestReadLineDiscarded(t *testing.T) {
+	long := strings.Repeat("x", 2*readBufferSize)
+	reader := NewReader(strings.NewReader("short\n"+long+"\nnext\n"), 100, false)
+
+	if line, _, err := reader.ReadLine(); err != nil || string(line) != "short" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	_, _, err := reader.ReadLine()
+	oversized, ok := err.(*OversizedError)
+	if !ok || oversized.Size != len(long)+1 {
+		t.Fatalf("got error %v, want an oversized line", err)
+	}
+	// The rest of the stream can still be read
+	if line, _, err := reader.ReadLine(); err != nil || string(line) != "next" {
+		t.Errorf("got %q, %v", line, err)
+	}
+}
+
+func TestReadLineTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		maxSize int
+		want    map[string]interface{}
+	}{
+		{
+			name:    "largest string trimmed",
+			line:    `{"message":"` + strings.Repeat("m", 200) + `","user":"u"}`,
+			maxSize: 100,
+			want:    map[string]interface{}{"message": strings.Repeat("m", 57), "user": "u", "truncated": true},
+		},
+		{
+			name:    "largest strings trimmed first",
+			line:    `{"a":"` + strings.Repeat("a", 100) + `","b":"` + strings.Repeat("b", 90) + `"}`,
+			maxSize: 80,
+			want: map[string]interface{}{
+				"a":         "",
+				"b":         strings.Repeat("b", 47),
+				"truncated": true,
+			},
+		},
+		{
+			name:    "escape sequences kept whole",
+			line:    `{"message":"` + strings.Repeat(`\u00e9`, 30) + `"}`,
+			maxSize: 60,
+			want:    map[string]interface{}{"message": strings.Repeat("é", 4), "truncated": true},
+		},
+		{
+			name:    "multi-byte characters kept whole",
+			line:    `{"message":"` + strings.Repeat("é", 60) + `"}`,
+			maxSize: 60,
+			want:    map[string]interface{}{"message": strings.Repeat("é", 14), "truncated": true},
+		},
+		{
+			name:    "escaped quotes",
+			line:    `{"message":"` + strings.Repeat(`\"`, 60) + `","n":1}`,
+			maxSize: 60,
+			want:    map[string]interface{}{"message": strings.Repeat(`"`, 11), "n": float64(1), "truncated": true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := NewReader(strings.NewReader(test.line+"\n"), test.maxSize, true)
+			line, truncated, err := reader.ReadLine()
+			if err != nil || !truncated {
+				t.Fatalf("got %q, %t, %v", line, truncated, err)
+			}
+			if len(line) > test.maxSize {
+				t.Errorf("the line is %d bytes long", len(line))
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal(line, &fields); err != nil {
+				t.Fatalf("invalid JSON %q: %s", line, err)
+			}
+			for key, want := range test.want {
+				if fields[key] != want {
+					t.Errorf("%s: got %v, want %v", key, fields[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadLineNotTruncatable(t *testing.T) {
+	// Without strings to trim, the line is discarded
+	line := `[` + strings.Repeat("1,", 100) + `1]`
+	reader := NewReader(strings.NewReader(line+"\nnext\n"), 50, true)
+
+	if _, _, err := reader.ReadLine(); err == nil {
+		t.Error("expected an oversized line")
+	} else if _, ok := err.(*OversizedError); !ok {
+		t.Errorf("got error %v, want an oversized line", err)
+	}
+	if next, _, err := reader.ReadLine(); err != nil || string(next) != "next" {
+		t.Errorf("got %q, %v", next, err)
+	}
+}
+
+func TestBoundary(t *testing.T) {
+	tests := []struct {
+		data string
+		n    int
+		want int
+	}{
+		{"abcdef", 3, 3},
+		{`ab\ncd`, 3, 2},
+		{`ab\ncd`, 4, 4},
+		{`a\u00e9b`, 5, 1},
+		{`a\u00e9b`, 7, 7},
+		{"aéb", 2, 1},
+		{"aéb", 3, 3},
+		{"abc", 10, 3},
+	}
+	for _, test := range tests {
+		if got := boundary([]byte(test.data), test.n); got != test.want {
+			t.Errorf("boundary(%q, %d) = %d, want %d", test.data, test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package logstash
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// truncatedMarker is added to the root object of the truncated lines
+const truncatedMarker = `,"truncated":true`
+
+// segment is a part of a line: either some JSON structure, or the content of a string (without its quotes)
+type segment struct {
+	data     []byte
+	isString bool
+	trimmed  bool // Content was removed, the rest of the string is skipped
+}
+
+// truncator shortens a JSON line while it's being read, by trimming its largest strings so that it never exceeds its
+// maximum size. The line stays parseable as long as it was valid JSON.
+type truncator struct {
+	segments []*segment
+	size     int
+	budget   int
+	inString bool
+	escaped  bool
+	failed   bool // The line couldn't fit in the budget even without its strings
+	trimmed  bool
+}
+
+func newTruncator(maxSize int) *truncator {
+	return &truncator{
+		segments: []*segment{{}},
+		budget:   maxSize - len(truncatedMarker),
+	}
+}
+
+func (t *truncator) write(chunk []byte) {
+	if t.failed {
+		return
+	}
+
+	for _, b := range chunk {
+		current := t.segments[len(t.segments)-1]
+
+		if !t.inString {
+			current.data = append(current.data, b)
+			t.size++
+			if b == '"' {
+				t.segments = append(t.segments, &segment{isString: true})
+				t.inString = true
+			}
+			continue
+		}
+
+		switch {
+		case t.escaped:
+			t.escaped = false
+		case b == '\\':
+			t.escaped = true
+		case b == '"':
+			t.segments = append(t.segments, &segment{data: []byte{'"'}})
+			t.size++
+			t.inString = false
+			continue
+		}
+		if !current.trimmed {
+			current.data = append(current.data, b)
+			t.size++
+		}
+	}
+
+	if t.size > t.budget && !t.trim() {
+		t.failed = true
+		t.segments = nil
+	}
+}
+
+// trim trims the largest strings until the line fits in the budget
+func (t *truncator) trim() bool {
+	for t.size > t.budget {
+		var largest *segment
+		for _, s := range t.segments {
+			if s.isString && len(s.data) > 0 && (largest == nil || len(s.data) > len(largest.data)) {
+				largest = s
+			}
+		}
+		if largest == nil {
+			return false
+		}
+
+		length := boundary(largest.data, len(largest.data)-(t.size-t.budget))
+		t.size -= len(largest.data) - length
+		largest.data = largest.data[:length]
+		largest.trimmed = true
+		t.trimmed = true
+	}
+	return true
+}
+
+// boundary returns the last position not after n that doesn't split an escape sequence or a UTF-8 character
+func boundary(data []byte, n int) int {
+	i := 0
+	for i < len(data) {
+		var width int
+		switch {
+		case data[i] == '\\' && i+1 < len(data) && data[i+1] == 'u':
+			width = 6
+		case data[i] == '\\':
+			width = 2
+		default:
+			_, width = utf8.DecodeRune(data[i:])
+		}
+		if i+width > n || i+width > len(data) {
+			break
+		}
+		i += width
+	}
+	return i
+}
+
+// bytes returns the truncated line, with a marker if some strings were trimmed
+func (t *truncator) bytes() ([]byte, bool) {
+	if t.failed {
+		return nil, false
+	}
+
+	line := make([]byte, 0, t.size+len(truncatedMarker))
+	for _, s := range t.segments {
+		line = append(line, s.data...)
+	}
+	line = bytes.TrimRight(line, " \t\r\n")
+
+	if t.trimmed && len(line) > 0 && line[len(line)-1] == '}' {
+		line = append(line[:len(line)-1], truncatedMarker+"}"...)
+	}
+	return line, true
+}
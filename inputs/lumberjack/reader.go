@@ -0,0 +1,227 @@
+package lumberjack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Frame types of the lumberjack protocol ( https://github.com/elastic/go-lumber )
+const (
+	VersionV1 = '1'
+	VersionV2 = '2'
+
+	frameWindowSize = 'W'
+	frameCompressed = 'C'
+	frameJSON       = 'J'
+	frameData       = 'D'
+	frameACK        = 'A'
+)
+
+// Batch is a window of events sent by the client, which has to be acknowledged as a whole
+type Batch struct {
+	Version byte                     // Protocol version used by the client
+	Events  []map[string]interface{} // Events of the window
+	LastSeq uint32                   // Sequence number to acknowledge
+}
+
+var errBatchTooBig = errors.New("window is too big")
+
+// Reader reads the batches of events sent by a lumberjack client
+type Reader struct {
+	reader        *bufio.Reader
+	maxEventSize  int
+	maxWindowSize int
+	maxBatchSize  int
+	batch         *Batch
+	windowSize    uint32
+	budget        int // Bytes the frames of the window can still take, compressed and decompressed
+}
+
+// NewReader creates a reader refusing events bigger than maxEventSize, windows of more than maxWindowSize events, and
+// windows whose frames take more than maxBatchSize bytes
+func NewReader(r io.Reader, maxEventSize, maxWindowSize, maxBatchSize int) *Reader {
+	return &Reader{
+		reader:        bufio.NewReader(r),
+		maxEventSize:  maxEventSize,
+		maxWindowSize: maxWindowSize,
+		maxBatchSize:  maxBatchSize,
+	}
+}
+
+// ReadBatch reads frames until a whole window of events has been received
+func (r *Reader) ReadBatch() (*Batch, error) {
+	r.batch = &Batch{}
+	r.windowSize = 0
+	r.budget = r.maxBatchSize
+	for r.windowSize == 0 || uint32(len(r.batch.Events)) < r.windowSize {
+		if err := r.readFrame(r.reader, false); err != nil {
+			if err == io.EOF && (r.windowSize != 0 || len(r.batch.Events) > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return r.batch, nil
+}
+
+// readFrame reads a frame, nested is set for the frames of a compressed frame
+func (r *Reader) readFrame(src io.Reader, nested bool) error {
+	var header [2]byte
+	if _, err := io.ReadFull(src, header[:]); err != nil {
+		return err
+	}
+	version, frameType := header[0], header[1]
+	if version != VersionV1 && version != VersionV2 {
+		return fmt.Errorf("unsupported protocol version %q", version)
+	}
+	r.batch.Version = version
+
+	switch frameType {
+	case frameWindowSize:
+		size, err := readUint32(src)
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return fmt.Errorf("invalid window size 0")
+		}
+		if size > uint32(r.maxWindowSize) {
+			return fmt.Errorf("window size %d is too big", size)
+		}
+		r.windowSize = size
+	case frameCompressed:
+		if nested {
+			return errors.New("nested compressed frame")
+		}
+		payload, err := r.readPayload(src, r.budget)
+		if err != nil {
+			return err
+		}
+		decompressor, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("invalid compressed frame: %s", err)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(decompressor, int64(r.budget)+1))
+		if err != nil {
+			return fmt.Errorf("invalid compressed frame: %s", err)
+		}
+		if r.budget -= len(data); r.budget < 0 {
+			return errBatchTooBig
+		}
+		inner := bytes.NewReader(data)
+		for inner.Len() > 0 {
+			if err := r.readFrame(inner, true); err != nil {
+				return err
+			}
+		}
+	case frameJSON:
+		seq, err := readUint32(src)
+		if err != nil {
+			return err
+		}
+		payload, err := r.readPayload(src, r.maxEventSize)
+		if err != nil {
+			return err
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return fmt.Errorf("invalid JSON frame: %s", err)
+		}
+		if err := r.addEvent(seq, event); err != nil {
+			return err
+		}
+	case frameData:
+		seq, err := readUint32(src)
+		if err != nil {
+			return err
+		}
+		event, err := r.readDataPairs(src)
+		if err != nil {
+			return err
+		}
+		if err := r.addEvent(seq, event); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported frame type %q", frameType)
+	}
+	return nil
+}
+
+func (r *Reader) addEvent(seq uint32, event map[string]interface{}) error {
+	// A compressed frame can hold more events than the window, and the window size may not have been sent yet
+	if len(r.batch.Events) >= r.maxWindowSize {
+		return fmt.Errorf("more than %d events in the window", r.maxWindowSize)
+	}
+	r.batch.Events = append(r.batch.Events, event)
+	r.batch.LastSeq = seq
+	return nil
+}
+
+// readDataPairs reads the key/value pairs of a (v1) data frame
+func (r *Reader) readDataPairs(src io.Reader) (map[string]interface{}, error) {
+	nbPairs, err := readUint32(src)
+	if err != nil {
+		return nil, err
+	}
+	event := make(map[string]interface{})
+	size := 0
+	for i := uint32(0); i < nbPairs; i++ {
+		key, err := r.readPayload(src, r.maxEventSize-size)
+		if err != nil {
+			return nil, err
+		}
+		size += len(key)
+		value, err := r.readPayload(src, r.maxEventSize-size)
+		if err != nil {
+			return nil, err
+		}
+		size += len(value)
+		event[string(key)] = string(value)
+	}
+	return event, nil
+}
+
+// WriteACK acknowledges all the events up to seq
+func WriteACK(w io.Writer, version byte, seq uint32) error {
+	frame := make([]byte, 6)
+	frame[0] = version
+	frame[1] = frameACK
+	binary.BigEndian.PutUint32(frame[2:], seq)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readUint32(src io.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(src, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// readPayload reads a payload of at most maxSize bytes, which is taken from the budget of the window
+func (r *Reader) readPayload(src io.Reader, maxSize int) ([]byte, error) {
+	size, err := readUint32(src)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize < 0 || size > uint32(maxSize) {
+		return nil, fmt.Errorf("frame is too big: %d bytes", size)
+	}
+	if r.budget -= int(size); r.budget < 0 {
+		return nil, errBatchTooBig
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(src, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,146 @@
+package lumberjack
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+func uint32Bytes(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func windowFrame(size int) []byte {
+	return append([]byte{VersionV2, frameWindowSize}, uint32Bytes(size)...)
+}
+
+func jsonFrame(seq int, event string) []byte {
+	frame := append([]byte{VersionV2, frameJSON}, uint32Bytes(seq)...)
+	frame = append(frame, uint32Bytes(len(event))...)
+	return append(frame, event...)
+}
+
+func dataFrame(seq int, pairs ...string) []byte {
+	frame := append([]byte{VersionV1, frameData}, uint32Bytes(seq)...)
+	frame = append(frame, uint32Bytes(len(pairs)/2)...)
+	for _, s := range pairs {
+		frame = append(frame, uint32Bytes(len(s))...)
+		frame = append(frame, s...)
+	}
+	return frame
+}
+
+func compressedFrame(frames ...[]byte) []byte {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	writer.Write(bytes.Join(frames, nil)) // nolint: errcheck
+	writer.Close()                        // nolint: errcheck
+	frame := append([]byte{VersionV2, frameCompressed}, uint32Bytes(compressed.Len())...)
+	return append(frame, compressed.Bytes()...)
+}
+
+func newTestReader(frames ...[]byte) *Reader {
+	return NewReader(bytes.NewReader(bytes.Join(frames, nil)), 1024, 10, 4096)
+}
+
+func TestReadBatch(t *testing.T) {
+	reader := newTestReader(
+		windowFrame(2),
+		jsonFrame(1, `{"message":"first"}`),
+		jsonFrame(2, `{"message":"second"}`),
+		windowFrame(3),
+		compressedFrame(jsonFrame(3, `{"message":"third"}`), jsonFrame(4, `{"message":"fourth"}`)),
+		dataFrame(5, "message", "fifth", "host", "h"),
+	)
+
+	batch, err := reader.ReadBatch()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(batch.Events) != 2 || batch.LastSeq != 2 || batch.Events[1]["message"] != "second" {
+		t.Errorf("unexpected first batch %+v", batch)
+	}
+
+	batch, err = reader.ReadBatch()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(batch.Events) != 3 || batch.LastSeq != 5 || batch.Events[0]["message"] != "third" {
+		t.Errorf("unexpected second batch %+v", batch)
+	}
+	if batch.Events[2]["message"] != "fifth" || batch.Events[2]["host"] != "h" {
+		t.Errorf("unexpected data frame event %v", batch.Events[2])
+	}
+
+	if _, err := reader.ReadBatch(); err != io.EOF {
+		t.Errorf("got error %v, want the end of the stream", err)
+	}
+}
+
+func TestReadBatchMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"unsupported version", [][]byte{{'3', frameWindowSize, 0, 0, 0, 1}}},
+		{"unsupported frame type", [][]byte{{VersionV2, 'X'}}},
+		{"window size 0", [][]byte{windowFrame(0)}},
+		{"window too big", [][]byte{windowFrame(11)}},
+		{"too many events", [][]byte{windowFrame(10), compressedFrame(bytes.Repeat(jsonFrame(1, `{}`), 11))}},
+		{"too many events without a window size", [][]byte{bytes.Repeat(jsonFrame(1, `{}`), 11)}},
+		{"event too big", [][]byte{windowFrame(1), jsonFrame(1, `{"message":"`+strings.Repeat("x", 1024)+`"}`)}},
+		{"data frame too big", [][]byte{windowFrame(1), dataFrame(1, "message", strings.Repeat("x", 1024))}},
+		{"invalid JSON", [][]byte{windowFrame(1), jsonFrame(1, `{"message"`)}},
+		{"invalid compressed frame", [][]byte{windowFrame(1), {VersionV2, frameCompressed, 0, 0, 0, 1, 0}}},
+		{"nested compressed frame", [][]byte{windowFrame(1), compressedFrame(compressedFrame(jsonFrame(1, `{}`)))}},
+		{"truncated window", [][]byte{windowFrame(2), jsonFrame(1, `{}`)}},
+		{"truncated frame", [][]byte{jsonFrame(1, `{}`)[:8]}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if batch, err := newTestReader(test.frames...).ReadBatch(); err == nil || err == io.EOF {
+				t.Errorf("got %+v, %v, expected an error", batch, err)
+			}
+		})
+	}
+}
+
+func TestReadBatchBudget(t *testing.T) {
+	event := jsonFrame(1, `{"message":"`+strings.Repeat("x", 500)+`"}`)
+
+	// The events of a window share the budget
+	reader := newTestReader(append(windowFrame(10), bytes.Repeat(event, 10)...))
+	if _, err := reader.ReadBatch(); err != errBatchTooBig {
+		t.Errorf("got error %v, want %v", err, errBatchTooBig)
+	}
+
+	// Highly compressed frames count for their decompressed size
+	reader = newTestReader(windowFrame(10), compressedFrame(bytes.Repeat(event, 9)))
+	if _, err := reader.ReadBatch(); err != errBatchTooBig {
+		t.Errorf("got error %v, want %v", err, errBatchTooBig)
+	}
+
+	// The budget is reset for each window
+	reader = newTestReader(windowFrame(3), event, event, event, windowFrame(3), event, event, event)
+	for i := 0; i < 2; i++ {
+		if _, err := reader.ReadBatch(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+}
+
+func TestWriteACK(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteACK(&buf, VersionV2, 258); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{VersionV2, frameACK, 0, 0, 1, 2}) {
+		t.Errorf("got %v", buf.Bytes())
+	}
+}
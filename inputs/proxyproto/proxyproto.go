@@ -0,0 +1,282 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This implements the receiving side of the PROXY protocol, versions 1 and 2
+// ( https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt )
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener reads the PROXY protocol header of the connections coming from trusted upstreams. The connections coming
+// from anywhere else are returned as is, so that their clients can't spoof their address.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// NewListener wraps a listener, the header has to be received within timeout
+func NewListener(listener net.Listener, trusted []*net.IPNet, timeout time.Duration) *Listener {
+	return &Listener{
+		Listener: listener,
+		trusted:  trusted,
+		timeout:  timeout,
+	}
+}
+
+// Accept waits for the next connection, its header is only read once the connection is used
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.timeout,
+	}, nil
+}
+
+func (l *Listener) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses a list of networks, plain IPs are accepted as single address networks
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %s", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Conn is a connection coming from a trusted upstream. The header is read before the first read or the first call to
+// RemoteAddr, which is the address of the original client when the upstream provided it.
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+
+	lock          sync.Mutex
+	readDeadline  time.Time // Set by the caller, it's restored once the header is read
+	readingHeader bool
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the original client
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, it only applies once the header is read if it's being read
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	if c.readingHeader {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) readHeader() {
+	// The header has to be received within the timeout, or before the deadline of the caller if it's earlier
+	c.lock.Lock()
+	c.readingHeader = true
+	deadline := time.Now().Add(c.timeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+		deadline = c.readDeadline
+	}
+	err := c.Conn.SetReadDeadline(deadline)
+	c.lock.Unlock()
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	c.remoteAddr, c.err = c.parseHeader()
+	if c.err != nil {
+		c.err = fmt.Errorf("invalid PROXY protocol header: %s", c.err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readingHeader = false
+	if err := c.Conn.SetReadDeadline(c.readDeadline); err != nil && c.err == nil {
+		c.err = err
+	}
+}
+
+// parseHeader reads the header if there's one. The upstream may connect without it (health checks for instance).
+func (c *Conn) parseHeader() (net.Addr, error) {
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return nil, ignoreEOF(err)
+	}
+
+	switch first[0] {
+	case v1Prefix[0]:
+		if prefix, err := c.reader.Peek(len(v1Prefix)); err != nil || string(prefix) != v1Prefix {
+			return nil, ignoreEOF(err)
+		}
+		return c.parseV1()
+	case v2Signature[0]:
+		if signature, err := c.reader.Peek(len(v2Signature)); err != nil || !bytes.Equal(signature, v2Signature) {
+			return nil, ignoreEOF(err)
+		}
+		return c.parseV2()
+	}
+	return nil, nil
+}
+
+// parseV1 parses a "PROXY TCP4 SRC_IP DST_IP SRC_PORT DST_PORT\r\n" line
+func (c *Conn) parseV1() (net.Addr, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if len(line) > v1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid v1 line")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 line %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source IP %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %s", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseV2 parses the binary header: signature, version and command, family, length and addresses
+func (c *Conn) parseV2() (net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+
+	addresses := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, addresses); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL: the connection was established by the upstream itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", versionCommand&0x0f)
+	}
+
+	// Only the source address of TCP connections is used, the TLVs following the addresses are ignored
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errors.New("truncated IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errors.New("truncated IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:]))}, nil
+	}
+	return nil, nil
+}
+
+func ignoreEOF(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
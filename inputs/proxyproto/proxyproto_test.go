@@ -0,0 +1,204 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newConn returns the server side of a connection from a trusted upstream which sent data
+func newConn(t *testing.T, data []byte) *Conn {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close() // nolint: errcheck
+		client.Close() // nolint: errcheck
+	})
+	go func() {
+		client.Write(data) // nolint: errcheck
+		client.Close()     // nolint: errcheck
+	}()
+	return &Conn{
+		Conn:    server,
+		reader:  bufio.NewReader(server),
+		timeout: time.Second,
+	}
+}
+
+func v2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x01, 0xbb)
+
+	tests := []struct {
+		name string
+		data []byte
+		addr string // Empty if the address of the upstream is kept
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\nline"), "192.0.2.1:12345"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\nline"), "[2001:db8::1]:12345"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\nline"), ""},
+		{"v2 TCP over IPv4", append(v2Header(0x1, 0x11, ipv4), "line"...), "192.0.2.1:12345"},
+		{"v2 TCP over IPv6", append(v2Header(0x1, 0x21, ipv6), "line"...), "[2001:db8::1]:12345"},
+		{"v2 with TLVs", append(v2Header(0x1, 0x11, append(ipv4, 0x01, 0x00, 0x01, 'h')), "line"...), "192.0.2.1:12345"},
+		{"v2 LOCAL", append(v2Header(0x0, 0x00, nil), "line"...), ""},
+		{"v2 UDP", append(v2Header(0x1, 0x12, ipv4), "line"...), ""},
+		{"without header", []byte("line"), ""},
+		{"looking like a header", []byte("PROXline"), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newConn(t, test.data)
+			want := test.addr
+			if want == "" {
+				want = conn.Conn.RemoteAddr().String()
+			}
+			if addr := conn.RemoteAddr().String(); addr != want {
+				t.Errorf("got address %s, want %s", addr, want)
+			}
+			rest, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.HasSuffix(rest, []byte("line")) {
+				t.Errorf("unexpected data %q", rest)
+			}
+		})
+	}
+}
+
+func TestMalformedHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"v1 without CRLF", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n")},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1")},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n")},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 12345 443\r\n")},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1 198.51.100.1\r\n")},
+		{"v1 invalid IP", []byte("PROXY TCP4 192.0.2 198.51.100.1 12345 443\r\n")},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 123456 443\r\n")},
+		{"v2 unsupported version", append(append([]byte{}, v2Signature...), 0x11, 0x11, 0, 0)},
+		{"v2 unsupported command", v2Header(0x2, 0x11, ipv4)},
+		{"v2 truncated header", append(append([]byte{}, v2Signature...), 0x21)},
+		{"v2 truncated addresses", v2Header(0x1, 0x11, ipv4)[:20]},
+		{"v2 short IPv4 addresses", v2Header(0x1, 0x11, ipv4[:8])},
+		{"v2 short IPv6 addresses", v2Header(0x1, 0x21, ipv4)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newConn(t, test.data)
+			if _, err := conn.Read(make([]byte, 16)); err == nil || !strings.HasPrefix(err.Error(), "invalid PROXY protocol header") {
+				t.Errorf("got error %v, want an invalid header", err)
+			}
+		})
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close() // nolint: errcheck
+	defer client.Close() // nolint: errcheck
+
+	conn := &Conn{Conn: server, reader: bufio.NewReader(server), timeout: 10 * time.Millisecond}
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Error("expected a timeout")
+	}
+}
+
+func TestCallerDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close() // nolint: errcheck
+	defer client.Close() // nolint: errcheck
+
+	conn := &Conn{Conn: server, reader: bufio.NewReader(server), timeout: time.Second}
+	if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte("PROXY UNKNOWN\r\n")) // nolint: errcheck
+
+	// The deadline of the caller still applies once the header is read
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 16))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the read timed out after %s", elapsed)
+	}
+}
+
+func TestListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen: %s", err)
+	}
+	defer tcp.Close() // nolint: errcheck
+
+	for _, test := range []struct {
+		trusted string
+		addr    string
+	}{
+		{"127.0.0.1", "192.0.2.1:12345"},
+		{"192.0.2.0/24", ""}, // The header isn't read
+	} {
+		trusted, err := ParseCIDRs([]string{test.trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := NewListener(tcp, trusted, time.Second)
+
+		client, err := net.Dial("tcp", tcp.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n")) // nolint: errcheck
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := test.addr
+		if want == "" {
+			want = client.LocalAddr().String()
+		}
+		if addr := conn.RemoteAddr().String(); addr != want {
+			t.Errorf("trusting %s: got address %s, want %s", test.trusted, addr, want)
+		}
+		client.Close() // nolint: errcheck
+		conn.Close()   // nolint: errcheck
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := ParseCIDRs([]string{"10.0.0.0/8", " 192.0.2.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"}
+	for i, network := range networks {
+		if network.String() != want[i] {
+			t.Errorf("got %s, want %s", network, want[i])
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0", "10.0.0.0/33"} {
+		if _, err := ParseCIDRs([]string{invalid}); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
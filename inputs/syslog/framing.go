@@ -0,0 +1,76 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Reader reads the messages of a TCP stream, framed either with octet counting ("LEN MSG", RFC 6587) or with newlines
+type Reader struct {
+	reader  *bufio.Reader
+	maxSize int
+}
+
+// NewReader creates a reader refusing messages bigger than maxSize
+func NewReader(r io.Reader, maxSize int) *Reader {
+	return &Reader{
+		reader:  bufio.NewReader(r),
+		maxSize: maxSize,
+	}
+}
+
+// ReadMessage returns the next message of the stream
+func (r *Reader) ReadMessage() ([]byte, error) {
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '1' && first[0] <= '9' {
+		return r.readOctetCounted()
+	}
+	return r.readLine()
+}
+
+func (r *Reader) readOctetCounted() ([]byte, error) {
+	lengthRaw, err := r.reader.ReadSlice(' ')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("invalid octet count")
+		}
+		return nil, err
+	}
+	length, err := strconv.Atoi(string(lengthRaw[:len(lengthRaw)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid octet count: %s", err)
+	}
+	if length > r.maxSize {
+		return nil, fmt.Errorf("message is too big: %d bytes", length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (r *Reader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > r.maxSize {
+			return nil, fmt.Errorf("message is too big: more than %d bytes", r.maxSize)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
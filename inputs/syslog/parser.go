@@ -0,0 +1,263 @@
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// Message is a parsed syslog message
+type Message struct {
+	Facility       int
+	Severity       int
+	Timestamp      time.Time // Zero if the message doesn't have a (valid) timestamp
+	Hostname       string
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData map[string]map[string]string // Parameters of each SD-ID (RFC 5424 only)
+	Message        string
+}
+
+// nolint
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// FacilityName returns the name of the facility of the message
+func (m *Message) FacilityName() string {
+	if m.Facility < len(facilityNames) {
+		return facilityNames[m.Facility]
+	}
+	return strconv.Itoa(m.Facility)
+}
+
+// SeverityLevel converts a syslog severity (0 is emergency, 7 is debug) to a level
+func SeverityLevel(severity int) clients.Level {
+	switch {
+	case severity <= 2: // emergency, alert, critical
+		return clients.LvlCritical
+	case severity == 3:
+		return clients.LvlError
+	case severity == 4:
+		return clients.LvlWarning
+	case severity <= 6: // notice, informational
+		return clients.LvlInfo
+	default:
+		return clients.LvlDebug
+	}
+}
+
+const nilValue = "-"
+
+var errTruncated = errors.New("truncated message")
+
+// Parse parses a RFC 5424 or a RFC 3164 message
+func Parse(data []byte) (*Message, error) {
+	data = bytes.TrimRight(data, "\r\n\x00")
+
+	msg := &Message{}
+	rest, err := msg.parsePriority(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) >= 2 && rest[0] == '1' && rest[1] == ' ' {
+		err = msg.parseRFC5424(rest[2:])
+	} else {
+		msg.parseRFC3164(rest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (m *Message) parsePriority(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != '<' {
+		return nil, errors.New("missing priority")
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return nil, errors.New("invalid priority")
+	}
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri > 191 {
+		return nil, errors.New("invalid priority")
+	}
+	m.Facility = pri / 8
+	m.Severity = pri % 8
+	return data[end+1:], nil
+}
+
+// parseRFC5424 parses what follows the version: TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func (m *Message) parseRFC5424(data []byte) error {
+	var fields [5]string
+	for i := range fields {
+		end := bytes.IndexByte(data, ' ')
+		if end < 0 {
+			return errTruncated
+		}
+		fields[i] = string(data[:end])
+		data = data[end+1:]
+	}
+
+	if fields[0] != nilValue {
+		timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid timestamp: %s", err)
+		}
+		m.Timestamp = timestamp
+	}
+	m.Hostname = nilToEmpty(fields[1])
+	m.AppName = nilToEmpty(fields[2])
+	m.ProcID = nilToEmpty(fields[3])
+	m.MsgID = nilToEmpty(fields[4])
+
+	rest, err := m.parseStructuredData(data)
+	if err != nil {
+		return err
+	}
+
+	if len(rest) > 0 {
+		if rest[0] != ' ' {
+			return errors.New("missing space after structured data")
+		}
+		m.Message = string(bytes.TrimPrefix(rest[1:], []byte("\xef\xbb\xbf"))) // Removing the UTF-8 BOM
+	}
+
+	return nil
+}
+
+func (m *Message) parseStructuredData(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errTruncated
+	}
+	if data[0] == '-' {
+		return data[1:], nil
+	}
+
+	for len(data) > 0 && data[0] == '[' {
+		end := bytes.IndexAny(data, " ]")
+		if end < 0 {
+			return nil, errTruncated
+		}
+		id := string(data[1:end])
+		params := make(map[string]string)
+		data = data[end:]
+
+		for len(data) > 0 && data[0] == ' ' {
+			data = data[1:]
+			eq := bytes.IndexByte(data, '=')
+			if eq < 0 || len(data) < eq+2 || data[eq+1] != '"' {
+				return nil, fmt.Errorf("invalid structured data parameter in %s", id)
+			}
+			name := string(data[:eq])
+			value, rest, err := parseParamValue(data[eq+2:])
+			if err != nil {
+				return nil, err
+			}
+			params[name] = value
+			data = rest
+		}
+
+		if len(data) == 0 || data[0] != ']' {
+			return nil, errTruncated
+		}
+		data = data[1:]
+
+		if m.StructuredData == nil {
+			m.StructuredData = make(map[string]map[string]string)
+		}
+		m.StructuredData[id] = params
+	}
+
+	return data, nil
+}
+
+// parseParamValue reads a quoted parameter value, in which '"', '\' and ']' are escaped by a '\'
+func parseParamValue(data []byte) (string, []byte, error) {
+	var value strings.Builder
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			if i+1 < len(data) && (data[i+1] == '"' || data[i+1] == '\\' || data[i+1] == ']') {
+				i++
+			}
+			value.WriteByte(data[i])
+		case '"':
+			return value.String(), data[i+1:], nil
+		default:
+			value.WriteByte(data[i])
+		}
+	}
+	return "", nil, errTruncated
+}
+
+// parseRFC3164 parses what follows the priority: TIMESTAMP HOSTNAME TAG[PID]: MSG
+// As this format is loosely followed, anything that can't be parsed ends up in the message.
+func (m *Message) parseRFC3164(data []byte) {
+	const stampLayout = "Jan _2 15:04:05"
+
+	if len(data) > len(stampLayout) && data[len(stampLayout)] == ' ' {
+		if timestamp, err := time.ParseInLocation(stampLayout, string(data[:len(stampLayout)]), time.Local); err == nil {
+			now := time.Now()
+			timestamp = timestamp.AddDate(now.Year(), 0, 0)
+			// Messages sent just before the new year
+			if timestamp.After(now.Add(24 * time.Hour)) {
+				timestamp = timestamp.AddDate(-1, 0, 0)
+			}
+			m.Timestamp = timestamp
+			data = data[len(stampLayout)+1:]
+
+			if end := bytes.IndexByte(data, ' '); end > 0 {
+				m.Hostname = string(data[:end])
+				data = data[end+1:]
+			}
+		}
+	}
+
+	// The tag is made of at most 32 alphanumeric characters
+	tagEnd := 0
+	for tagEnd < len(data) && tagEnd < 32 && isTagChar(data[tagEnd]) {
+		tagEnd++
+	}
+	if tagEnd > 0 && tagEnd < len(data) && (data[tagEnd] == ':' || data[tagEnd] == '[') {
+		tag := string(data[:tagEnd])
+		rest := data[tagEnd:]
+		procID := ""
+		if rest[0] == '[' {
+			if end := bytes.IndexByte(rest, ']'); end > 0 {
+				procID = string(rest[1:end])
+				rest = rest[end+1:]
+			}
+		}
+		if len(rest) > 0 && rest[0] == ':' {
+			m.AppName = tag
+			m.ProcID = procID
+			data = bytes.TrimPrefix(rest[1:], []byte(" "))
+		}
+	}
+
+	// RFC 3164 doesn't define any encoding
+	m.Message = strings.ToValidUTF8(string(data), "\uFFFD")
+}
+
+func isTagChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '/'
+}
+
+func nilToEmpty(value string) string {
+	if value == nilValue {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,183 @@
+package syslog
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+func TestParseRFC5424(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Message
+	}{
+		{
+			name: "full",
+			data: `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 12 ID47 ` +
+				`[exampleSDID@32473 iut="3" eventSource="Application"] ` + "\xef\xbb\xbf" + `An application event`,
+			want: Message{
+				Facility:  20,
+				Severity:  5,
+				Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				Hostname:  "mymachine.example.com",
+				AppName:   "evntslog",
+				ProcID:    "12",
+				MsgID:     "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": "Application"},
+				},
+				Message: "An application event",
+			},
+		},
+		{
+			name: "nil values",
+			data: "<34>1 - - - - - -",
+			want: Message{Facility: 4, Severity: 2},
+		},
+		{
+			name: "without message",
+			data: "<34>1 - host app - - [a][b x=\"y\"]\r\n",
+			want: Message{
+				Facility:       4,
+				Severity:       2,
+				Hostname:       "host",
+				AppName:        "app",
+				StructuredData: map[string]map[string]string{"a": {}, "b": {"x": "y"}},
+			},
+		},
+		{
+			name: "escaped parameter values",
+			data: `<14>1 - - - - - [id a="q\"b\\s\]e\x"] msg`,
+			want: Message{
+				Facility:       1,
+				Severity:       6,
+				StructuredData: map[string]map[string]string{"id": {"a": `q"b\s]e\x`}},
+				Message:        "msg",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := Parse([]byte(test.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(*msg, test.want) {
+				t.Errorf("got %+v, want %+v", *msg, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRFC3164(t *testing.T) {
+	now := time.Now()
+	stamp := time.Date(now.Year(), now.Month(), now.Day(), 10, 5, 3, 0, time.Local)
+
+	tests := []struct {
+		name    string
+		data    string
+		want    Message
+		noStamp bool
+	}{
+		{
+			name: "full",
+			data: "<13>" + stamp.Format(time.Stamp) + " host sshd[123]: accepted key",
+			want: Message{Facility: 1, Severity: 5, Hostname: "host", AppName: "sshd", ProcID: "123", Message: "accepted key"},
+		},
+		{
+			name:    "without timestamp",
+			data:    "<13>app: hello",
+			want:    Message{Facility: 1, Severity: 5, AppName: "app", Message: "hello"},
+			noStamp: true,
+		},
+		{
+			name:    "without tag",
+			data:    "<13>just a message",
+			want:    Message{Facility: 1, Severity: 5, Message: "just a message"},
+			noStamp: true,
+		},
+		{
+			name:    "longest tag",
+			data:    "<13>" + strings.Repeat("a", 32) + ": hello",
+			want:    Message{Facility: 1, Severity: 5, AppName: strings.Repeat("a", 32), Message: "hello"},
+			noStamp: true,
+		},
+		{
+			name:    "tag too long",
+			data:    "<13>" + strings.Repeat("a", 33) + ": hello",
+			want:    Message{Facility: 1, Severity: 5, Message: strings.Repeat("a", 33) + ": hello"},
+			noStamp: true,
+		},
+		{
+			name:    "invalid UTF-8",
+			data:    "<13>app: \xff",
+			want:    Message{Facility: 1, Severity: 5, AppName: "app", Message: "�"},
+			noStamp: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := Parse([]byte(test.data))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !test.noStamp {
+				if !msg.Timestamp.Equal(stamp) {
+					t.Errorf("got timestamp %s, want %s", msg.Timestamp, stamp)
+				}
+				msg.Timestamp = time.Time{}
+			}
+			if !reflect.DeepEqual(*msg, test.want) {
+				t.Errorf("got %+v, want %+v", *msg, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"missing priority", "hello"},
+		{"unterminated priority", "<13"},
+		{"empty priority", "<>1 - - - - - -"},
+		{"priority too long", "<1234>hello"},
+		{"priority out of range", "<192>hello"},
+		{"non numeric priority", "<a1>hello"},
+		{"truncated header", "<13>1 - host app"},
+		{"invalid timestamp", "<13>1 yesterday - - - - -"},
+		{"missing structured data", "<13>1 - - - - - "},
+		{"unterminated structured data", "<13>1 - - - - - [id"},
+		{"unterminated parameter", `<13>1 - - - - - [id a="b]`},
+		{"unquoted parameter", "<13>1 - - - - - [id a=b]"},
+		{"missing space before message", "<13>1 - - - - - [id]msg"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if msg, err := Parse([]byte(test.data)); err == nil {
+				t.Errorf("expected an error, got %+v", *msg)
+			}
+		})
+	}
+}
+
+func TestSeverityLevel(t *testing.T) {
+	levels := []clients.Level{
+		clients.LvlCritical, clients.LvlCritical, clients.LvlCritical, clients.LvlError,
+		clients.LvlWarning, clients.LvlInfo, clients.LvlInfo, clients.LvlDebug,
+	}
+	for severity, want := range levels {
+		if got := SeverityLevel(severity); got != want {
+			t.Errorf("severity %d: got %d, want %d", severity, got, want)
+		}
+	}
+}
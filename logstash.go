@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// https://www.scalyr.com/help/parsing-logs#specialAttrs
+// nolint
+var severityConversions = map[string]clients.Level{
+	"finest":    clients.LvlFinest,
+	"finer":     clients.LvlTrace,
+	"trace":     clients.LvlTrace,
+	"fine":      clients.LvlDebug,
+	"debug":     clients.LvlDebug,
+	"info":      clients.LvlInfo,
+	"notice":    clients.LvlInfo,
+	"warn":      clients.LvlWarning,
+	"warning":   clients.LvlWarning,
+	"error":     clients.LvlError,
+	"fatal":     clients.LvlCritical,
+	"emerg":     clients.LvlCritical,
+	"emergency": clients.LvlCritical,
+	"crit":      clients.LvlCritical,
+	"critical":  clients.LvlCritical,
+	"panic":     clients.LvlCritical,
+	"alert":     clients.LvlCritical,
+	//"i":         LvlInfo,
+	//"w":         LvlWarning,
+	//"err":       LvlError,
+	//"e":         LvlError,
+	//"f":         LvlCritical,
+}
+
+// malformedLineError is returned for lines that couldn't be decoded
+type malformedLineError struct {
+	line            string          // Line without its auth prefix
+	tenant          *clients.Tenant // Tenant of the auth prefix
+	unauthenticated bool            // The auth key couldn't be checked, the line must not be forwarded
+	err             error
+}
+
+func (e *malformedLineError) Error() string {
+	return e.err.Error()
+}
+
+// malformedEvent applies the malformed line policy to a line that couldn't be decoded. It returns the event to
+// forward, or nil if the line shouldn't be forwarded.
+func (srv *Server) malformedEvent(addr net.Addr, malformed *malformedLineError) *clients.LogEvent {
+	policy := srv.config.MalformedLinePolicy
+	if malformed.unauthenticated && policy == "wrap" {
+		policy = "drop"
+	}
+	malformedLines.Inc(policy)
+	switch policy {
+	case "wrap":
+		return &clients.LogEvent{
+			Timestamp: time.Now(),
+			Severity:  clients.LvlInfo,
+			Attributes: map[string]interface{}{
+				"message":     malformed.line,
+				"parse_error": true,
+			},
+			Tenant: malformed.tenant,
+		}
+	case "deadletter":
+		if err := srv.deadLetters.write(addr, malformed.line, malformed.err); err != nil {
+			srv.log.Errorw("Couldn't write dead letter", "remoteAddr", addr, "line", malformed.line, "err", err)
+		}
+	default: // drop
+		srv.log.Debugw("Dropping malformed line", "remoteAddr", addr, "line", malformed.line, "err", malformed.err)
+	}
+	return nil
+}
+
+// parseLogstashLine checks the authentication of a logstash line and converts it to an event
+func (srv *Server) parseLogstashLine(line string, authenticated bool) (*clients.LogEvent, error) {
+	var lineJSON map[string]interface{}
+	var tenant *clients.Tenant
+
+	if srv.prefixAuth() {
+		// Trusted clients might still send a prefix, to choose their tenant
+		spl := strings.SplitN(line, " ", 2)
+		if len(spl) == 2 {
+			if t, ok := srv.tokenTenant(srv.config.LogstashAuthPrefixToken, spl[0]); ok {
+				tenant, authenticated, line = t, true, spl[1]
+			} else if !authenticated {
+				return nil, errors.New("wrong auth prefix token authentication")
+			}
+		} else if !authenticated {
+			return nil, errors.New("you need to have an auth prefix")
+		}
+	}
+
+	if err := json.Unmarshal([]byte(line), &lineJSON); err != nil {
+		// Without the JSON, the authentication key can't be checked
+		return nil, &malformedLineError{
+			line:            strings.TrimRight(line, "\r\n"),
+			tenant:          tenant,
+			unauthenticated: !authenticated && srv.config.LogstashAuthKey != "",
+			err:             err,
+		}
+	}
+
+	event, err := srv.logstashEvent(lineJSON, authenticated)
+	if err != nil {
+		return nil, err
+	}
+	if tenant != nil {
+		event.Tenant = tenant
+	}
+	return event, nil
+}
+
+// logstashEvent checks the authentication of a decoded logstash event and converts it
+func (srv *Server) logstashEvent(lineJSON map[string]interface{}, authenticated bool) (*clients.LogEvent, error) {
+	var tenant *clients.Tenant
+
+	// Checking authentication if required
+	if key := srv.config.LogstashAuthKey; key != "" {
+		value, ok := lineJSON[key].(string)
+		if t, valid := srv.tokenTenant(srv.config.LogstashAuthValue, value); ok && valid {
+			tenant = t
+		} else if !authenticated {
+			return nil, fmt.Errorf("wrong authentication with key %s", key)
+		}
+		// Trusted clients might still send the shared secret, it shouldn't be forwarded
+		delete(lineJSON, key)
+	}
+
+	event := &clients.LogEvent{
+		Timestamp:  time.Now(),
+		Attributes: lineJSON,
+		Tenant:     tenant,
+	}
+	// Fetching the timestamp
+	if strTs, ok := event.Attributes["@timestamp"].(string); ok {
+		if timestamp, err := time.Parse(time.RFC3339Nano, strTs); err == nil {
+			event.Timestamp = timestamp
+			delete(event.Attributes, "@timestamp")
+		}
+	}
+
+	// We copy the extra fields to the root (otherwise, scalyr will index them as big chunk of a JSON string)
+	if fields, ok := event.Attributes["@fields"]; ok {
+		if fields, ok := fields.(map[string]interface{}); ok {
+			for k, v := range fields {
+				if _, ok := event.Attributes[k]; !ok {
+					event.Attributes[k] = v
+				}
+			}
+		}
+		delete(event.Attributes, "@fields")
+	}
+
+	if value, ok := event.Attributes["@message"]; ok {
+		event.Attributes["message"] = value
+		delete(event.Attributes, "@message")
+	}
+
+	{ // Fetching the loglevel
+		var levelName string
+		var level clients.Level
+		var ok bool
+		for _, keyName := range []string{"levelName", "levelname"} {
+			if levelName, ok = event.Attributes[keyName].(string); ok {
+				delete(event.Attributes, keyName)
+			}
+		}
+		if ok {
+			if level, ok = severityConversions[strings.ToLower(levelName)]; ok {
+				event.Severity = level
+			}
+		}
+		if !ok {
+			event.Severity = clients.LvlInfo
+		}
+	}
+
+	return event, nil
+}
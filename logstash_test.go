@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+func TestMalformedLine(t *testing.T) {
+	tenants := map[string]*clients.Tenant{"acme-token": {Name: "acme"}}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+	tests := []struct {
+		name    string
+		policy  string
+		authKey string // The lines are authenticated by a key of their JSON instead of a prefix
+		line    string
+		counted string // Policy counting the line
+		wrapped bool
+		err     bool
+	}{
+		{name: "wrap", policy: "wrap", line: "acme-token not json\n", counted: "wrap", wrapped: true},
+		{name: "unauthenticated", policy: "wrap", authKey: "key", line: "not json", counted: "drop"},
+		{name: "deadletter", policy: "deadletter", line: "acme-token not json", counted: "deadletter"},
+		{name: "drop", policy: "drop", line: "acme-token not json", counted: "drop"},
+		{name: "disconnect", policy: "disconnect", line: "acme-token not json", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := NewConfig()
+			config.MalformedLinePolicy = test.policy
+			if test.authKey != "" {
+				config.LogstashAuthKey = test.authKey
+				config.LogstashAuthValue = "secret"
+			} else {
+				config.LogstashAuthPrefixToken = "global-token"
+			}
+			out := newFakeOutput("out")
+			srv := newTestServer(config, tenants, out)
+			path := filepath.Join(t.TempDir(), "deadletters.json")
+			if test.policy == "deadletter" {
+				sink, err := config.newDeadLetterSink(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				srv.deadLetters = sink
+			}
+
+			counted := malformedLines.Value(test.counted)
+			clt := srv.newSessionHandler(addr, "udp")
+			err := clt.ParseLogstashLine(test.line)
+			if test.err != (err != nil) {
+				t.Fatalf("got error %v", err)
+			}
+			if test.counted != "" && malformedLines.Value(test.counted) != counted+1 {
+				t.Errorf("the line wasn't counted by the %s policy", test.counted)
+			}
+
+			// Only the wrapped lines are forwarded, with the tenant of their prefix
+			if !test.wrapped {
+				if len(out.events) != 0 {
+					t.Errorf("unexpected events %v", out.events)
+				}
+			} else if len(out.events) != 1 {
+				t.Errorf("got %d events", len(out.events))
+			} else {
+				event := out.events[0]
+				if event.Attributes["message"] != "not json" || event.Attributes["parse_error"] != true {
+					t.Errorf("unexpected attributes %v", event.Attributes)
+				}
+				if event.Tenant == nil || event.Tenant.Name != "acme" || event.Source.Tenant != event.Tenant {
+					t.Errorf("unexpected tenant %v", event.Tenant)
+				}
+			}
+
+			if test.policy != "deadletter" {
+				return
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			letter := &deadLetter{}
+			if err := json.Unmarshal(data, letter); err != nil {
+				t.Fatalf("invalid dead letter %q: %s", data, err)
+			}
+			if letter.Line != "not json" || letter.RemoteAddr != addr.String() || letter.Error == "" {
+				t.Errorf("unexpected dead letter %+v", letter)
+			}
+		})
+	}
+}
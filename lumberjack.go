@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/inputs/lumberjack"
+)
+
+func (srv *Server) listenLumberjack() (net.Listener, error) {
+	if srv.config.LumberjackListenAddr == "" {
+		return nil, nil
+	}
+
+	listener, err := srv.listenTCP(srv.config.LumberjackListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", srv.config.LumberjackListenAddr, err)
+	}
+
+	if srv.config.LumberjackTLS {
+		tlsConfig, err := srv.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	srv.log.Infow(
+		"Listening for lumberjack connections",
+		"addr", srv.config.LumberjackListenAddr,
+		"tls", srv.config.LumberjackTLS,
+	)
+
+	go srv.acceptConnections(listener, "lumberjack", (*ClientHandler).runLumberjack)
+
+	return listener, nil
+}
+
+// runLumberjack reads the events sent by a beats client. Each window of events is only acknowledged once all its
+// events have been handed to the output clients.
+func (clt *ClientHandler) runLumberjack() {
+	clt.log.Infow("Client connected", "protocol", "lumberjack")
+
+	defer clt.end()
+
+	// Beats can't send the logstash prefix token, they have to use the auth key (in their fields) or a certificate
+	if clt.server.prefixAuth() && clt.identity == nil {
+		authFailures.Inc(clt.input)
+		clt.log.Warnw("Lumberjack clients can't use the auth prefix token, they need a client certificate")
+		return
+	}
+
+	config := clt.server.config
+	reader := lumberjack.NewReader(
+		clt.Conn,
+		config.LogstashMaxEventSize,
+		config.LumberjackMaxWindowSize,
+		config.LumberjackMaxBatchSize,
+	)
+	for {
+		batch, err := reader.ReadBatch()
+		if err != nil {
+			clt.readFailed(err)
+			return
+		}
+
+		for _, data := range batch.Events {
+			linesRead.Inc(clt.input)
+			event, err := clt.server.beatsEvent(data, clt.identity != nil)
+			if err != nil {
+				authFailures.Inc(clt.input)
+				clt.log.Errorw("Couldn't convert beats event", "err", err)
+				return
+			}
+			if err := clt.checkTenant(event); err != nil {
+				authFailures.Inc(clt.input)
+				clt.log.Errorw("Rejected beats event", "err", err)
+				return
+			}
+			clt.receive(event)
+		}
+
+		if err := lumberjack.WriteACK(clt.Conn, batch.Version, batch.LastSeq); err != nil {
+			clt.log.Errorw("Couldn't acknowledge events", "err", err)
+			return
+		}
+	}
+}
+
+// beatsEvent converts a beats event. Its nested objects are flattened (host.name, log.file.path, agent.type, etc.)
+// and its custom fields are brought to the root like the logstash @fields.
+func (srv *Server) beatsEvent(data map[string]interface{}, authenticated bool) (*clients.LogEvent, error) {
+	attributes := make(map[string]interface{}, len(data))
+
+	delete(data, "@metadata")
+	if fields, ok := data["fields"].(map[string]interface{}); ok {
+		for k, v := range fields {
+			attributes[k] = v
+		}
+		delete(data, "fields")
+	}
+	flattenAttributes(attributes, "", data)
+
+	event, err := srv.logstashEvent(attributes, authenticated)
+	if err != nil {
+		return nil, err
+	}
+
+	if levelName, ok := event.Attributes["log.level"].(string); ok {
+		if level, ok := severityConversions[strings.ToLower(levelName)]; ok {
+			event.Severity = level
+			delete(event.Attributes, "log.level")
+		}
+	}
+
+	return event, nil
+}
+
+func flattenAttributes(dst map[string]interface{}, prefix string, src map[string]interface{}) {
+	for k, v := range src {
+		if nested, ok := v.(map[string]interface{}); ok {
+			flattenAttributes(dst, prefix+k+".", nested)
+		} else {
+			dst[prefix+k] = v
+		}
+	}
+}
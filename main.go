@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strings"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -20,7 +22,39 @@ func getLog(dev bool) *zap.SugaredLogger {
 	return logger.Sugar()
 }
 
+// checkConfig loads and validates the config (and the tenants file) without listening, so that it can be checked
+// before being deployed. It returns the exit code.
+func checkConfig(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: logfwd check-config [config file]")
+		return 2
+	}
+	config := NewConfig()
+	if len(args) == 1 {
+		config.ConfigFile = args[0]
+	}
+	if err := config.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %s\n", err)
+		return 1
+	}
+	rc, err := newReloadableConfig(config, 1)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf("Config is valid, enabled outputs: %s\n", strings.Join(rc.enabledOutputs(), ", "))
+	return 0
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay-dlq" {
+		os.Exit(replayDeadLetters(os.Args[2:]))
+	}
+
 	log := getLog(false)
 
 	log.Infow(
@@ -49,10 +83,65 @@ func main() {
 		"config", server.config,
 	)
 
+	if err := server.loadReloadable(); err != nil {
+		log.Fatalw("Can't load tenants", "err", err)
+	}
+	server.registerMetrics()
+
+	if err := server.openDeadLetters(); err != nil {
+		log.Fatalw("Can't open dead letters", "err", err)
+	}
+
 	if _, err := server.listen(); err != nil {
 		log.Fatalw("Can't listen", "err", err)
 	}
 
+	if _, err := server.listenTLS(); err != nil {
+		log.Fatalw("Can't listen with TLS", "err", err)
+	}
+
+	if _, err := server.listenUDP(); err != nil {
+		log.Fatalw("Can't listen on UDP", "err", err)
+	}
+
+	if _, err := server.listenHTTP(); err != nil {
+		log.Fatalw("Can't listen on HTTP", "err", err)
+	}
+
+	if _, err := server.listenLumberjack(); err != nil {
+		log.Fatalw("Can't listen for lumberjack", "err", err)
+	}
+
+	if _, _, err := server.listenSyslog(); err != nil {
+		log.Fatalw("Can't listen for syslog", "err", err)
+	}
+
+	if _, _, err := server.listenGELF(); err != nil {
+		log.Fatalw("Can't listen for GELF", "err", err)
+	}
+
+	if _, err := server.listenFluent(); err != nil {
+		log.Fatalw("Can't listen for fluent", "err", err)
+	}
+
+	if _, err := server.listenUnix(); err != nil {
+		log.Fatalw("Can't listen on unix socket", "err", err)
+	}
+
+	if _, err := server.listenUnixgram(); err != nil {
+		log.Fatalw("Can't listen on unix datagram socket", "err", err)
+	}
+
+	if _, err := server.listenAdmin(); err != nil {
+		log.Fatalw("Can't listen for admin requests", "err", err)
+	}
+
+	if _, err := server.listenHealth(); err != nil {
+		log.Fatalw("Can't listen for health checks", "err", err)
+	}
+
+	go server.handleSignals()
+
 	exit := <-server.exit
 
 	os.Exit(exit)
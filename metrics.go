@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/metrics"
+)
+
+// Metrics of the inputs and of the events they receive, by input
+var (
+	connections = metrics.NewCounter(
+		"logfwd_connections_total",
+		"Connections accepted",
+		"input",
+	)
+	linesRead = metrics.NewCounter(
+		"logfwd_lines_total",
+		"Lines, datagrams or messages read",
+		"input",
+	)
+	parseFailures = metrics.NewCounter(
+		"logfwd_parse_failures_total",
+		"Lines or messages that couldn't be parsed",
+		"input",
+	)
+	authFailures = metrics.NewCounter(
+		"logfwd_auth_failures_total",
+		"Lines, events or requests rejected by the authentication",
+		"input",
+	)
+	oversizedLines = metrics.NewCounter(
+		"logfwd_oversized_lines_total",
+		"Lines bigger than the maximum size, by action (truncated or discarded)",
+		"input", "action",
+	)
+	eventsReceived = metrics.NewCounter(
+		"logfwd_events_total",
+		"Events received, by severity",
+		"input", "severity",
+	)
+	malformedLines = metrics.NewCounter(
+		"logfwd_malformed_lines_total",
+		"Malformed lines, by policy",
+		"policy",
+	)
+	gelfDroppedChunks = metrics.NewCounter(
+		"logfwd_gelf_dropped_chunks_total",
+		"Chunks of GELF messages dropped as too many messages were incomplete",
+	)
+)
+
+var severityNames = map[clients.Level]string{
+	clients.LvlFinest:   "finest",
+	clients.LvlTrace:    "trace",
+	clients.LvlDebug:    "debug",
+	clients.LvlInfo:     "info",
+	clients.LvlWarning:  "warning",
+	clients.LvlError:    "error",
+	clients.LvlCritical: "critical",
+}
+
+// countFailure counts a line that couldn't be handled, as a parsing or an authentication failure
+func countFailure(input string, err error) {
+	if _, ok := err.(*malformedLineError); ok {
+		parseFailures.Inc(input)
+	} else {
+		authFailures.Inc(input)
+	}
+}
+
+// registerMetrics registers the metrics collected from the clients, once the outputs are started
+func (srv *Server) registerMetrics() {
+	metrics.NewGaugeFunc(
+		"logfwd_output_queue_length",
+		"Events waiting in the queues of the outputs",
+		"output",
+		srv.queueLengths,
+	)
+}
+
+// queueLengths returns the number of events waiting in the queues of each output instance
+func (srv *Server) queueLengths() map[string]float64 {
+	lengths := make(map[string]float64)
+	for _, out := range srv.allOutputs() {
+		lengths[out.Name()] += float64(out.QueueLength())
+	}
+	return lengths
+}
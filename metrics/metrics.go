@@ -0,0 +1,122 @@
+// Package metrics exposes counters, histograms and gauges in the prometheus text format. It wraps the prometheus
+// client with label values passed to each call, all the metrics are registered in a registry of their own.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registry holds the metrics of logfwd, without the ones of the go runtime registered by default
+var registry = prometheus.NewRegistry()
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Counter is a value that only increases
+type Counter struct {
+	name   string
+	labels []string
+	vec    *prometheus.CounterVec
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		name:   name,
+		labels: labels,
+		vec:    prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels),
+	}
+	registry.MustRegister(c.vec)
+	return c
+}
+
+// Inc increments the counter of the label values
+func (c *Counter) Inc(values ...string) {
+	c.vec.WithLabelValues(values...).Inc()
+}
+
+// Add adds to the counter of the label values
+func (c *Counter) Add(v float64, values ...string) {
+	c.vec.WithLabelValues(values...).Add(v)
+}
+
+// Value returns the counter of the label values, as it's exposed
+func (c *Counter) Value(values ...string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		return 0
+	}
+	for _, family := range families {
+		if family.GetName() != c.name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.Metric {
+			for _, label := range metric.Label {
+				for i, name := range c.labels {
+					if name == label.GetName() && values[i] != label.GetValue() {
+						continue metrics
+					}
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+// DurationBuckets are buckets suited to request durations, in seconds
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// NewHistogram creates and registers a histogram
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		vec: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels),
+	}
+	registry.MustRegister(h.vec)
+	return h
+}
+
+// Observe adds an observation for the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.vec.WithLabelValues(values...).Observe(v)
+}
+
+// GaugeFunc is a gauge whose values are collected when the metrics are written
+type GaugeFunc struct {
+	desc    *prometheus.Desc
+	collect func() map[string]float64
+}
+
+// NewGaugeFunc creates and registers a gauge with a single label. The collect function returns its values by label
+// value.
+func NewGaugeFunc(name, help, label string, collect func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{
+		desc:    prometheus.NewDesc(name, help, []string{label}, nil),
+		collect: collect,
+	}
+	registry.MustRegister(g)
+	return g
+}
+
+// Describe implements prometheus.Collector
+func (g *GaugeFunc) Describe(descs chan<- *prometheus.Desc) {
+	descs <- g.desc
+}
+
+// Collect implements prometheus.Collector
+func (g *GaugeFunc) Collect(metrics chan<- prometheus.Metric) {
+	for value, v := range g.collect() {
+		metrics <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, v, value)
+	}
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestHandler(t *testing.T) {
+	counter := NewCounter("test_events_total", "Events", "input", "severity")
+	counter.Inc("tcp", "info")
+	counter.Add(2, "tcp", "info")
+	counter.Inc("udp", `quote " and \ newline`+"\n")
+	if got := counter.Value("tcp", "info"); got != 3 {
+		t.Errorf("got counter %g, want 3", got)
+	}
+	if got := counter.Value("tcp", "error"); got != 0 {
+		t.Errorf("got counter %g, want 0", got)
+	}
+	histogram := NewHistogram("test_duration_seconds", "Durations", []float64{.1, 1}, "output")
+	histogram.Observe(.05, "out")
+	histogram.Observe(.5, "out")
+	histogram.Observe(5, "out")
+	NewGaugeFunc("test_queue_length", "Queue length", "output", func() map[string]float64 {
+		return map[string]float64{"a": 3, "b": 0}
+	})
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	families, err := (&expfmt.TextParser{}).TextToMetricFamilies(recorder.Body)
+	if err != nil {
+		t.Fatalf("the served metrics don't parse: %s", err)
+	}
+	if len(families) != 3 {
+		t.Errorf("got %d metrics", len(families))
+	}
+
+	events := families["test_events_total"]
+	if events == nil || len(events.Metric) != 2 || events.Metric[0].GetCounter().GetValue() != 3 {
+		t.Errorf("unexpected counter %v", events)
+	} else if label := events.Metric[1].Label[0]; label.GetValue() != "udp" {
+		t.Errorf("unexpected label %v", label)
+	} else if label := events.Metric[1].Label[1]; label.GetValue() != `quote " and \ newline`+"\n" {
+		t.Errorf("the label value %q wasn't escaped", label.GetValue())
+	}
+
+	durations := families["test_duration_seconds"]
+	if durations == nil || len(durations.Metric) != 1 {
+		t.Fatalf("unexpected histogram %v", durations)
+	}
+	sample := durations.Metric[0].GetHistogram()
+	if sample.GetSampleCount() != 3 || sample.GetSampleSum() != 5.55 {
+		t.Errorf("got count %d and sum %g", sample.GetSampleCount(), sample.GetSampleSum())
+	}
+	for i, want := range []uint64{1, 2} {
+		if got := sample.Bucket[i].GetCumulativeCount(); got != want {
+			t.Errorf("bucket %g: got %d, want %d", sample.Bucket[i].GetUpperBound(), got, want)
+		}
+	}
+
+	queue := families["test_queue_length"]
+	if queue == nil || len(queue.Metric) != 2 || queue.Metric[0].GetGauge().GetValue() != 3 {
+		t.Errorf("unexpected gauge %v", queue)
+	}
+}
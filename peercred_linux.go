@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// peerCredentials returns the credentials of the process connected to a unix socket
+func peerCredentials(conn *net.UnixConn) (*clients.PeerAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	return &clients.PeerAddr{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}, nil
+}
+
+// enablePassCred asks the kernel to attach the credentials of the sender to each datagram
+func enablePassCred(conn *net.UnixConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var optErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		optErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	}); err != nil {
+		return err
+	}
+	return optErr
+}
+
+// datagramCredentials extracts the credentials of the sender from the out-of-band data of a datagram
+func datagramCredentials(oob []byte) *clients.PeerAddr {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for i := range msgs {
+		if cred, err := syscall.ParseUnixCredentials(&msgs[i]); err == nil {
+			return &clients.PeerAddr{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}
+		}
+	}
+	return nil
+}
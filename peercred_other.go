@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+var errNoPeerCred = errors.New("peer credentials are only available on linux")
+
+func peerCredentials(conn *net.UnixConn) (*clients.PeerAddr, error) {
+	return nil, errNoPeerCred
+}
+
+func enablePassCred(conn *net.UnixConn) error {
+	return nil
+}
+
+func datagramCredentials(oob []byte) *clients.PeerAddr {
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/habx/service-logfwd/clients"
+	"go.uber.org/zap"
+)
+
+// reloadableConfig is the part of the config which can be reloaded without restarting: the outputs and the tenants.
+// The clients switch to a new one between two events.
+type reloadableConfig struct {
+	generation        int                                       // Incremented by each reload
+	outputs           []string                                  // Names of the output instances
+	outputConfigs     map[string]clients.Config                 // Config of each output instance
+	outputDefinitions map[string]clients.OutputClientDefinition // Type of each output instance
+	outputClients     []clients.OutputClient                    // Output clients shared by all the clients
+	tenants           map[string]*clients.Tenant                // Tenants by token
+	senders           sync.WaitGroup                            // Clients sending an event to the output clients
+}
+
+// reloadableSettings are the settings applied by a reload, the other ones require a restart
+var reloadableSettings = map[string]bool{
+	"OUTPUTS":      true,
+	"TENANTS_FILE": true,
+	"CONFIG_FILE":  true,
+}
+
+func newReloadableConfig(config *Config, generation int) (*reloadableConfig, error) {
+	rc := &reloadableConfig{
+		generation:        generation,
+		outputs:           config.Outputs,
+		outputConfigs:     config.OutputClientConfigs,
+		outputDefinitions: config.OutputClientDefinitions,
+	}
+	if config.TenantsFile != "" {
+		tenants, err := loadTenants(config.TenantsFile, config.OutputClientConfigs)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load tenants: %s", err)
+		}
+		rc.tenants = tenants
+	}
+	return rc, nil
+}
+
+// enabledOutputs returns the names of the output instances which are enabled
+func (rc *reloadableConfig) enabledOutputs() []string {
+	var names []string
+	for _, name := range rc.outputs {
+		if rc.outputConfigs[name].Enabled() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// setTenants makes the tenants the ones of the events restored from a disk queue or from the dead letters
+func (rc *reloadableConfig) setTenants() {
+	list := make([]*clients.Tenant, 0, len(rc.tenants))
+	for _, tenant := range rc.tenants {
+		list = append(list, tenant)
+	}
+	clients.SetTenants(list)
+}
+
+// startOutputs creates the output clients of the enabled output instances. The ones already created are closed if one
+// of them can't be.
+func (rc *reloadableConfig) startOutputs(log *zap.SugaredLogger) error {
+	for _, name := range rc.enabledOutputs() {
+		out, err := rc.outputDefinitions[name].Create(name, rc.outputConfigs[name], log)
+		if err != nil {
+			closeOutputs(log, rc.outputClients)
+			rc.outputClients = nil
+			return err
+		}
+		rc.outputClients = append(rc.outputClients, out)
+	}
+	return nil
+}
+
+// closeOutputs closes output clients, they still send the events they have queued
+func closeOutputs(log *zap.SugaredLogger, outputs []clients.OutputClient) {
+	for _, out := range outputs {
+		if err := out.Close(); err != nil {
+			log.Errorw(
+				"Issue closing output client",
+				"clientName", out.Name(),
+				"err", err,
+			)
+		}
+	}
+}
+
+// sendingOutputs filters the outputs which are still sending events
+func sendingOutputs(outputs []clients.OutputClient) []clients.OutputClient {
+	var sending []clients.OutputClient
+	for _, out := range outputs {
+		select {
+		case <-out.Done():
+		default:
+			sending = append(sending, out)
+		}
+	}
+	return sending
+}
+
+// allOutputs returns the output clients, including the ones replaced by reloads which are still sending events
+func (srv *Server) allOutputs() []clients.OutputClient {
+	srv.Lock()
+	defer srv.Unlock()
+	outputs := sendingOutputs(srv.retired)
+	return append(outputs, srv.current().outputClients...)
+}
+
+// outputsSending tells whether some output clients are still sending events
+func (srv *Server) outputsSending() bool {
+	return len(sendingOutputs(srv.allOutputs())) > 0
+}
+
+// current returns the reloadable config in use
+func (srv *Server) current() *reloadableConfig {
+	return srv.reloadable.Load().(*reloadableConfig)
+}
+
+// acquireCurrent returns the reloadable config in use, to send an event to its outputs. They're closed once the
+// config is replaced by a reload and all its senders called senders.Done().
+func (srv *Server) acquireCurrent() *reloadableConfig {
+	srv.sending.RLock()
+	defer srv.sending.RUnlock()
+	rc := srv.current()
+	rc.senders.Add(1)
+	return rc
+}
+
+// loadReloadable sets up the initial reloadable config, loading the tenants file if there's one
+func (srv *Server) loadReloadable() error {
+	rc, err := newReloadableConfig(srv.config, 1)
+	if err != nil {
+		return err
+	}
+	// The disk queues are read as soon as the outputs are started
+	rc.setTenants()
+	if err := rc.startOutputs(srv.log); err != nil {
+		return err
+	}
+	srv.reloadable.Store(rc)
+	if rc.tenants != nil {
+		srv.log.Infow("Loaded tenants", "nbTenants", len(rc.tenants))
+	}
+	return nil
+}
+
+// reload loads the config again (env vars, config file and tenants file) and switches the outputs and the tenants to
+// it. The previous outputs are closed in the background once no event is being sent to them, they still send the
+// events they have queued. An invalid config is rejected and the current one is kept.
+func (srv *Server) reload() error {
+	srv.reloading.Lock()
+	defer srv.reloading.Unlock()
+
+	config := NewConfig()
+	if err := config.Load(); err != nil {
+		return err
+	}
+	return srv.applyConfig(config)
+}
+
+// applyConfig switches the outputs and the tenants to the ones of a loaded config, the reloads are serialized by the
+// caller
+func (srv *Server) applyConfig(config *Config) error {
+	rc, err := newReloadableConfig(config, srv.current().generation+1)
+	if err != nil {
+		return err
+	}
+
+	if changed := changedSettings(srv.config, config); len(changed) > 0 {
+		srv.log.Warnw("Some changed settings require a restart", "settings", changed)
+	}
+
+	rc.setTenants()
+	if err := rc.startOutputs(srv.log); err != nil {
+		srv.current().setTenants()
+		return err
+	}
+	// No event can be sent to the previous outputs once the config is switched, they're closed once the events
+	// being sent to them are
+	srv.sending.Lock()
+	previous := srv.current()
+	srv.reloadable.Store(rc)
+	srv.sending.Unlock()
+
+	srv.Lock()
+	srv.retired = sendingOutputs(append(srv.retired, previous.outputClients...))
+	srv.Unlock()
+	go func() {
+		previous.senders.Wait()
+		closeOutputs(srv.log, previous.outputClients)
+	}()
+
+	srv.log.Infow(
+		"Reloaded config",
+		"generation", rc.generation,
+		"outputs", rc.enabledOutputs(),
+		"nbTenants", len(rc.tenants),
+	)
+	return nil
+}
+
+// changedSettings lists the settings which changed between two configs and aren't applied by a reload
+func changedSettings(previous, next *Config) []string {
+	var changed []string
+	p, n := reflect.ValueOf(previous).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < p.NumField(); i++ {
+		key := p.Type().Field(i).Tag.Get("envconfig")
+		if key == "" || reloadableSettings[key] {
+			continue
+		}
+		if !reflect.DeepEqual(p.Field(i).Interface(), n.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
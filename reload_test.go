@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+func TestReloadInFlight(t *testing.T) {
+	previous, next := newFakeOutput("previous"), newFakeOutput("next")
+	srv := newTestServer(NewConfig(), nil, previous)
+	conn := connectClient(srv)
+	send := func(message string) {
+		if _, err := fmt.Fprintf(conn, "{\"message\": %q}\n", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("before")
+	waitFor(t, "the event sent before the reload", func() bool { return len(previous.messages()) == 1 })
+
+	// An event is being sent to the previous outputs while they're replaced
+	sending := srv.acquireCurrent()
+	if err := srv.applyConfig(newOutputsConfig(next)); err != nil {
+		t.Fatal(err)
+	}
+	if srv.current().generation != 2 {
+		t.Errorf("got generation %d", srv.current().generation)
+	}
+
+	// The client switches to the new outputs, the previous ones aren't closed until the event is sent
+	send("after")
+	waitFor(t, "the event sent after the reload", func() bool { return len(next.messages()) == 1 })
+	if previous.isClosed() {
+		t.Fatal("the previous output was closed while an event was being sent to it")
+	}
+	event := &clients.LogEvent{
+		Attributes: map[string]interface{}{"message": "in flight"},
+		Source:     &clients.Source{Pending: clients.NewPending()},
+	}
+	for _, out := range sending.outputClients {
+		out.Send(event)
+	}
+	sending.senders.Done()
+	waitFor(t, "the previous output to be closed", previous.isClosed)
+
+	if messages := previous.messages(); len(messages) != 2 || messages[0] != "before" || messages[1] != "in flight" {
+		t.Errorf("unexpected messages of the previous output %v", messages)
+	}
+	if messages := next.messages(); len(messages) != 1 || messages[0] != "after" {
+		t.Errorf("unexpected messages of the next output %v", messages)
+	}
+	if next.isClosed() {
+		t.Error("the next output was closed")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// replayStats counts the records of the replayed dead letter files
+type replayStats struct {
+	replayed int
+	skipped  int // Malformed lines, and events of outputs which aren't enabled
+	invalid  int
+	disabled map[string]bool // Outputs which aren't enabled, they're only reported once
+}
+
+// replayDeadLetters sends the events of dead letter files again, through the outputs which couldn't send them. It
+// returns the exit code. The events are queued in memory as the disk queues belong to the server, the ones which
+// can't be sent again are written to OUTPUT_DEADLETTER_FILE.
+func replayDeadLetters(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: logfwd replay-dlq <dead letter file>...")
+		return 2
+	}
+
+	config := NewConfig()
+	if err := config.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %s\n", err)
+		return 1
+	}
+	log := getLog(config.LogEnv == "dev")
+
+	for _, outputConfig := range config.OutputClientConfigs {
+		outputConfig.SetReplay()
+	}
+	rc, err := newReloadableConfig(config, 1)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %s\n", err)
+		return 1
+	}
+	if config.OutputDeadLetterFile != "" {
+		sink, err := config.newDeadLetterSink(config.OutputDeadLetterFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't open output dead letter file: %s\n", err)
+			return 1
+		}
+		clients.SetDeadLetterWriter(sink)
+	}
+	rc.setTenants()
+	if err := rc.startOutputs(log); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't start outputs: %s\n", err)
+		return 1
+	}
+
+	outputs := make(map[string]clients.OutputClient)
+	for _, out := range rc.outputClients {
+		outputs[out.Name()] = out
+	}
+
+	exit := 0
+	stats := &replayStats{disabled: make(map[string]bool)}
+	for _, path := range args {
+		if err := stats.replayFile(path, outputs); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't replay %s: %s\n", path, err)
+			exit = 1
+		}
+	}
+
+	// The outputs send the events they have queued
+	closeOutputs(log, rc.outputClients)
+	for _, out := range rc.outputClients {
+		<-out.Done()
+	}
+
+	fmt.Printf(
+		"Replayed %d events, skipped %d records, %d invalid records\n",
+		stats.replayed,
+		stats.skipped,
+		stats.invalid,
+	)
+	if stats.invalid > 0 {
+		exit = 1
+	}
+	return exit
+}
+
+// replayFile replays the events of a dead letter file. It's only read up to its size when it's opened, as the events
+// which fail again can be appended to it.
+func (stats *replayStats) replayFile(path string, outputs map[string]clients.OutputClient) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close() // nolint: errcheck
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(io.LimitReader(file, info.Size()))
+	for lineNb := 1; ; lineNb++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			stats.replay(fmt.Sprintf("%s:%d", path, lineNb), line, outputs)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// replay sends the event of a dead letter to its output
+func (stats *replayStats) replay(position string, line []byte, outputs map[string]clients.OutputClient) {
+	letter := &clients.EventDeadLetter{}
+	if err := json.Unmarshal(line, letter); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid dead letter: %s\n", position, err)
+		stats.invalid++
+		return
+	}
+
+	// The malformed lines don't have an output, they can share the file
+	if letter.Output == "" {
+		stats.skipped++
+		return
+	}
+	out, ok := outputs[letter.Output]
+	if !ok {
+		if !stats.disabled[letter.Output] {
+			fmt.Fprintf(os.Stderr, "%s: skipping the events of output %s, which isn't enabled\n", position, letter.Output)
+			stats.disabled[letter.Output] = true
+		}
+		stats.skipped++
+		return
+	}
+
+	if err := out.Replay(letter.Event); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid event: %s\n", position, err)
+		stats.invalid++
+		return
+	}
+	stats.replayed++
+}
@@ -1,28 +1,52 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/inputs/proxyproto"
 	"go.uber.org/zap"
 )
 
+const (
+	tlsHandshakeTimeout = 10 * time.Second
+	proxyHeaderTimeout  = 10 * time.Second
+)
+
 type Server struct {
-	config *Config
-	exit   chan int
-	log    *zap.SugaredLogger
+	config        *Config
+	exit          chan int
+	log           *zap.SugaredLogger
+	clientNb      int64
+	tlsReloader   *certReloader
+	deadLetters   *deadLetterSink
+	reloadable    atomic.Value           // *reloadableConfig, replaced by the reloads
+	reloading     sync.Mutex             // Serializes the reloads
+	sending       sync.RWMutex           // Held exclusively to switch the reloadable config, see acquireCurrent
+	sync.Mutex                           // Protects the fields below
+	stopping      bool                   // Set once the shutdown started
+	handlers      map[int]*ClientHandler // Clients whose events are still being handled
+	retired       []clients.OutputClient // Outputs replaced by a reload, still sending their events
+	sessionTables []*sessionTable        // Sessions of the connectionless inputs
+	shutdownHooks []func()               // Functions stopping the inputs
 }
 
 func NewServer(config *Config, log *zap.SugaredLogger) *Server {
 	return &Server{
-		config: config,
-		exit:   make(chan int),
-		log:    log,
+		config:   config,
+		exit:     make(chan int),
+		log:      log,
+		handlers: make(map[int]*ClientHandler),
 	}
 }
 
 func (srv *Server) listen() (net.Listener, error) {
-	listener, err := net.Listen("tcp", srv.config.ListenAddr)
+	listener, err := srv.listenTCP(srv.config.ListenAddr)
 	if err != nil {
 		srv.log.Fatalw("Couldn't listen", "addr", srv.config.ListenAddr, "err", err)
 		return nil, fmt.Errorf("couldn't listen on %s", srv.config.ListenAddr)
@@ -30,22 +54,137 @@ func (srv *Server) listen() (net.Listener, error) {
 
 	srv.log.Infow("Listening for TCP connections", "addr", srv.config.ListenAddr)
 
-	go srv.acceptConnections(listener)
+	go srv.acceptConnections(listener, "tcp", (*ClientHandler).run)
 
 	return listener, nil
 }
 
-func (srv *Server) acceptConnections(listener net.Listener) {
-	clientNb := 0
+// listenTCP listens on a TCP address, reading the PROXY protocol header of the trusted upstreams when it's enabled
+func (srv *Server) listenTCP(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || !srv.config.ProxyProtocol {
+		return listener, err
+	}
+
+	trusted, err := proxyproto.ParseCIDRs(srv.config.ProxyTrustedCIDRs)
+	if err != nil {
+		listener.Close() // nolint: errcheck
+		return nil, err
+	}
+	return proxyproto.NewListener(listener, trusted, proxyHeaderTimeout), nil
+}
+
+// tlsConfig returns the TLS config shared by all the TLS listeners
+func (srv *Server) tlsConfig() (*tls.Config, error) {
+	if srv.tlsReloader == nil {
+		reloader, err := newCertReloader(srv.config, srv.log)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load TLS certificates: %s", err)
+		}
+		srv.tlsReloader = reloader
+		go reloader.watch(srv.config.TLSReloadPeriod)
+	}
+	return srv.tlsReloader.tlsConfig(), nil
+}
+
+func (srv *Server) listenTLS() (net.Listener, error) {
+	if srv.config.TLSListenAddr == "" {
+		return nil, nil
+	}
+
+	tlsConfig, err := srv.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := srv.listenTCP(srv.config.TLSListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", srv.config.TLSListenAddr, err)
+	}
+	listener = tls.NewListener(listener, tlsConfig)
+
+	srv.log.Infow("Listening for TLS connections", "addr", srv.config.TLSListenAddr)
+
+	go srv.acceptConnections(listener, "tls", (*ClientHandler).run)
+
+	return listener, nil
+}
+
+func (srv *Server) nextClientID() int {
+	return int(atomic.AddInt64(&srv.clientNb, 1))
+}
+
+// register keeps track of a client until its events have been handled
+func (srv *Server) register(clt *ClientHandler) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.handlers[clt.id] = clt
+
+	// The shutdown might have started while the client was being created
+	if srv.stopping && clt.Conn != nil {
+		clt.stopReading()
+	}
+}
+
+func (srv *Server) unregister(clt *ClientHandler) {
+	srv.Lock()
+	defer srv.Unlock()
+	delete(srv.handlers, clt.id)
+}
+
+// acceptConnections accepts the connections of a listener, each of them is handled by the run function
+func (srv *Server) acceptConnections(listener net.Listener, input string, run func(*ClientHandler)) {
+	srv.closeOnShutdown(listener)
+
 	for {
 		// Listen for an incoming connection.
 		conn, err := listener.Accept()
 		if err != nil {
+			if srv.isStopping() {
+				return
+			}
 			srv.log.Fatalw("Couldn't accept connection", "err", err)
 			return
 		}
 		// Handle connections in a new goroutine.
-		clientNb++
-		go srv.NewClientHandler(conn, clientNb).run()
+		connections.Inc(input)
+		go srv.handleConnection(conn, input, run)
+	}
+}
+
+func (srv *Server) handleConnection(conn net.Conn, input string, run func(*ClientHandler)) {
+	var identity *clients.Identity
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// The handshake is done before creating the output clients so that they know who they're talking to
+		if err := handshake(tlsConn); err != nil {
+			srv.log.Warnw("TLS handshake failed", "remoteAddr", conn.RemoteAddr(), "err", err)
+			if err := conn.Close(); err != nil {
+				srv.log.Warnw("Issue closing connection", "err", err)
+			}
+			return
+		}
+		identity = tlsIdentity(tlsConn.ConnectionState())
+	}
+
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		// The remote address of a unix socket is meaningless, the credentials of the process are used instead
+		if peer, err := peerCredentials(unixConn); err == nil {
+			conn = &peerConn{Conn: conn, addr: peer}
+		} else {
+			srv.log.Warnw("Couldn't get the peer credentials", "err", err)
+		}
+	}
+
+	run(srv.NewClientHandler(conn, input, identity))
+}
+
+func handshake(conn *tls.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
 	}
+	return conn.SetDeadline(time.Time{})
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+	"go.uber.org/zap"
+)
+
+// fakeOutput records the events it's sent, its sending can be held to keep the events pending
+type fakeOutput struct {
+	name string
+	sync.Mutex
+	events  []*clients.LogEvent
+	pending int
+	hold    chan struct{} // Sending waits until it's closed, if it's set
+	closed  bool
+	done    chan struct{}
+}
+
+func newFakeOutput(name string) *fakeOutput {
+	return &fakeOutput{name: name, done: make(chan struct{})}
+}
+
+// Send records the event, it's handled in the background once the output isn't held anymore
+func (out *fakeOutput) Send(event *clients.LogEvent) {
+	out.Lock()
+	defer out.Unlock()
+	if out.closed {
+		panic(fmt.Sprintf("event sent to the closed output %s", out.name))
+	}
+	out.events = append(out.events, event)
+	out.pending++
+	event.Source.Pending.Add(out.name, 1)
+
+	hold := out.hold
+	go func() {
+		if hold != nil {
+			<-hold
+		}
+		out.Lock()
+		defer out.Unlock()
+		out.pending--
+		event.Source.Pending.Add(out.name, -1)
+		out.closeIfDone()
+	}()
+}
+
+// closeIfDone closes done once the output is closed and its events were handled, the output must be locked
+func (out *fakeOutput) closeIfDone() {
+	if out.closed && out.pending == 0 {
+		select {
+		case <-out.done:
+		default:
+			close(out.done)
+		}
+	}
+}
+
+func (out *fakeOutput) Close() error {
+	out.Lock()
+	defer out.Unlock()
+	out.closed = true
+	out.closeIfDone()
+	return nil
+}
+
+func (out *fakeOutput) Name() string {
+	return out.name
+}
+
+func (out *fakeOutput) Done() <-chan struct{} {
+	return out.done
+}
+
+func (out *fakeOutput) Pending() int {
+	out.Lock()
+	defer out.Unlock()
+	return out.pending
+}
+
+func (out *fakeOutput) QueueLength() int {
+	return out.Pending()
+}
+
+func (out *fakeOutput) QueueUsage() int {
+	return out.Pending() * 100 / 10
+}
+
+func (out *fakeOutput) Replay(event []byte) error {
+	return nil
+}
+
+func (out *fakeOutput) isClosed() bool {
+	out.Lock()
+	defer out.Unlock()
+	return out.closed
+}
+
+// messages returns the messages of the events the output was sent
+func (out *fakeOutput) messages() []string {
+	out.Lock()
+	defer out.Unlock()
+	var messages []string
+	for _, event := range out.events {
+		messages = append(messages, fmt.Sprint(event.Attributes["message"]))
+	}
+	return messages
+}
+
+// fakeDefinition creates a fake output, for the reloads
+type fakeDefinition struct {
+	out *fakeOutput
+}
+
+func (def *fakeDefinition) Name() string {
+	return def.out.name
+}
+
+func (def *fakeDefinition) Config() clients.Config {
+	return &fakeConfig{}
+}
+
+func (def *fakeDefinition) Create(
+	name string,
+	config clients.Config,
+	log *zap.SugaredLogger,
+) (clients.OutputClient, error) {
+	return def.out, nil
+}
+
+type fakeConfig struct{}
+
+func (c *fakeConfig) Load(prefix string) error {
+	return nil
+}
+
+func (c *fakeConfig) Enabled() bool {
+	return true
+}
+
+func (c *fakeConfig) SetReplay() {}
+
+// newOutputsConfig creates a config whose outputs are the given ones
+func newOutputsConfig(outputs ...*fakeOutput) *Config {
+	config := NewConfig()
+	for _, out := range outputs {
+		config.Outputs = append(config.Outputs, out.name)
+		config.OutputClientConfigs[out.name] = &fakeConfig{}
+		config.OutputClientDefinitions[out.name] = &fakeDefinition{out: out}
+	}
+	return config
+}
+
+// newTestServer creates a server whose events are sent to the given outputs
+func newTestServer(config *Config, tenants map[string]*clients.Tenant, outputs ...*fakeOutput) *Server {
+	srv := NewServer(config, zap.NewNop().Sugar())
+	rc := &reloadableConfig{generation: 1, tenants: tenants, outputConfigs: make(map[string]clients.Config)}
+	for _, out := range outputs {
+		rc.outputs = append(rc.outputs, out.name)
+		rc.outputConfigs[out.name] = &fakeConfig{}
+		rc.outputClients = append(rc.outputClients, out)
+	}
+	srv.reloadable.Store(rc)
+	return srv
+}
+
+// connectClient connects a logstash client to the server through a pipe, it returns the end of the client
+func connectClient(srv *Server) net.Conn {
+	conn, remote := net.Pipe()
+	clt := srv.NewClientHandler(conn, "tcp", nil)
+	go clt.run()
+	return remote
+}
+
+// waitFor waits until the condition is true, it fails the test after a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// sessionTable groups the events of connectionless inputs into virtual client sessions, so that the output clients
+// still get stable sessions. A session is identified by the source address and the value of a key attribute, and is
+// ended when it hasn't received any event for some time.
+type sessionTable struct {
+	server      *Server
+	input       string // Name of the input, for the metrics
+	keyAttr     string
+	idleTimeout time.Duration
+	done        chan struct{} // Closed when shutting down, it stops the expiry
+	sync.Mutex
+	sessions map[string]*session
+	ended    bool // Set when shutting down
+}
+
+// session is the handler of a virtual client. Its lock keeps the order of its events without holding the lock of the
+// table while they're handed to the outputs, which can block.
+type session struct {
+	sync.Mutex
+	handler  *ClientHandler
+	lastSeen time.Time // Protected by the lock of the table
+	ended    bool
+}
+
+func (srv *Server) newSessionTable(input string) *sessionTable {
+	table := &sessionTable{
+		server:      srv,
+		input:       input,
+		keyAttr:     srv.config.SessionKey,
+		idleTimeout: srv.config.SessionIdleTimeout,
+		done:        make(chan struct{}),
+		sessions:    make(map[string]*session),
+	}
+
+	srv.Lock()
+	srv.sessionTables = append(srv.sessionTables, table)
+	srv.Unlock()
+
+	go table.expireSessions()
+
+	return table
+}
+
+// send hands the event to the session it belongs to, creating the session if needed
+func (t *sessionTable) send(addr net.Addr, event *clients.LogEvent) {
+	key := addr.String()
+	if t.keyAttr != "" {
+		key = fmt.Sprintf("%s/%v", key, event.Attributes[t.keyAttr])
+	}
+	if event.Tenant != nil {
+		key = event.Tenant.Name + "/" + key
+	}
+
+	for {
+		sess := t.session(addr, key)
+		if sess == nil {
+			t.server.log.Warnw("Dropping event received while shutting down", "remoteAddr", addr)
+			return
+		}
+
+		sess.Lock()
+		if !sess.ended {
+			sess.handler.receive(event)
+			sess.Unlock()
+			return
+		}
+		// The session ended since it was found, the event goes to a new one
+		sess.Unlock()
+	}
+}
+
+// session returns the session of a key, creating it if needed. It returns nil once the table is ended.
+func (t *sessionTable) session(addr net.Addr, key string) *session {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.ended {
+		return nil
+	}
+
+	sess, ok := t.sessions[key]
+	if !ok {
+		sess = &session{handler: t.server.newSessionHandler(addr, t.input)}
+		sess.handler.log.Infow("Session started", "remoteAddr", addr, "sessionKey", key)
+		t.sessions[key] = sess
+	}
+	sess.lastSeen = time.Now()
+	return sess
+}
+
+// end ends the session, once the event it may be handing to the outputs is handed
+func (sess *session) end() {
+	sess.Lock()
+	defer sess.Unlock()
+	sess.ended = true
+	sess.handler.end()
+}
+
+// expireSessions ends the idle sessions, until the sessions are all ended
+func (t *sessionTable) expireSessions() {
+	ticker := time.NewTicker(t.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*session
+		t.Lock()
+		for key, sess := range t.sessions {
+			if time.Since(sess.lastSeen) > t.idleTimeout {
+				expired = append(expired, sess)
+				delete(t.sessions, key)
+			}
+		}
+		t.Unlock()
+
+		for _, sess := range expired {
+			sess.handler.log.Infow("Session expired")
+			sess.end()
+		}
+	}
+}
+
+// endAll ends all the sessions, no session can be started afterwards
+func (t *sessionTable) endAll() {
+	t.Lock()
+	if !t.ended {
+		close(t.done)
+	}
+	t.ended = true
+	sessions := t.sessions
+	t.sessions = make(map[string]*session)
+	t.Unlock()
+
+	for _, sess := range sessions {
+		sess.end()
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+func TestSessionExpiry(t *testing.T) {
+	config := NewConfig()
+	config.SessionIdleTimeout = 20 * time.Millisecond
+	out := newFakeOutput("out")
+	srv := newTestServer(config, nil, out)
+	table := srv.newSessionTable("udp")
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	event := func() *clients.LogEvent {
+		return &clients.LogEvent{Attributes: map[string]interface{}{"message": "m"}}
+	}
+
+	table.send(addr, event())
+	if srv.nbHandlers() != 1 {
+		t.Fatalf("got %d sessions", srv.nbHandlers())
+	}
+	waitFor(t, "the idle session to expire", func() bool { return srv.nbHandlers() == 0 })
+	messages := out.messages()
+	if len(messages) != 2 || messages[0] != "m" || messages[1] != "Client disconnected" {
+		t.Errorf("unexpected messages %v", messages)
+	}
+
+	// Ending the table stops the expiry, the events received afterwards are dropped
+	table.endAll()
+	select {
+	case <-table.done:
+	default:
+		t.Fatal("the expiry wasn't stopped")
+	}
+	table.endAll()
+	table.send(addr, event())
+	if srv.nbHandlers() != 0 || len(out.messages()) != 2 {
+		t.Errorf("an event was accepted after the end")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const drainCheckPeriod = 100 * time.Millisecond
+
+// handleSignals reloads the config on SIGHUP and shuts the server down on SIGTERM or SIGINT, a second signal stops it
+// immediately
+func (srv *Server) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		if err := srv.reload(); err != nil {
+			srv.log.Errorw("Couldn't reload config, keeping the current one", "err", err)
+		}
+		sig = <-signals
+	}
+	signal.Ignore(syscall.SIGHUP)
+
+	srv.log.Infow("Shutting down", "signal", sig.String(), "drainTimeout", srv.config.ShutdownDrainTimeout)
+
+	go func() {
+		sig := <-signals
+		srv.log.Warnw("Stopping immediately", "signal", sig.String())
+		srv.exit <- 1
+	}()
+
+	srv.shutdown(srv.config.ShutdownDrainTimeout)
+	srv.exit <- 0
+}
+
+func (srv *Server) isStopping() bool {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.stopping
+}
+
+// onShutdown registers a function stopping an input
+func (srv *Server) onShutdown(stop func()) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.shutdownHooks = append(srv.shutdownHooks, stop)
+}
+
+// closeOnShutdown registers a listener (or a packet connection) to close when shutting down
+func (srv *Server) closeOnShutdown(closer io.Closer) {
+	srv.onShutdown(func() {
+		if err := closer.Close(); err != nil {
+			srv.log.Warnw("Issue closing listener", "err", err)
+		}
+	})
+}
+
+// shutdown stops the inputs, lets the clients finish their current message and waits for the outputs to send all
+// their events. The events that weren't sent before the timeout are lost.
+func (srv *Server) shutdown(timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	srv.Lock()
+	srv.stopping = true
+	hooks := srv.shutdownHooks
+	tables := srv.sessionTables
+	for _, clt := range srv.handlers {
+		if clt.Conn != nil {
+			clt.stopReading()
+		}
+	}
+	srv.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		// No new connection, datagram or request is accepted from now on
+		for _, stop := range hooks {
+			stop()
+		}
+		for _, table := range tables {
+			table.endAll()
+		}
+		for srv.nbHandlers() > 0 {
+			time.Sleep(drainCheckPeriod)
+		}
+		// The outputs handled the events of all the clients
+		outputs := srv.allOutputs()
+		closeOutputs(srv.log, srv.current().outputClients)
+		for _, out := range outputs {
+			<-out.Done()
+		}
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		if _, nbEvents := srv.pendingEvents(); nbEvents > 0 {
+			// The outputs with a disk queue stop reading it, its events are sent after the restart
+			srv.log.Infow("Events were kept in the disk queues", "nbEvents", nbEvents)
+		} else {
+			srv.log.Infow("All the events were sent")
+		}
+	case <-deadline:
+		nbClients, nbEvents := srv.pendingEvents()
+		srv.log.Errorw(
+			"Drain deadline reached, some events weren't sent",
+			"nbClients", nbClients,
+			"nbUnsentEvents", nbEvents,
+		)
+	}
+}
+
+func (srv *Server) nbHandlers() int {
+	srv.Lock()
+	defer srv.Unlock()
+	return len(srv.handlers)
+}
+
+// pendingEvents returns the number of clients whose events are still being sent, and the number of events the
+// outputs haven't handled yet
+func (srv *Server) pendingEvents() (int, int) {
+	nbEvents := 0
+	for _, out := range srv.allOutputs() {
+		nbEvents += out.Pending()
+	}
+	return srv.nbHandlers(), nbEvents
+}
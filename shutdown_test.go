@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	t.Run("drained", func(t *testing.T) {
+		out := newFakeOutput("out")
+		out.hold = make(chan struct{})
+		srv := newTestServer(NewConfig(), nil, out)
+		conn := connectClient(srv)
+		if _, err := fmt.Fprintln(conn, `{"message": "a"}`); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the event to be sent", func() bool { return out.Pending() == 1 })
+
+		stopped := make(chan struct{})
+		go func() {
+			srv.shutdown(5 * time.Second)
+			close(stopped)
+		}()
+
+		// The client is disconnected, the shutdown waits for the outputs to handle its events
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("the client wasn't disconnected: %v", err)
+		}
+		waitFor(t, "the disconnection event", func() bool { return out.Pending() == 2 })
+		select {
+		case <-stopped:
+			t.Fatal("the shutdown didn't wait for the pending events")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		close(out.hold)
+		<-stopped
+		if !out.isClosed() || out.Pending() != 0 || srv.nbHandlers() != 0 {
+			t.Errorf("the server wasn't drained")
+		}
+		if messages := out.messages(); len(messages) != 2 || messages[0] != "a" || messages[1] != "Client disconnected" {
+			t.Errorf("unexpected messages %v", messages)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		out := newFakeOutput("out")
+		out.hold = make(chan struct{})
+		defer close(out.hold)
+		srv := newTestServer(NewConfig(), nil, out)
+		conn := connectClient(srv)
+		if _, err := fmt.Fprintln(conn, `{"message": "a"}`); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the event to be sent", func() bool { return out.Pending() == 1 })
+
+		// The events still pending at the deadline are given up
+		start := time.Now()
+		srv.shutdown(200 * time.Millisecond)
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("the shutdown took %s", elapsed)
+		}
+		if nbClients, nbEvents := srv.pendingEvents(); nbClients != 1 || nbEvents != 2 {
+			t.Errorf("got %d clients and %d events pending", nbClients, nbEvents)
+		}
+	})
+}
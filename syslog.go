@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+	"github.com/habx/service-logfwd/inputs/syslog"
+)
+
+// listenSyslog listens for syslog messages on both TCP and UDP
+func (srv *Server) listenSyslog() (net.Listener, net.PacketConn, error) {
+	addr := srv.config.SyslogListenAddr
+	if addr == "" {
+		return nil, nil, nil
+	}
+
+	listener, err := srv.listenTCP(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't listen on TCP %s: %s", addr, err)
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't listen on UDP %s: %s", addr, err)
+	}
+
+	srv.log.Infow("Listening for syslog messages", "addr", addr)
+
+	go srv.acceptConnections(listener, "syslog", (*ClientHandler).runSyslog)
+	go srv.readSyslogDatagrams(conn, srv.newSessionTable("syslog"))
+
+	return listener, conn, nil
+}
+
+// runSyslog reads the syslog messages of a TCP connection
+func (clt *ClientHandler) runSyslog() {
+	clt.log.Infow("Client connected", "protocol", "syslog")
+
+	defer clt.end()
+
+	reader := syslog.NewReader(clt.Conn, clt.server.config.LogstashMaxEventSize)
+	for {
+		data, err := reader.ReadMessage()
+		if err != nil {
+			clt.readFailed(err)
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		// Syslog clients don't expect any answer, invalid messages are just skipped
+		linesRead.Inc(clt.input)
+		msg, err := syslog.Parse(data)
+		if err != nil {
+			parseFailures.Inc(clt.input)
+			clt.log.Warnw("Couldn't parse syslog message", "message", string(data), "err", err)
+			continue
+		}
+
+		clt.receive(syslogEvent(msg))
+	}
+}
+
+func (srv *Server) readSyslogDatagrams(conn net.PacketConn, sessions *sessionTable) {
+	srv.closeOnShutdown(conn)
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if srv.isStopping() {
+				return
+			}
+			srv.log.Fatalw("Couldn't read datagram", "err", err)
+			return
+		}
+
+		linesRead.Inc(sessions.input)
+		msg, err := syslog.Parse(buffer[:n])
+		if err != nil {
+			parseFailures.Inc(sessions.input)
+			srv.log.Warnw(
+				"Couldn't parse syslog datagram",
+				"remoteAddr", addr,
+				"message", string(buffer[:n]),
+				"err", err,
+			)
+			continue
+		}
+
+		sessions.send(addr, syslogEvent(msg))
+	}
+}
+
+// syslogEvent converts a syslog message. Its header fields become attributes, as well as the parameters of its
+// structured data (as "SD-ID.PARAM-NAME").
+func syslogEvent(msg *syslog.Message) *clients.LogEvent {
+	event := &clients.LogEvent{
+		Timestamp: msg.Timestamp,
+		Severity:  syslog.SeverityLevel(msg.Severity),
+		Attributes: map[string]interface{}{
+			"message":  msg.Message,
+			"facility": msg.FacilityName(),
+		},
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	for name, value := range map[string]string{
+		"hostname": msg.Hostname,
+		"appname":  msg.AppName,
+		"procid":   msg.ProcID,
+		"msgid":    msg.MsgID,
+	} {
+		if value != "" {
+			event.Attributes[name] = value
+		}
+	}
+
+	for id, params := range msg.StructuredData {
+		for name, value := range params {
+			event.Attributes[id+"."+name] = value
+		}
+	}
+
+	return event
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+// tenantConfig is the definition of a tenant in the tenants file
+type tenantConfig struct {
+	Token        string                 `json:"token"`         // Auth token of the tenant
+	OutputTokens map[string]string      `json:"output_tokens"` // Token of each output client
+	Attributes   map[string]interface{} `json:"attributes"`    // Default attributes of the events
+}
+
+// loadTenants loads the tenants file, a JSON object of the tenant configs by name. The tenants are returned by token.
+func loadTenants(path string, outputs map[string]clients.Config) (map[string]*clients.Tenant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs map[string]*tenantConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid tenants file: %s", err)
+	}
+
+	tenants := make(map[string]*clients.Tenant, len(configs))
+	for name, conf := range configs {
+		if conf.Token == "" {
+			return nil, fmt.Errorf("tenant %s has no token", name)
+		}
+		if other, ok := tenants[conf.Token]; ok {
+			return nil, fmt.Errorf("tenants %s and %s have the same token", name, other.Name)
+		}
+		for output := range conf.OutputTokens {
+			if _, ok := outputs[output]; !ok {
+				return nil, fmt.Errorf("tenant %s has a token for the unknown output %s", name, output)
+			}
+		}
+		tenants[conf.Token] = &clients.Tenant{
+			Name:         name,
+			OutputTokens: conf.OutputTokens,
+			Attributes:   conf.Attributes,
+		}
+	}
+	return tenants, nil
+}
+
+// prefixAuth tells if the lines are authenticated with a prefix token rather than with the auth key. Tenants use the
+// prefix token unless the auth key is configured.
+func (srv *Server) prefixAuth() bool {
+	return srv.config.LogstashAuthPrefixToken != "" || (srv.current().tenants != nil && srv.config.LogstashAuthKey == "")
+}
+
+// tokenTenant checks an auth token, which is either the global token (of the default tenant) or a tenant token. The
+// global token is compared in constant time.
+func (srv *Server) tokenTenant(global clients.Secret, token string) (*clients.Tenant, bool) {
+	if global != "" && subtle.ConstantTimeCompare([]byte(token), []byte(global)) == 1 {
+		return nil, true
+	}
+	tenant, ok := srv.current().tenants[token]
+	return tenant, ok
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/habx/service-logfwd/clients"
+)
+
+func writeTenantsFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTenants(t *testing.T) {
+	outputs := map[string]clients.Config{"scalyr": nil}
+	path := writeTenantsFile(t, `{
+		"acme": {"token": "acme-token", "output_tokens": {"scalyr": "acme-scalyr"}, "attributes": {"team": "a"}},
+		"initech": {"token": "initech-token"}
+	}`)
+	tenants, err := loadTenants(path, outputs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(tenants) != 2 || tenants["initech-token"].Name != "initech" {
+		t.Fatalf("unexpected tenants %v", tenants)
+	}
+	acme := tenants["acme-token"]
+	if acme.OutputToken("scalyr", "default") != "acme-scalyr" || acme.Attributes["team"] != "a" {
+		t.Errorf("unexpected tenant %+v", acme)
+	}
+	if tenants["initech-token"].OutputToken("scalyr", "default") != "default" {
+		t.Error("the tenant without a scalyr token doesn't use the default one")
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"duplicate token", `{"a": {"token": "t"}, "b": {"token": "t"}}`, "have the same token"},
+		{"empty token", `{"a": {"token": ""}}`, "tenant a has no token"},
+		{"unknown output", `{"a": {"token": "t", "output_tokens": {"datadog": "x"}}}`, "unknown output datadog"},
+		{"invalid file", `["a"]`, "invalid tenants file"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTenants(writeTenantsFile(t, test.content), outputs)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestTokenTenant(t *testing.T) {
+	acme := &clients.Tenant{Name: "acme"}
+	srv := newTestServer(NewConfig(), map[string]*clients.Tenant{"acme-token": acme})
+
+	tests := []struct {
+		global string
+		token  string
+		tenant *clients.Tenant
+		valid  bool
+	}{
+		{"global", "global", nil, true},
+		{"global", "acme-token", acme, true},
+		{"global", "globa", nil, false},
+		{"global", "", nil, false},
+		{"", "", nil, false}, // Without a global token, only the tenants are accepted
+	}
+	for _, test := range tests {
+		tenant, valid := srv.tokenTenant(clients.Secret(test.global), test.token)
+		if tenant != test.tenant || valid != test.valid {
+			t.Errorf("token %q with global %q: got %v and %t", test.token, test.global, tenant, valid)
+		}
+	}
+}
+
+func TestPrefixTenant(t *testing.T) {
+	acme := &clients.Tenant{Name: "acme"}
+	config := NewConfig()
+	config.LogstashAuthPrefixToken = "global"
+	srv := newTestServer(config, map[string]*clients.Tenant{"acme-token": acme})
+
+	tests := []struct {
+		name          string
+		line          string
+		authenticated bool // The client presented a certificate
+		tenant        *clients.Tenant
+		err           bool
+	}{
+		{"global token", `global {"message": "m"}`, false, nil, false},
+		{"tenant token", `acme-token {"message": "m"}`, false, acme, false},
+		{"wrong token", `other {"message": "m"}`, false, nil, true},
+		{"no token", `{"message":"m"}`, false, nil, true},
+		// The trusted clients don't need a prefix, they might send one to choose their tenant
+		{"trusted without token", `{"message": "m"}`, true, nil, false},
+		{"trusted with tenant token", `acme-token {"message": "m"}`, true, acme, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := srv.parseLogstashLine(test.line, test.authenticated)
+			if test.err {
+				if err == nil {
+					t.Errorf("the line was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if event.Tenant != test.tenant || event.Attributes["message"] != "m" {
+				t.Errorf("got tenant %v and attributes %v", event.Tenant, event.Attributes)
+			}
+		})
+	}
+}
+
+func TestCheckTenant(t *testing.T) {
+	acme, initech := &clients.Tenant{Name: "acme"}, &clients.Tenant{Name: "initech"}
+	srv := newTestServer(NewConfig(), nil, newFakeOutput("out"))
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	event := func(tenant *clients.Tenant) *clients.LogEvent {
+		return &clients.LogEvent{Attributes: map[string]interface{}{}, Tenant: tenant}
+	}
+
+	// A client keeps the tenant of its first event, the events of the default tenant are accepted
+	clt := srv.newSessionHandler(addr, "udp")
+	if err := clt.checkTenant(event(acme)); err != nil {
+		t.Fatalf("the first event was rejected: %s", err)
+	}
+	clt.receive(event(acme))
+	if err := clt.checkTenant(event(&clients.Tenant{Name: "acme"})); err != nil {
+		t.Errorf("the reloaded tenant was rejected: %s", err)
+	}
+	if err := clt.checkTenant(event(nil)); err != nil {
+		t.Errorf("the event of the default tenant was rejected: %s", err)
+	}
+	if err := clt.checkTenant(event(initech)); err == nil {
+		t.Error("the event of another tenant was accepted")
+	}
+
+	// A client of the default tenant can't send the events of a tenant
+	clt = srv.newSessionHandler(addr, "udp")
+	clt.receive(event(nil))
+	if err := clt.checkTenant(event(acme)); err == nil {
+		t.Error("the event of a tenant was accepted from a client of the default tenant")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/habx/service-logfwd/clients"
+	"go.uber.org/zap"
+)
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// certReloader keeps the TLS certificate (and the CA used to check clients) up to date with the files on disk
+type certReloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+	log        *zap.SugaredLogger
+
+	sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func newCertReloader(config *Config, log *zap.SugaredLogger) (*certReloader, error) {
+	r := &certReloader{
+		certFile:   config.TLSCertFile,
+		keyFile:    config.TLSKeyFile,
+		caFile:     config.TLSCAFile,
+		clientAuth: tlsClientAuthTypes[config.TLSClientAuth],
+		log:        log.With("component", "tls"),
+		modTimes:   make(map[string]time.Time),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+func (r *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load key pair: %s", err)
+	}
+
+	var caPool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read CA file: %s", err)
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in CA file %s", r.caFile)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.cert = &cert
+	r.caPool = caPool
+	r.modTimes = modTimes
+
+	return nil
+}
+
+func (r *certReloader) changed() bool {
+	r.RLock()
+	defer r.RUnlock()
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// The file might be in the middle of being replaced, we'll check again later
+			return false
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates whenever one of the files changes
+func (r *certReloader) watch(period time.Duration) {
+	for range time.Tick(period) {
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			r.log.Errorw("Couldn't reload certificates, keeping the previous ones", "err", err)
+		} else {
+			r.log.Infow("Reloaded certificates", "certFile", r.certFile)
+		}
+	}
+}
+
+// tlsConfig returns a configuration that always uses the most recently loaded certificates
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.RLock()
+			defer r.RUnlock()
+			conf := &tls.Config{
+				Certificates: []tls.Certificate{*r.cert},
+				MinVersion:   tls.VersionTLS12,
+			}
+			if r.caPool != nil {
+				conf.ClientCAs = r.caPool
+				conf.ClientAuth = r.clientAuth
+			}
+			return conf, nil
+		},
+	}
+}
+
+// tlsIdentity extracts the identity of a client from its verified certificate
+func tlsIdentity(state tls.ConnectionState) *clients.Identity {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	identity := &clients.Identity{
+		CommonName: cert.Subject.CommonName,
+	}
+	identity.SANs = append(identity.SANs, cert.DNSNames...)
+	identity.SANs = append(identity.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		identity.SANs = append(identity.SANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		identity.SANs = append(identity.SANs, uri.String())
+	}
+	return identity
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// maxDatagramSize is the biggest payload a UDP datagram can carry
+const maxDatagramSize = 65535
+
+func (srv *Server) listenUDP() (net.PacketConn, error) {
+	if srv.config.UDPListenAddr == "" {
+		return nil, nil
+	}
+
+	conn, err := net.ListenPacket("udp", srv.config.UDPListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", srv.config.UDPListenAddr, err)
+	}
+
+	srv.log.Infow("Listening for UDP datagrams", "addr", srv.config.UDPListenAddr)
+
+	sessions := srv.newSessionTable("udp")
+	go srv.readDatagrams(conn, sessions)
+
+	return conn, nil
+}
+
+func (srv *Server) readDatagrams(conn net.PacketConn, sessions *sessionTable) {
+	srv.closeOnShutdown(conn)
+
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if srv.isStopping() {
+				return
+			}
+			srv.log.Fatalw("Couldn't read datagram", "err", err)
+			return
+		}
+
+		// Each datagram usually contains a single event, but some clients group them with newlines
+		for _, line := range bytes.Split(buffer[:n], []byte{'\n'}) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			linesRead.Inc(sessions.input)
+			event, err := srv.parseLogstashLine(string(line), false)
+			if err != nil {
+				countFailure(sessions.input, err)
+			}
+			if malformed, ok := err.(*malformedLineError); ok && srv.config.MalformedLinePolicy != "disconnect" {
+				if event = srv.malformedEvent(addr, malformed); event == nil {
+					continue
+				}
+			} else if err != nil {
+				srv.log.Warnw(
+					"Couldn't parse logstash datagram",
+					"remoteAddr", addr,
+					"line", string(line),
+					"err", err,
+				)
+				continue
+			}
+			sessions.send(addr, event)
+		}
+	}
+}
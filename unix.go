@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// peerConn is a unix socket connection whose remote address is the credentials of the connected process
+type peerConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// unixListener removes the socket file when it's closed. It can be closed several times, so that it's closed by the
+// shutdown even before its connections are accepted.
+type unixListener struct {
+	net.Listener
+	path  string
+	close sync.Once
+	err   error
+}
+
+func (l *unixListener) Close() error {
+	l.close.Do(func() {
+		l.err = closeSocket(l.Listener, l.path)
+	})
+	return l.err
+}
+
+func (srv *Server) listenUnix() (net.Listener, error) {
+	path := srv.config.UnixListenPath
+	if path == "" {
+		return nil, nil
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", path, err)
+	}
+
+	if err := srv.setSocketPermissions(path); err != nil {
+		return nil, err
+	}
+
+	srv.log.Infow("Listening for unix socket connections", "path", path)
+
+	listener = &unixListener{Listener: listener, path: path}
+	srv.closeOnShutdown(listener)
+	go srv.acceptConnections(listener, "unix", (*ClientHandler).run)
+
+	return listener, nil
+}
+
+func (srv *Server) listenUnixgram() (net.PacketConn, error) {
+	path := srv.config.UnixDgramListenPath
+	if path == "" {
+		return nil, nil
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't listen on %s: %s", path, err)
+	}
+
+	if err := enablePassCred(conn); err != nil {
+		return nil, fmt.Errorf("couldn't enable credentials passing on %s: %s", path, err)
+	}
+
+	if err := srv.setSocketPermissions(path); err != nil {
+		return nil, err
+	}
+
+	srv.log.Infow("Listening for unix socket datagrams", "path", path)
+
+	srv.onShutdown(func() {
+		if err := closeSocket(conn, path); err != nil {
+			srv.log.Warnw("Issue closing unix socket", "path", path, "err", err)
+		}
+	})
+	go srv.readUnixDatagrams(conn, srv.newSessionTable("unixgram"))
+
+	return conn, nil
+}
+
+func (srv *Server) readUnixDatagrams(conn *net.UnixConn, sessions *sessionTable) {
+	buffer := make([]byte, maxDatagramSize)
+	oob := make([]byte, 128) // Large enough for the credentials control message
+	for {
+		n, oobn, _, from, err := conn.ReadMsgUnix(buffer, oob)
+		if err != nil {
+			if srv.isStopping() {
+				return
+			}
+			srv.log.Fatalw("Couldn't read datagram", "err", err)
+			return
+		}
+
+		var addr net.Addr = from
+		if peer := datagramCredentials(oob[:oobn]); peer != nil {
+			addr = peer
+		} else if from == nil {
+			addr = &net.UnixAddr{Name: "@", Net: "unixgram"}
+		}
+
+		for _, line := range bytes.Split(buffer[:n], []byte{'\n'}) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			linesRead.Inc(sessions.input)
+			event, err := srv.parseLogstashLine(string(line), false)
+			if err != nil {
+				countFailure(sessions.input, err)
+			}
+			if malformed, ok := err.(*malformedLineError); ok && srv.config.MalformedLinePolicy != "disconnect" {
+				if event = srv.malformedEvent(addr, malformed); event == nil {
+					continue
+				}
+			} else if err != nil {
+				srv.log.Warnw(
+					"Couldn't parse logstash datagram",
+					"remoteAddr", addr,
+					"line", string(line),
+					"err", err,
+				)
+				continue
+			}
+			sessions.send(addr, event)
+		}
+	}
+}
+
+// removeStaleSocket removes the socket file left by a previous instance
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and isn't a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// closeSocket closes a unix socket and removes its file, so that it isn't left behind after a shutdown
+func closeSocket(socket io.Closer, path string) error {
+	err := socket.Close()
+	if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+func (srv *Server) setSocketPermissions(path string) error {
+	mode, err := strconv.ParseUint(srv.config.UnixSocketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid socket mode %s: %s", srv.config.UnixSocketMode, err)
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		return fmt.Errorf("couldn't change the mode of %s: %s", path, err)
+	}
+
+	if srv.config.UnixSocketOwner == "" && srv.config.UnixSocketGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if srv.config.UnixSocketOwner != "" {
+		if uid, err = lookupID(srv.config.UnixSocketOwner, lookupUserID); err != nil {
+			return fmt.Errorf("unknown socket owner %s: %s", srv.config.UnixSocketOwner, err)
+		}
+	}
+	if srv.config.UnixSocketGroup != "" {
+		if gid, err = lookupID(srv.config.UnixSocketGroup, lookupGroupID); err != nil {
+			return fmt.Errorf("unknown socket group %s: %s", srv.config.UnixSocketGroup, err)
+		}
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("couldn't change the owner of %s: %s", path, err)
+	}
+	return nil
+}
+
+// lookupID accepts either a numeric ID or a name
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+func lookupUserID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroupID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
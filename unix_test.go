@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocketCleanup(t *testing.T) {
+	dir := t.TempDir()
+	config := NewConfig()
+	config.UnixListenPath = filepath.Join(dir, "stream.sock")
+	config.UnixDgramListenPath = filepath.Join(dir, "dgram.sock")
+	srv := newTestServer(config, nil, newFakeOutput("out"))
+
+	if _, err := srv.listenUnix(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.listenUnixgram(); err != nil {
+		t.Fatal(err)
+	}
+	for network, path := range map[string]string{"unix": config.UnixListenPath, "unixgram": config.UnixDgramListenPath} {
+		conn, err := net.Dial(network, path)
+		if err != nil {
+			t.Fatalf("couldn't connect to %s: %s", path, err)
+		}
+		conn.Close() // nolint: errcheck
+	}
+
+	srv.shutdown(time.Second)
+	for _, path := range []string{config.UnixListenPath, config.UnixDgramListenPath} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed: %v", path, err)
+		}
+	}
+}